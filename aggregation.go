@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// the aggregates are the series of the resource counters with __rancher__ names, which is the legacy output
+	aggregationModeSentinel = "sentinel"
+	// the aggregates are the separate families, e.g. rancher_stacks_bootstrap_environment_total
+	aggregationModeFamilies = "families"
+	// the aggregates are not exported, they can be aggregated by sum() in Prometheus
+	aggregationModeNone = "none"
+)
+
+// the levels of the aggregates, in the order of the label names after the environment labels
+var aggregationLevels = []string{"environment", "stack", "service"}
+
+// discardedCounter counts the aggregates which are not exported, it is never registered.
+var discardedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "discarded_total",
+})
+
+func initAggregationMode() error {
+	switch aggregationMode {
+	case aggregationModeSentinel, aggregationModeFamilies, aggregationModeNone:
+		return nil
+	}
+	return fmt.Errorf("invalid aggregation mode %q", aggregationMode)
+}
+
+// aggregatedCounterVec is a counter vector of the stacks, services or instances with their aggregates,
+// an aggregate is counted with the label values from its level on being specialTag,
+// e.g. (environment_id, environment_name, stack_name, __rancher__) counts the services of a stack.
+type aggregatedCounterVec struct {
+	*prometheus.CounterVec
+
+	// the name without the namespace, which is used in the state file
+	name       string
+	labelNames []string
+
+	// the families of the aggregates of each level, the environment, the stack and the service
+	aggregates     []*prometheus.CounterVec
+	aggregateNames []string
+}
+
+// newAggregatedCounterVec creates the counter vector, the label names must be the environment labels and the resource labels.
+func newAggregatedCounterVec(opts prometheus.CounterOpts, labelNames []string) *aggregatedCounterVec {
+	c := &aggregatedCounterVec{
+		CounterVec: prometheus.NewCounterVec(opts, labelNames),
+		name:       opts.Name,
+		labelNames: labelNames,
+	}
+
+	// an aggregate of each resource label, e.g. the services are aggregated by environment and by stack
+	for i := 0; i < len(labelNames)-2; i++ {
+		aggregateOpts := opts
+		aggregateOpts.Name = strings.TrimSuffix(opts.Name, "_total") + "_" + aggregationLevels[i] + "_total"
+		aggregateOpts.Help = opts.Help + ", aggregated by " + aggregationLevels[i]
+
+		c.aggregates = append(c.aggregates, prometheus.NewCounterVec(aggregateOpts, labelNames[:2+i]))
+		c.aggregateNames = append(c.aggregateNames, aggregateOpts.Name)
+	}
+	return c
+}
+
+// newUnaggregatedCounterVec creates the counter vector without any aggregate, e.g. of the labels which cannot be aggregated by the levels,
+// it is persisted like the aggregated ones.
+func newUnaggregatedCounterVec(opts prometheus.CounterOpts, labelNames []string) *aggregatedCounterVec {
+	return &aggregatedCounterVec{
+		CounterVec: prometheus.NewCounterVec(opts, labelNames),
+		name:       opts.Name,
+		labelNames: labelNames,
+	}
+}
+
+// WithLabelValues routes the counter of an aggregate by the aggregation mode.
+func (c *aggregatedCounterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	if aggregationMode == aggregationModeSentinel {
+		return c.CounterVec.WithLabelValues(lvs...)
+	}
+
+	// the environment labels are never specialTag
+	for i := 2; i < len(lvs) && i-2 < len(c.aggregates); i++ {
+		if lvs[i] != specialTag {
+			continue
+		}
+		if aggregationMode == aggregationModeNone {
+			return discardedCounter
+		}
+		return c.aggregates[i-2].WithLabelValues(lvs[:i]...)
+	}
+	return c.CounterVec.WithLabelValues(lvs...)
+}
+
+func (c *aggregatedCounterVec) Describe(ch chan<- *prometheus.Desc) {
+	c.CounterVec.Describe(ch)
+	if aggregationMode == aggregationModeFamilies {
+		for _, aggregate := range c.aggregates {
+			aggregate.Describe(ch)
+		}
+	}
+}
+
+func (c *aggregatedCounterVec) Collect(ch chan<- prometheus.Metric) {
+	c.CounterVec.Collect(ch)
+	if aggregationMode == aggregationModeFamilies {
+		for _, aggregate := range c.aggregates {
+			aggregate.Collect(ch)
+		}
+	}
+}
+
+// restore adds a counter of the state file, which is saved by the name of the vector or an aggregate,
+// the labels missing in an aggregate are specialTag, so the counter is routed by the current aggregation mode.
+func (c *aggregatedCounterVec) restore(labels map[string]string, value float64) {
+	values := make([]string, 0, len(c.labelNames))
+	for _, name := range c.labelNames {
+		labelValue, ok := labels[name]
+		if !ok {
+			labelValue = specialTag
+		}
+		values = append(values, labelValue)
+	}
+	c.WithLabelValues(values...).Add(value)
+}
+
+// deleteMatchingSeries drops the series whose leading label values are the values, e.g. the upgrades of a service with any images,
+// and the aggregates labeled by all the values, e.g. the services of a stack aggregated by the stack.
+func (c *aggregatedCounterVec) deleteMatchingSeries(values []string) {
+	labels := make(prometheus.Labels, len(values))
+	for i, value := range values {
+		labels[c.labelNames[i]] = value
+	}
+
+	deleteMatchingLabels(c.CounterVec, labels)
+	for _, aggregate := range c.aggregates {
+		deleteMatchingLabels(aggregate, labels)
+	}
+}
+
+// labeledVec is a vector of the counters, the gauges or the histograms.
+type labeledVec interface {
+	prometheus.Collector
+	Delete(labels prometheus.Labels) bool
+}
+
+// deleteMatchingLabels drops the series which have all the labels, a vector without any of the labels is never matched,
+// the series are deleted after collecting them as a vector cannot be changed while it is collected.
+func deleteMatchingLabels(vec labeledVec, labels prometheus.Labels) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+
+	var matched []prometheus.Labels
+	for metric := range ch {
+		pb := &dto.Metric{}
+		if err := metric.Write(pb); err != nil {
+			logger.Warnln(err)
+			continue
+		}
+
+		seriesLabels := make(prometheus.Labels, len(pb.GetLabel()))
+		for _, label := range pb.GetLabel() {
+			seriesLabels[label.GetName()] = label.GetValue()
+		}
+		if matchesLabels(seriesLabels, labels) {
+			matched = append(matched, seriesLabels)
+		}
+	}
+
+	for _, seriesLabels := range matched {
+		vec.Delete(seriesLabels)
+	}
+}
+
+func matchesLabels(seriesLabels, labels prometheus.Labels) bool {
+	for name, value := range labels {
+		if seriesValue, ok := seriesLabels[name]; !ok || seriesValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// collectState collects the counters of the vector and its aggregates by their names.
+func (c *aggregatedCounterVec) collectState() ([]stateCounter, error) {
+	result, err := collectCounters(c.name, c.CounterVec)
+	if err != nil {
+		return nil, err
+	}
+	for i, aggregate := range c.aggregates {
+		counters, err := collectCounters(c.aggregateNames[i], aggregate)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, counters...)
+	}
+	return result, nil
+}
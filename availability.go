@@ -0,0 +1,147 @@
+package main
+
+import (
+	"time"
+
+	"github.com/buger/jsonparser"
+)
+
+// stateTimeline is the current state and health state of a stack, a service or a host, the agent state of a host is its health state.
+type stateTimeline struct {
+	project *project
+	class   string
+	// the label values of the series without the environment labels
+	labelValues []string
+
+	state       string
+	healthState string
+	// the time since which the seconds of the current states are not counted yet
+	since time.Time
+}
+
+// stateTimelines are the state timelines of the stacks, the services and the hosts by their ids,
+// they are only changed by the msg event handler and the scrapes while holding the mutex of the states.
+//
+// The seconds in the states are counted at every transition and every scrape,
+// so the ratios of the states are exact regardless of the scrape interval. The seconds while the exporter is down are not counted.
+type stateTimelines map[string]*stateTimeline
+
+func newStateTimeline(msg *buffMsg, now time.Time) *stateTimeline {
+	return &stateTimeline{
+		project:     msg.project,
+		class:       msg.class,
+		labelValues: msg.timelineLabelValues(),
+		state:       msg.state,
+		healthState: msg.timelineHealthState(),
+		since:       now,
+	}
+}
+
+func (msg *buffMsg) timelineLabelValues() []string {
+	if msg.class == "service" {
+		return []string{msg.stackName, msg.name}
+	}
+	return []string{msg.name}
+}
+
+func (msg *buffMsg) timelineHealthState() string {
+	if msg.class == "host" {
+		return msg.agentState
+	}
+	return msg.healthState
+}
+
+// observe counts the seconds in the previous states and names of a stack, a service or a host on its transition.
+func (s stateTimelines) observe(msg *buffMsg, now time.Time) {
+	if msg.class != "stack" && msg.class != "service" && msg.class != "host" {
+		return
+	}
+
+	timeline, ok := s[msg.id]
+	switch {
+	case msg.state == "removed" || msg.state == "purging" || msg.state == "purged":
+		if ok {
+			timeline.flush(now)
+			delete(s, msg.id)
+		}
+		return
+	case !ok:
+		s[msg.id] = newStateTimeline(msg, now)
+		return
+	}
+
+	// the seconds until now are counted with the previous names, e.g. of a renamed stack or service
+	timeline.flush(now)
+	labelValues := msg.timelineLabelValues()
+	if msg.class == "service" && len(msg.stackName) == 0 {
+		// the stack of the service is forgotten, e.g. it is removed before the service
+		labelValues[0] = timeline.labelValues[0]
+	}
+	timeline.labelValues = labelValues
+	timeline.state = msg.state
+	timeline.healthState = msg.timelineHealthState()
+}
+
+// flush counts the seconds in the current states until now.
+func (timeline *stateTimeline) flush(now time.Time) {
+	if !now.After(timeline.since) {
+		return
+	}
+
+	counter := extendingTotalStackStateSeconds
+	switch timeline.class {
+	case "service":
+		counter = extendingTotalServiceStateSeconds
+	case "host":
+		counter = extendingTotalHostStateSeconds
+	}
+
+	labelValues := append([]string{timeline.project.id, timeline.project.name}, timeline.labelValues...)
+	counter.WithLabelValues(append(labelValues, timeline.state, timeline.healthState)...).Add(now.Sub(timeline.since).Seconds())
+	timeline.since = now
+}
+
+// track starts the timelines of the listed stacks, services and hosts at their current states,
+// and forgets the ones which are not listed anymore.
+func (s stateTimelines) track(p *project, now time.Time) {
+	for id, timeline := range s {
+		if timeline.project != p {
+			continue
+		}
+		if _, ok := p.inventory.get(inventoryCollections[timeline.class], id); !ok {
+			timeline.flush(now)
+			delete(s, id)
+		}
+	}
+
+	for _, baseType := range []string{"host", "stack", "service"} {
+		var untracked [][]byte
+		p.inventory.foreach(inventoryCollections[baseType], func(data []byte) {
+			id, _ := jsonparser.GetString(data, "id")
+			if _, ok := s[id]; !ok {
+				untracked = append(untracked, append([]byte(nil), data...))
+			}
+		})
+
+		for _, data := range untracked {
+			if msg, ok := p.newBuffMsg(baseType, data); ok {
+				s.observe(&msg, now)
+			}
+		}
+	}
+}
+
+// flushStateTimelines counts the seconds in the current states of all timelines before the counters are collected or saved,
+// the concurrent scrapes only add the seconds since the previous flush, so the counters never need to be reset.
+func (r *rancherExporter) flushStateTimelines() {
+	r.states.mutex.Lock()
+	defer r.states.mutex.Unlock()
+	r.states.timelines.flush(r.clock())
+}
+
+// flush counts the seconds in the current states of all timelines until now, it must be called while holding the mutex of the states.
+func (s stateTimelines) flush(now time.Time) {
+	for _, timeline := range s {
+		timeline.flush(now)
+	}
+}
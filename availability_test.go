@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStateTimelines(t *testing.T) {
+	aggregationMode = aggregationModeSentinel
+	for _, counter := range []*aggregatedCounterVec{extendingTotalServiceStateSeconds, extendingTotalHostStateSeconds} {
+		counter.Reset()
+	}
+
+	p := newOfflineProject("1a6", "Availability")
+	start := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)
+	now := start
+
+	r := newReplayExporter()
+	r.clock = func() time.Time {
+		return now
+	}
+
+	for _, step := range []struct {
+		offset time.Duration
+		msg    buffMsg
+	}{
+		{0, buffMsg{project: p, class: "service", id: "1s6", stackName: "shop", name: "api", state: "active", healthState: "healthy"}},
+		{0, buffMsg{project: p, class: "host", id: "1h6", name: "node-6", state: "active", agentState: "active"}},
+		// an outage shorter than any scrape interval
+		{40 * time.Second, buffMsg{project: p, class: "service", id: "1s6", stackName: "shop", name: "api", state: "active", healthState: "unhealthy"}},
+		{43 * time.Second, buffMsg{project: p, class: "service", id: "1s6", stackName: "shop", name: "api", state: "active", healthState: "healthy"}},
+		{50 * time.Second, buffMsg{project: p, class: "host", id: "1h6", name: "node-6", state: "active", agentState: "disconnected"}},
+		// the service is renamed, and then reported after its stack is forgotten
+		{60 * time.Second, buffMsg{project: p, class: "service", id: "1s6", stackName: "shop", name: "gateway", state: "active", healthState: "healthy"}},
+		{70 * time.Second, buffMsg{project: p, class: "service", id: "1s6", name: "gateway", state: "active", healthState: "healthy"}},
+		{80 * time.Second, buffMsg{project: p, class: "host", id: "1h6", name: "node-6", state: "removed", agentState: "disconnected"}},
+		// an instance has no state timeline
+		{80 * time.Second, buffMsg{project: p, class: "instance", id: "1i6", name: "shop-api-1", state: "running", healthState: "healthy"}},
+	} {
+		now = start.Add(step.offset)
+		r.states.timelines.observe(&step.msg, now)
+	}
+
+	now = start.Add(100 * time.Second)
+	r.flushStateTimelines()
+
+	if len(r.states.timelines) != 1 {
+		t.Errorf("%d timelines are tracked, want the service only", len(r.states.timelines))
+	}
+
+	for _, c := range []struct {
+		counter *aggregatedCounterVec
+		labels  map[string]string
+		want    float64
+	}{
+		{extendingTotalServiceStateSeconds, map[string]string{"name": "api", "state": "active", "health_state": "healthy"}, 57},
+		{extendingTotalServiceStateSeconds, map[string]string{"stack_name": "shop", "name": "gateway", "state": "active", "health_state": "healthy"}, 40},
+		{extendingTotalServiceStateSeconds, map[string]string{"name": "api", "state": "active", "health_state": "unhealthy"}, 3},
+		{extendingTotalHostStateSeconds, map[string]string{"name": "node-6", "state": "active", "agent_state": "active"}, 50},
+		{extendingTotalHostStateSeconds, map[string]string{"name": "node-6", "state": "active", "agent_state": "disconnected"}, 30},
+	} {
+		counters, err := collectCounters(c.counter.name, c.counter.CounterVec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := 0.0
+		for _, counter := range counters {
+			matched := counter.Labels["environment_id"] == p.id
+			for name, value := range c.labels {
+				matched = matched && counter.Labels[name] == value
+			}
+			if matched {
+				got += counter.Value
+			}
+		}
+		if got != c.want {
+			t.Errorf("%s%v = %v, want %v", c.counter.name, c.labels, got, c.want)
+		}
+	}
+}
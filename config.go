@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	logger "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	configFileFlag = "config_file"
+	// the interval of checking whether the config file is changed
+	configCheckInterval = 10 * time.Second
+)
+
+// reloadableFlags are the options applied by reloading the config file, which are only read while holding the mutexes of the exporter,
+// the others are only applied at startup as they are bound to the connections or the registered metrics, or read without the mutexes.
+var reloadableFlags = map[string]bool{
+	"cattle_access_key":           true,
+	"cattle_secret_key":           true,
+	"cattle_ca_file":              true,
+	"cattle_cert_file":            true,
+	"cattle_key_file":             true,
+	"cattle_server_name":          true,
+	"cattle_insecure_skip_verify": true,
+	"cattle_proxy_url":            true,
+	"log_level":                   true,
+	"stack_bootstrap_timeout":     true,
+	"service_bootstrap_timeout":   true,
+	"instance_bootstrap_timeout":  true,
+	"health_flap_window":          true,
+	"health_flap_threshold":       true,
+	"host_labels":                 true,
+	"stack_labels":                true,
+	"service_labels":              true,
+	"instance_labels":             true,
+	"labels_mode":                 true,
+}
+
+// configFile applies a YAML or JSON file of the options, the keys are the names of the flags, e.g.
+//
+//	cattle_url: http://rancher:8080
+//	http_timeout: 10s
+//	include_environments: [Default, Staging]
+//	service_labels: {team: team, cost-center: cost_center}
+//
+// a flag or an environment variable set explicitly overrides the same option of the file.
+type configFile struct {
+	path string
+	ctx  *cli.Context
+
+	// the flags set explicitly at startup
+	explicit map[string]bool
+	modTime  time.Time
+}
+
+// exporterRegistry serves the metrics of the rancher exporter, it is empty until the exporter is initialized,
+// and it is replaced after reloading the config file
+// as a registry never accepts a metric whose label names are changed, even if the previous one is unregistered.
+type exporterRegistry struct {
+	mutex    *sync.RWMutex
+	registry *prometheus.Registry
+}
+
+func newExporterRegistry() *exporterRegistry {
+	return &exporterRegistry{
+		mutex:    &sync.RWMutex{},
+		registry: prometheus.NewRegistry(),
+	}
+}
+
+func (er *exporterRegistry) reset(r *rancherExporter) error {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(r); err != nil {
+		return err
+	}
+
+	er.mutex.Lock()
+	defer er.mutex.Unlock()
+	er.registry = registry
+	return nil
+}
+
+func (er *exporterRegistry) Gather() ([]*dto.MetricFamily, error) {
+	er.mutex.RLock()
+	registry := er.registry
+	er.mutex.RUnlock()
+
+	return registry.Gather()
+}
+
+func newConfigFile(c *cli.Context) *configFile {
+	cf := &configFile{
+		path:     c.String(configFileFlag),
+		ctx:      c,
+		explicit: make(map[string]bool),
+	}
+	for _, name := range c.GlobalFlagNames() {
+		if c.IsSet(name) {
+			cf.explicit[name] = true
+		}
+	}
+	return cf
+}
+
+// load applies all the options of the file, it must be called before the options are used.
+func (cf *configFile) load() error {
+	if len(cf.path) == 0 {
+		return nil
+	}
+
+	options, err := cf.read()
+	if err != nil {
+		return err
+	}
+
+	applied := 0
+	for _, name := range sortedKeys(options) {
+		if cf.explicit[name] {
+			continue
+		}
+		if err := cf.ctx.Set(name, options[name]); err != nil {
+			return fmt.Errorf("invalid %s in config file %s, %v", name, cf.path, err)
+		}
+		applied++
+	}
+
+	logger.Infof("loaded %d options from config file %s", applied, cf.path)
+	return nil
+}
+
+// read parses the file into the string values of the flags.
+func (cf *configFile) read() (map[string]string, error) {
+	info, err := os.Stat(cf.path)
+	if err != nil {
+		return nil, err
+	}
+	cf.modTime = info.ModTime()
+
+	data, err := ioutil.ReadFile(cf.path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("cannot parse config file %s, %v", cf.path, err)
+	}
+
+	flags := make(map[string]bool)
+	for _, name := range cf.ctx.GlobalFlagNames() {
+		flags[name] = true
+	}
+
+	options := make(map[string]string, len(raw))
+	for name, value := range raw {
+		if !flags[name] || name == configFileFlag {
+			return nil, fmt.Errorf("unknown option %s in config file %s", name, cf.path)
+		}
+
+		option, err := configValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in config file %s, %v", name, cf.path, err)
+		}
+		options[name] = option
+	}
+	return options, nil
+}
+
+// configValue converts a value of the file to the value of a flag,
+// a list is joined by commas and a map is joined as the label mappings, e.g. {team: team} -> team=team.
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[interface{}]interface{}:
+		items := make([]string, 0, len(v))
+		for key, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, fmt.Sprintf("%v=%s", key, s))
+		}
+		sort.Strings(items)
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// flagValue returns the current value of a flag in the form accepted by the flag.
+func (cf *configFile) flagValue(name string) string {
+	for _, f := range cf.ctx.App.Flags {
+		if strings.Split(f.GetName(), ",")[0] != name {
+			continue
+		}
+		switch f.(type) {
+		case cli.DurationFlag:
+			return cf.ctx.Duration(name).String()
+		case cli.BoolFlag:
+			return strconv.FormatBool(cf.ctx.Bool(name))
+		}
+		return cf.ctx.String(name)
+	}
+	return ""
+}
+
+// isChanged compares an option of the file with the current value of the flag,
+// e.g. 1m of the file is the same as 1m0s of a duration flag.
+func (cf *configFile) isChanged(name, value string) bool {
+	current := cf.flagValue(name)
+	if d, err := time.ParseDuration(value); err == nil {
+		return d.String() != current
+	}
+	if b, err := strconv.ParseBool(value); err == nil {
+		return strconv.FormatBool(b) != current
+	}
+	return value != current
+}
+
+// reload applies the changed reloadable options of the file,
+// the previous options are restored if the metrics cannot be rebuilt with the changed ones.
+func (cf *configFile) reload(r *rancherExporter, er *exporterRegistry) error {
+	options, err := cf.read()
+	if err != nil {
+		return err
+	}
+
+	changed := make(map[string]string)
+	for _, name := range sortedKeys(options) {
+		if cf.explicit[name] || !cf.isChanged(name, options[name]) {
+			continue
+		}
+		if !reloadableFlags[name] {
+			logger.Warnf("%s in config file %s is changed, which is applied after restarting", name, cf.path)
+			continue
+		}
+		changed[name] = options[name]
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	previous, err := cf.apply(r, changed)
+	if err != nil {
+		return err
+	}
+	if err := er.reset(r); err != nil {
+		if _, restoreErr := cf.apply(r, previous); restoreErr != nil {
+			logger.Errorf("failed to restore the options, %v", restoreErr)
+		}
+		return err
+	}
+
+	logger.Infof("reloaded %s from config file %s", strings.Join(sortedKeys(changed), ", "), cf.path)
+	return nil
+}
+
+// apply sets the changed options and rebuilds the metrics and the http client,
+// it returns the previous options, which are restored if any changed option is invalid.
+func (cf *configFile) apply(r *rancherExporter, changed map[string]string) (map[string]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.states.mutex.Lock()
+	defer r.states.mutex.Unlock()
+
+	previous := make(map[string]string, len(changed))
+	for name, value := range changed {
+		previous[name] = cf.flagValue(name)
+		if err := cf.ctx.Set(name, value); err != nil {
+			cf.restore(previous)
+			return nil, fmt.Errorf("invalid %s in config file %s, %v", name, cf.path, err)
+		}
+	}
+
+	if err := initResourceMetrics(); err != nil {
+		cf.restore(previous)
+		if err := initResourceMetrics(); err != nil {
+			logger.Errorf("failed to restore the metrics, %v", err)
+		}
+		return nil, err
+	}
+	if err := initHttpClient(); err != nil {
+		cf.restore(previous)
+		if err := initResourceMetrics(); err != nil {
+			logger.Errorf("failed to restore the metrics, %v", err)
+		}
+		if err := initHttpClient(); err != nil {
+			logger.Errorf("failed to restore the http client, %v", err)
+		}
+		return nil, err
+	}
+	setLogLevel(cf.ctx.String("log_level"))
+	return previous, nil
+}
+
+func (cf *configFile) restore(previous map[string]string) {
+	for name, value := range previous {
+		_ = cf.ctx.Set(name, value)
+	}
+}
+
+// watch reloads the file on SIGHUP or when its modification time is changed.
+func (cf *configFile) watch(r *rancherExporter, er *exporterRegistry) {
+	if len(cf.path) == 0 {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			logger.Infof("reloading config file %s on SIGHUP", cf.path)
+		case <-ticker.C:
+			info, err := os.Stat(cf.path)
+			if err != nil || info.ModTime().Equal(cf.modTime) {
+				continue
+			}
+			logger.Infof("reloading config file %s on change", cf.path)
+		}
+
+		if err := cf.reload(r, er); err != nil {
+			logger.Errorf("failed to reload config file %s, %v", cf.path, err)
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli"
+)
+
+// newTestConfigFile parses the args with a subset of the flags of the exporter, and writes the content to the config file.
+func newTestConfigFile(t *testing.T, content string, args ...string) *configFile {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestConfigFile(t, path, content)
+
+	var cf *configFile
+	app := cli.NewApp()
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: configFileFlag},
+		cli.StringFlag{Name: "cattle_url", Destination: &cattleURL},
+		cli.StringFlag{Name: "log_level", Value: "info"},
+		cli.BoolFlag{Name: "hide_sys", Destination: &hideSys},
+		cli.DurationFlag{Name: "stack_bootstrap_timeout", Destination: &stackBootstrapTimeout},
+		cli.StringFlag{Name: "stack_labels", Destination: &stackLabelMapping},
+		cli.StringFlag{Name: "labels_mode", Value: labelsModeInfo, Destination: &labelsMode},
+	}
+	app.Action = func(c *cli.Context) error {
+		cf = newConfigFile(c)
+		return nil
+	}
+	if err := app.Run(append([]string{"rancher_exporter", "--" + configFileFlag, path}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return cf
+}
+
+func writeTestConfigFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigFileLoad(t *testing.T) {
+	cf := newTestConfigFile(t, `
+cattle_url: http://rancher:8080
+log_level: debug
+stack_bootstrap_timeout: 2m
+stack_labels: {team: team, cost-center: cost_center}
+`, "--log_level", "warn")
+
+	if err := cf.load(); err != nil {
+		t.Fatal(err)
+	}
+	if cattleURL != "http://rancher:8080" {
+		t.Errorf("cattle_url = %q", cattleURL)
+	}
+	if stackBootstrapTimeout != 2*time.Minute {
+		t.Errorf("stack_bootstrap_timeout = %v, want 2m", stackBootstrapTimeout)
+	}
+	if stackLabelMapping != "cost-center=cost_center,team=team" {
+		t.Errorf("stack_labels = %q", stackLabelMapping)
+	}
+	// the flags set explicitly override the file
+	if level := cf.ctx.String("log_level"); level != "warn" {
+		t.Errorf("log_level = %q, want the explicit warn", level)
+	}
+}
+
+func TestConfigFileUnknownOption(t *testing.T) {
+	cf := newTestConfigFile(t, "cattle_url: http://rancher:8080\nunknown_option: 1\n")
+	if err := cf.load(); err == nil {
+		t.Error("the unknown option is accepted")
+	}
+
+	cf = newTestConfigFile(t, "stack_bootstrap_timeout: never\n")
+	if err := cf.load(); err == nil {
+		t.Error("the invalid duration is accepted")
+	}
+}
+
+func TestConfigFileIsChanged(t *testing.T) {
+	cf := newTestConfigFile(t, "", "--stack_bootstrap_timeout", "1m", "--hide_sys")
+
+	for _, c := range []struct {
+		name, value string
+		want        bool
+	}{
+		{"stack_bootstrap_timeout", "1m", false},
+		{"stack_bootstrap_timeout", "60s", false},
+		{"stack_bootstrap_timeout", "1m0s", false},
+		{"stack_bootstrap_timeout", "2m", true},
+		{"hide_sys", "true", false},
+		{"hide_sys", "false", true},
+		{"labels_mode", labelsModeInfo, false},
+		{"labels_mode", labelsModeSeries, true},
+	} {
+		if got := cf.isChanged(c.name, c.value); got != c.want {
+			t.Errorf("isChanged(%s, %s) = %v, want %v", c.name, c.value, got, c.want)
+		}
+	}
+}
+
+func TestConfigFileReloadRollback(t *testing.T) {
+	cf := newTestConfigFile(t, "cattle_url: http://rancher:8080\nstack_bootstrap_timeout: 1m\n")
+	if err := cf.load(); err != nil {
+		t.Fatal(err)
+	}
+	stackBootstrapBuckets = "10,30,60"
+	serviceBootstrapBuckets = "10,30,60"
+	instanceBootstrapBuckets = "1,5,10"
+	for _, init := range []func() error{initBootstrapHistograms, initResourceMetrics, initHttpClient} {
+		if err := init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := newReplayExporter()
+	er := newExporterRegistry()
+
+	writeTestConfigFile(t, cf.path, "cattle_url: http://rancher:8080\nstack_bootstrap_timeout: 5m\n")
+	if err := cf.reload(r, er); err != nil {
+		t.Fatal(err)
+	}
+	if stackBootstrapTimeout != 5*time.Minute {
+		t.Fatalf("stack_bootstrap_timeout = %v after reloading, want 5m", stackBootstrapTimeout)
+	}
+
+	// a gauge named as a counter with the other label names fails the registration of the exporter
+	msCost := extendingInstanceBootstrapMsCost
+	extendingInstanceBootstrapMsCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stacks_bootstrap_total",
+	}, []string{"conflict"})
+	defer func() {
+		extendingInstanceBootstrapMsCost = msCost
+	}()
+
+	writeTestConfigFile(t, cf.path, "cattle_url: http://rancher:8080\nstack_bootstrap_timeout: 10m\n")
+	if err := cf.reload(r, er); err == nil {
+		t.Fatal("the reload is not failed")
+	}
+	if stackBootstrapTimeout != 5*time.Minute {
+		t.Errorf("stack_bootstrap_timeout = %v after the failed reload, want the previous 5m", stackBootstrapTimeout)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/prometheus/client_golang/prometheus"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// a sample which is not refreshed in the duration belongs to a stopped or removed container
+	containerStatsStaleness = time.Minute
+	// the interval of discovering the hosts to subscribe
+	containerStatsDiscoverInterval = 30 * time.Second
+)
+
+// containerStatsSample is the latest stats of a container streamed from the containerStats link of its host.
+type containerStatsSample struct {
+	received time.Time
+
+	cpuUsageNanoseconds float64
+	memoryUsage         float64
+	memoryLimit         float64
+	// interface -> bytes
+	networkReceive  map[string]float64
+	networkTransmit map[string]float64
+	blkioRead       float64
+	blkioWrite      float64
+}
+
+// containerStats keeps the latest stats of the containers in a project,
+// a sample is keyed by the id in the stream, which is matched with both the docker id and the Rancher id of an instance.
+type containerStats struct {
+	mutex   *sync.RWMutex
+	samples map[string]*containerStatsSample
+	// hosts with a running subscription
+	hosts map[string]bool
+}
+
+func newContainerStats() *containerStats {
+	return &containerStats{
+		mutex:   &sync.RWMutex{},
+		samples: make(map[string]*containerStatsSample),
+		hosts:   make(map[string]bool),
+	}
+}
+
+func (s *containerStats) get(instanceBytes []byte) (*containerStatsSample, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, key := range []string{"externalId", "id"} {
+		id, _ := jsonparser.GetString(instanceBytes, key)
+		if len(id) == 0 {
+			continue
+		}
+		if sample, ok := s.samples[id]; ok && time.Since(sample.received) < containerStatsStaleness {
+			return sample, true
+		}
+	}
+	return nil, false
+}
+
+func (s *containerStats) store(statsBytes []byte) {
+	id, _ := jsonparser.GetString(statsBytes, "id")
+	if len(id) == 0 {
+		return
+	}
+
+	sample := &containerStatsSample{
+		received:        time.Now(),
+		networkReceive:  make(map[string]float64),
+		networkTransmit: make(map[string]float64),
+	}
+	sample.cpuUsageNanoseconds, _ = jsonparser.GetFloat(statsBytes, "cpu", "usage", "total")
+	sample.memoryUsage, _ = jsonparser.GetFloat(statsBytes, "memory", "usage")
+	sample.memoryLimit, _ = jsonparser.GetFloat(statsBytes, "memLimit")
+
+	_, _ = jsonparser.ArrayEach(statsBytes, func(interfaceBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+		name, _ := jsonparser.GetString(interfaceBytes, "name")
+		rx, _ := jsonparser.GetFloat(interfaceBytes, "rx_bytes")
+		tx, _ := jsonparser.GetFloat(interfaceBytes, "tx_bytes")
+		sample.networkReceive[name] += rx
+		sample.networkTransmit[name] += tx
+	}, "network", "interfaces")
+
+	_, _ = jsonparser.ArrayEach(statsBytes, func(deviceBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+		read, _ := jsonparser.GetFloat(deviceBytes, "stats", "Read")
+		write, _ := jsonparser.GetFloat(deviceBytes, "stats", "Write")
+		sample.blkioRead += read
+		sample.blkioWrite += write
+	}, "diskio", "io_service_bytes")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.samples[id] = sample
+}
+
+// prune drops the stale samples, the stats streams never announce the removal of a container.
+func (s *containerStats) prune() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, sample := range s.samples {
+		if time.Since(sample.received) >= containerStatsStaleness {
+			delete(s.samples, id)
+		}
+	}
+}
+
+// watchContainerStats subscribes the container stats of every host in the inventory of the project until the project is closed,
+// a host added later is subscribed at the next discovery.
+func (p *project) watchContainerStats() {
+	ticker := time.NewTicker(containerStatsDiscoverInterval)
+	defer ticker.Stop()
+
+	for {
+		p.inventory.foreach(hostSubpath, func(data []byte) {
+			hostId, _ := jsonparser.GetString(data, "id")
+			if len(hostId) == 0 {
+				return
+			}
+
+			p.containerStats.mutex.Lock()
+			defer p.containerStats.mutex.Unlock()
+			if !p.containerStats.hosts[hostId] {
+				p.containerStats.hosts[hostId] = true
+				go p.watchHostContainerStats(hostId)
+			}
+		})
+		p.containerStats.prune()
+
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// watchHostContainerStats reads the container stats stream of the host until the host is removed or the project is closed,
+// the stream is reopened with a backoff as the token of the stats access expires.
+func (p *project) watchHostContainerStats(hostId string) {
+	defer func() {
+		p.containerStats.mutex.Lock()
+		delete(p.containerStats.hosts, hostId)
+		p.containerStats.mutex.Unlock()
+	}()
+
+	backoff := websocketMinBackoff
+	for {
+		hostBytes, ok := p.inventory.get(hostSubpath, hostId)
+		if !ok {
+			logger.Debugf("stop watching container stats of host %s of environment [%s], removed", hostId, p.name)
+			return
+		}
+
+		start := time.Now()
+		err := p.readHostContainerStats(hostBytes)
+		if p.isClosing() {
+			logger.Debugf("stop watching container stats of host %s of environment [%s], closed", hostId, p.name)
+			return
+		}
+		if time.Since(start) > maxWebsocketBackoff() {
+			backoff = websocketMinBackoff
+		}
+
+		sleep := time.Duration(rand.Int63n(int64(backoff))) + websocketMinBackoff/2
+		logger.Warnf("container stats of host %s of environment [%s] is closed, retry in %v, %v", hostId, p.name, sleep, err)
+		select {
+		case <-time.After(sleep):
+		case <-p.done:
+			return
+		}
+
+		if backoff *= 2; backoff > maxWebsocketBackoff() {
+			backoff = maxWebsocketBackoff()
+		}
+	}
+}
+
+func (p *project) readHostContainerStats(hostBytes []byte) error {
+	link, err := jsonparser.GetString(hostBytes, "links", "containerStats")
+	if err != nil {
+		return fmt.Errorf("no containerStats link, %v", err)
+	}
+
+	client := getHttpClient()
+	accessBytes, err := client.getLink(link)
+	if err != nil {
+		return err
+	}
+	statsURL, _ := jsonparser.GetString(accessBytes, "url")
+	token, _ := jsonparser.GetString(accessBytes, "token")
+	if len(statsURL) == 0 {
+		return fmt.Errorf("no url in the stats access of %s", link)
+	}
+
+	u, err := url.Parse(statsURL)
+	if err != nil {
+		return err
+	}
+	queries := u.Query()
+	queries.Set("token", token)
+	u.RawQuery = queries.Encode()
+
+	wbs, _, err := client.dialer.Dial(u.String(), nil)
+	if err != nil {
+		return err
+	}
+	defer wbs.Close()
+
+	// the blocked read is interrupted by closing the stream once the project is closed
+	read := make(chan struct{})
+	defer close(read)
+	go func() {
+		select {
+		case <-p.done:
+			closeWebsocket(wbs)
+			_ = wbs.Close()
+		case <-read:
+		}
+	}()
+
+	for {
+		_ = wbs.SetReadDeadline(time.Now().Add(containerStatsStaleness))
+		_, messageBytes, err := wbs.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		_, _ = jsonparser.ArrayEach(messageBytes, func(statsBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+			p.containerStats.store(statsBytes)
+		})
+	}
+}
+
+// setInstanceStatsMetrics exports the latest stats of the instance, the cumulative stats are exported as counters.
+func setInstanceStatsMetrics(p *project, hosts *sync.Map, stackName, serviceName string, instanceBytes []byte, ch chan<- prometheus.Metric) {
+	sample, ok := p.containerStats.get(instanceBytes)
+	if !ok {
+		return
+	}
+
+	instanceName, _ := jsonparser.GetString(instanceBytes, "name")
+	hostId, _ := jsonparser.GetString(instanceBytes, "hostId")
+	hostName := hostId
+	if value, ok := hosts.Load(hostId); ok {
+		hostName = value.(string)
+	}
+
+	labels := instanceLabels.seriesValues(instanceBytes, p.id, p.name, stackName, serviceName, instanceName, hostName)
+
+	ch <- prometheus.MustNewConstMetric(instanceCPUUsage, prometheus.CounterValue, sample.cpuUsageNanoseconds/float64(time.Second), labels...)
+	ch <- prometheus.MustNewConstMetric(instanceMemoryUsage, prometheus.GaugeValue, sample.memoryUsage, labels...)
+	if sample.memoryLimit > 0 {
+		ch <- prometheus.MustNewConstMetric(instanceMemoryLimit, prometheus.GaugeValue, sample.memoryLimit, labels...)
+	}
+	for name, value := range sample.networkReceive {
+		interfaceLabels := instanceLabels.seriesValues(instanceBytes, p.id, p.name, stackName, serviceName, instanceName, hostName, name)
+		ch <- prometheus.MustNewConstMetric(instanceNetworkReceive, prometheus.CounterValue, value, interfaceLabels...)
+	}
+	for name, value := range sample.networkTransmit {
+		interfaceLabels := instanceLabels.seriesValues(instanceBytes, p.id, p.name, stackName, serviceName, instanceName, hostName, name)
+		ch <- prometheus.MustNewConstMetric(instanceNetworkTransmit, prometheus.CounterValue, value, interfaceLabels...)
+	}
+	ch <- prometheus.MustNewConstMetric(instanceBlkioRead, prometheus.CounterValue, sample.blkioRead, labels...)
+	ch <- prometheus.MustNewConstMetric(instanceBlkioWrite, prometheus.CounterValue, sample.blkioWrite, labels...)
+}
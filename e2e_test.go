@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnrancher/rancher1.x-exporter/internal/fakerancher"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	e2eAccessKey = "access"
+	e2eSecretKey = "secret"
+)
+
+func newE2EServer() *fakerancher.Server {
+	server := fakerancher.NewServer(e2eAccessKey, e2eSecretKey, &fakerancher.Project{
+		ID:   "1a5",
+		Name: "Default",
+		Hosts: []string{
+			`{"id":"1h1","name":"node-1","hostname":"node-1","state":"active","agentState":"active","type":"host"}`,
+		},
+		Stacks: []string{
+			`{"id":"1st1","name":"web","state":"active","healthState":"healthy","system":false,"type":"stack"}`,
+			`{"id":"1st2","name":"ci","state":"active","healthState":"healthy","system":false,"type":"stack"}`,
+			`{"id":"1st5","name":"db","state":"active","healthState":"unhealthy","system":false,"type":"stack"}`,
+		},
+		Services: []string{
+			`{"id":"1s1","name":"nginx","stackId":"1st1","state":"active","healthState":"healthy","system":false,"type":"service","scale":2}`,
+			`{"id":"1s2","name":"job","stackId":"1st2","state":"active","healthState":"healthy","system":false,"type":"service","scale":1}`,
+		},
+		Instances: []string{
+			`{"id":"1i1","name":"web-nginx-1","state":"running","healthState":"healthy","system":false,"type":"container","serviceIds":["1s1"],"hostId":"1h1","labels":{"io.rancher.stack_service.name":"web/nginx"}}`,
+			`{"id":"1i2","name":"web-nginx-2","state":"running","healthState":"healthy","system":false,"type":"container","serviceIds":["1s1"],"hostId":"1h1","labels":{"io.rancher.stack_service.name":"web/nginx"}}`,
+		},
+	})
+	// every collection has more resources than a page
+	server.PageSize = 1
+	return server
+}
+
+// startE2EExporter points the exporter to the fake server and waits for the environments to be ready,
+// the metrics are package-level, so the exporter is started once and shared by the subtests.
+func startE2EExporter(t *testing.T, server *fakerancher.Server) (*rancherExporter, *prometheus.Registry) {
+	cattleURL = server.URL + "/v2-beta"
+	cattleAccessKey = e2eAccessKey
+	cattleSecretKey = e2eSecretKey
+	timeout = 5 * time.Second
+	resyncInterval = 0
+	websocketPingInterval = 0
+	websocketMaxBackoff = time.Second
+	stateFilePath = ""
+	staleSeriesRetention = 0
+	labelsMode = labelsModeInfo
+	aggregationMode = aggregationModeSentinel
+	stackBootstrapBuckets = "10,30,60"
+	serviceBootstrapBuckets = "10,30,60"
+	instanceBootstrapBuckets = "1,5,10"
+	stackBootstrapTimeout = time.Hour
+	serviceBootstrapTimeout = time.Hour
+	instanceBootstrapTimeout = time.Hour
+
+	for _, init := range []func() error{initBootstrapHistograms, initResourceMetrics, initResourceFilter, initAggregationMode} {
+		if err := init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	re := newRancherExporter()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := re.Stop(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	eventually(t, "the environments are ready", func() bool {
+		for _, check := range exporterReadiness.checks() {
+			if check.Status != healthStatusOK {
+				return false
+			}
+		}
+		return true
+	})
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(re); err != nil {
+		t.Fatal(err)
+	}
+	return re, registry
+}
+
+// scrape serves the metrics as Prometheus scrapes them and parses the text format.
+func scrape(t *testing.T, registry *prometheus.Registry) map[string]*dto.MetricFamily {
+	recorder := httptest.NewRecorder()
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("scraped %d, %s", recorder.Code, recorder.Body.String())
+	}
+
+	families, err := (&expfmt.TextParser{}).TextToMetricFamilies(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families
+}
+
+// sampleValue returns the value of the series matching the labels, false if there is no such series.
+func sampleValue(families map[string]*dto.MetricFamily, name string, labels map[string]string) (float64, bool) {
+	family, ok := families[name]
+	if !ok {
+		return 0, false
+	}
+
+	for _, m := range family.GetMetric() {
+		matched := 0
+		for _, pair := range m.GetLabel() {
+			if value, ok := labels[pair.GetName()]; ok && value == pair.GetValue() {
+				matched++
+			}
+		}
+		if matched != len(labels) {
+			continue
+		}
+
+		switch {
+		case m.Gauge != nil:
+			return m.GetGauge().GetValue(), true
+		case m.Counter != nil:
+			return m.GetCounter().GetValue(), true
+		case m.Untyped != nil:
+			return m.GetUntyped().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestE2E(t *testing.T) {
+	server := newE2EServer()
+	defer server.Close()
+
+	re, registry := startE2EExporter(t, server)
+
+	t.Run("unauthorized", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/v2-beta/projects")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("got %d without the API keys, want %d", resp.StatusCode, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		followed := false
+		for _, uri := range server.Requests() {
+			if strings.Contains(uri, "/stacks?") && strings.Contains(uri, "marker=2") {
+				followed = true
+			}
+		}
+		if !followed {
+			t.Fatalf("the last page of the stacks is never requested, %v", server.Requests())
+		}
+	})
+
+	t.Run("resources", func(t *testing.T) {
+		families := scrape(t, registry)
+
+		for _, c := range []struct {
+			name   string
+			labels map[string]string
+			want   float64
+		}{
+			{"rancher_up", map[string]string{"environment_name": "Default"}, 1},
+			{"rancher_stack_health_status", map[string]string{"name": "web", "health_state": "healthy"}, 1},
+			{"rancher_stack_health_status", map[string]string{"name": "db", "health_state": "unhealthy"}, 1},
+			{"rancher_stack_state", map[string]string{"name": "ci", "state": "active"}, 1},
+			{"rancher_service_scale", map[string]string{"name": "nginx"}, 2},
+			{"rancher_service_state", map[string]string{"name": "job", "state": "active"}, 1},
+			{"rancher_host_state", map[string]string{"name": "node-1", "state": "active"}, 1},
+			{"rancher_instance_state", map[string]string{"name": "web-nginx-2", "state": "running"}, 1},
+			{"rancher_exporter_websocket_connected", map[string]string{"environment_name": "Default"}, 1},
+		} {
+			got, ok := sampleValue(families, c.name, c.labels)
+			if !ok {
+				t.Errorf("%s%v is not exported", c.name, c.labels)
+			} else if got != c.want {
+				t.Errorf("%s%v = %v, want %v", c.name, c.labels, got, c.want)
+			}
+		}
+	})
+
+	t.Run("bootstrap", func(t *testing.T) {
+		// the counters are package-level, so they are compared with their values before the events
+		labels := map[string]string{"environment_name": "Default", "name": "new"}
+		families := scrape(t, registry)
+		total, _ := sampleValue(families, "rancher_stacks_bootstrap_total", labels)
+		success, _ := sampleValue(families, "rancher_stacks_bootstrap_success_total", labels)
+
+		for _, stack := range []string{
+			`{"baseType":"stack","id":"1st3","name":"new","state":"active","healthState":"initializing","system":false,"type":"stack"}`,
+			`{"baseType":"stack","id":"1st3","name":"new","state":"active","healthState":"healthy","system":false,"type":"stack"}`,
+		} {
+			if err := server.Publish("1a5", stack); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		eventually(t, "the bootstrap of stack new succeeds", func() bool {
+			value, ok := sampleValue(scrape(t, registry), "rancher_stacks_bootstrap_success_total", labels)
+			return ok && value == success+1
+		})
+
+		families = scrape(t, registry)
+		if value, _ := sampleValue(families, "rancher_stacks_bootstrap_total", labels); value != total+1 {
+			t.Errorf("rancher_stacks_bootstrap_total%v = %v, want %v", labels, value, total+1)
+		}
+		if value, _ := sampleValue(families, "rancher_stack_health_status", map[string]string{"name": "new", "health_state": "healthy"}); value != 1 {
+			t.Errorf("stack new is not healthy in rancher_stack_health_status")
+		}
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		labels := map[string]string{"environment_name": "Default", "stack_name": "web", "name": "nginx", "old_image": "docker:nginx:1.18", "new_image": "docker:nginx:1.19"}
+		families := scrape(t, registry)
+		total, _ := sampleValue(families, "rancher_services_upgrade_total", labels)
+		finished, _ := sampleValue(families, "rancher_services_upgrade_finished_total", labels)
+
+		service := `{"baseType":"service","id":"1s1","name":"nginx","stackId":"1st1","state":"%s","healthState":"healthy","system":false,"type":"service","scale":2,` +
+			`"launchConfig":{"imageUuid":"docker:nginx:1.19"},"upgrade":{"inServiceStrategy":{"previousLaunchConfig":{"imageUuid":"docker:nginx:1.18"}}}}`
+		publish := func(state string) {
+			if err := server.Publish("1a5", fmt.Sprintf(service, state)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		publish("upgrading")
+		publish("upgraded")
+		eventually(t, "service nginx is pending to finish the upgrade", func() bool {
+			value, ok := sampleValue(scrape(t, registry), "rancher_services_upgrade_pending", labels)
+			return ok && value == 1
+		})
+		if value, _ := sampleValue(scrape(t, registry), "rancher_services_upgrade_total", labels); value != total+1 {
+			t.Errorf("rancher_services_upgrade_total%v = %v, want %v", labels, value, total+1)
+		}
+
+		publish("finishing_upgrade")
+		publish("active")
+		eventually(t, "the upgrade of service nginx is finished", func() bool {
+			value, ok := sampleValue(scrape(t, registry), "rancher_services_upgrade_finished_total", labels)
+			return ok && value == finished+1
+		})
+		if _, ok := sampleValue(scrape(t, registry), "rancher_services_upgrade_pending", labels); ok {
+			t.Error("service nginx is still pending to finish the upgrade")
+		}
+	})
+	t.Run("reload", func(t *testing.T) {
+		// the client is replaced while the environment is resynced and scraped, which the race detector checks
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 5; i++ {
+				if err := initHttpClient(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		for i := 0; i < 5; i++ {
+			if err := re.projects[0].resync(); err != nil {
+				t.Error(err)
+			}
+			scrape(t, registry)
+		}
+		<-done
+
+		if value, _ := sampleValue(scrape(t, registry), "rancher_up", map[string]string{"environment_name": "Default"}); value != 1 {
+			t.Errorf("rancher_up = %v after replacing the client, want 1", value)
+		}
+	})
+}
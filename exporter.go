@@ -1,18 +1,16 @@
 package main
 
 import (
-	"encoding/base64"
-	"fmt"
-	"net/http"
+	"context"
 	"net/url"
 	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/buger/jsonparser"
-	"github.com/gorilla/websocket"
+	"github.com/cnrancher/rancher1.x-exporter/internal/bootstrap"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/sirupsen/logrus"
 	logger "github.com/sirupsen/logrus"
 )
 
@@ -20,6 +18,8 @@ const (
 	// Used to prepand Prometheus metrics created by this exporter.
 	namespace  = "rancher"
 	specialTag = "__rancher__"
+
+	bootstrapSweepInterval = 10 * time.Second
 )
 
 var (
@@ -33,11 +33,48 @@ var (
 	serviceStates = []string{"activating", "active", "canceled_upgrade", "canceling_upgrade", "deactivating", "finishing_upgrade", "inactive", "registering", "removed", "removing", "requested", "restarting", "rolling_back", "updating_active", "updating_inactive", "upgraded", "upgrading"}
 	healthStates  = []string{"healthy", "unhealthy"}
 
-	projectID, projectName string
-	hc                     *httpClient
+	instanceStates       = []string{"creating", "error", "erroring", "migrating", "purged", "purging", "removed", "removing", "requested", "restarting", "running", "starting", "stopped", "stopping", "updating-running", "updating-stopped"}
+	instanceHealthStates = []string{"healthy", "initializing", "reinitializing", "unhealthy"}
 )
 
+// bootstrapStates are the in-flight bootstraps of the stacks, services and instances, the in-flight upgrades of the services,
+// the health timelines of the services and instances, and the state timelines of the stacks, services and hosts, they are only changed by the msg event handler while holding the mutex.
+type bootstrapStates struct {
+	mutex *sync.Mutex
+
+	machine *bootstrap.Machine
+	// id -> the time of counting the bootstrap
+	since map[string]time.Time
+
+	upgrades serviceUpgrades
+	health   healthTimelines
+
+	timelines stateTimelines
+}
+
+func newBootstrapStates() *bootstrapStates {
+	return &bootstrapStates{
+		mutex:    &sync.Mutex{},
+		machine:  bootstrap.NewMachine(),
+		since:    make(map[string]time.Time),
+		upgrades: make(serviceUpgrades),
+		health:   make(healthTimelines),
+
+		timelines: make(stateTimelines),
+	}
+}
+
+// pruneSince forgets the counting time of the bootstraps which are not in-flight anymore.
+func (s *bootstrapStates) pruneSince() {
+	for id := range s.since {
+		if _, ok := s.machine.Lookup(id); !ok {
+			delete(s.since, id)
+		}
+	}
+}
+
 type buffMsg struct {
+	project       *project
 	class         string
 	id            string
 	parentId      string
@@ -47,21 +84,31 @@ type buffMsg struct {
 	transitioning string
 	stackName     string
 	serviceName   string
+	// the images of the previous and the current launch configs of a service
+	previousImage string
+	image         string
+	// the agent state of a host
+	agentState string
 }
 
 /**
 RancherExporter
 */
 type rancherExporter struct {
-	mutex         *sync.Mutex
-	websocketConn *websocket.Conn
-
-	msgBuff       chan buffMsg
-	stacksBuff    chan buffMsg
-	servicesBuff  chan buffMsg
-	instancesBuff chan buffMsg
-
-	recreateWebsocket func() *websocket.Conn
+	mutex    *sync.Mutex
+	projects []*project
+	states   *bootstrapStates
+
+	msgBuff chan buffMsg
+	// the watchEvents goroutines, msgBuff is closed after all of them return
+	watchers *sync.WaitGroup
+	// closed once msgBuff is closed and drained by the msg event handler
+	drained chan struct{}
+
+	// the clock of the msg event handler, which is the time of the recorded events while replaying
+	clock func() time.Time
+	// records the websocket messages, nil if recording is disabled
+	recorder *eventRecorder
 }
 
 func (r *rancherExporter) Describe(ch chan<- *prometheus.Desc) {
@@ -72,6 +119,26 @@ func (r *rancherExporter) Describe(ch chan<- *prometheus.Desc) {
 	infinityWorksServicesState.Describe(ch)
 	infinityWorksHostsState.Describe(ch)
 	infinityWorksHostAgentsState.Describe(ch)
+	if containerStatsEnabled {
+		ch <- instanceCPUUsage
+		ch <- instanceMemoryUsage
+		ch <- instanceMemoryLimit
+		ch <- instanceNetworkReceive
+		ch <- instanceNetworkTransmit
+		ch <- instanceBlkioRead
+		ch <- instanceBlkioWrite
+	}
+	hostMemoryTotal.Describe(ch)
+	hostMemoryAvailable.Describe(ch)
+	hostCPUCount.Describe(ch)
+	hostLoadAverage.Describe(ch)
+	hostFilesystemSize.Describe(ch)
+	hostFilesystemUsed.Describe(ch)
+	hostInfo.Describe(ch)
+	hostLabelsInfo.Describe(ch)
+	stackLabelsInfo.Describe(ch)
+	serviceLabelsInfo.Describe(ch)
+	instanceLabelsInfo.Describe(ch)
 
 	extendingTotalStackInitializations.Describe(ch)
 	extendingTotalSuccessStackInitialization.Describe(ch)
@@ -93,26 +160,93 @@ func (r *rancherExporter) Describe(ch chan<- *prometheus.Desc) {
 	extendingTotalSuccessInstanceBootstrap.Describe(ch)
 	extendingTotalErrorInstanceBootstrap.Describe(ch)
 	extendingInstanceBootstrapMsCost.Describe(ch)
+	extendingTotalTimeoutStackBootstrap.Describe(ch)
+	extendingTotalTimeoutServiceBootstrap.Describe(ch)
+	extendingTotalTimeoutInstanceBootstrap.Describe(ch)
+	extendingStackBootstrapInflight.Describe(ch)
+	extendingServiceBootstrapInflight.Describe(ch)
+	extendingInstanceBootstrapInflight.Describe(ch)
+	extendingStackBootstrapOldest.Describe(ch)
+	extendingServiceBootstrapOldest.Describe(ch)
+	extendingInstanceBootstrapOldest.Describe(ch)
+	extendingStackBootstrapDuration.Describe(ch)
+	extendingServiceBootstrapDuration.Describe(ch)
+	extendingInstanceBootstrapDuration.Describe(ch)
+	extendingTotalServiceUpgrades.Describe(ch)
+	extendingTotalFinishedServiceUpgrade.Describe(ch)
+	extendingTotalRollbackServiceUpgrade.Describe(ch)
+	extendingTotalErrorServiceUpgrade.Describe(ch)
+	extendingServiceUpgradePending.Describe(ch)
+	extendingTotalServiceHealthTransitions.Describe(ch)
+	extendingTotalInstanceHealthTransitions.Describe(ch)
+	extendingServiceHealthStateSeconds.Describe(ch)
+	extendingInstanceHealthStateSeconds.Describe(ch)
+	extendingServiceHealthFlapping.Describe(ch)
+	extendingInstanceHealthFlapping.Describe(ch)
+	extendingTotalStackStateSeconds.Describe(ch)
+	extendingTotalServiceStateSeconds.Describe(ch)
+	extendingTotalHostStateSeconds.Describe(ch)
 
 	extendingInstanceHeartbeat.Describe(ch)
+	instancesState.Describe(ch)
+	instancesHealth.Describe(ch)
+	instancesStartCount.Describe(ch)
+	instancesExitCode.Describe(ch)
+	instancesInfo.Describe(ch)
 	extendingServiceHeartbeat.Describe(ch)
 	extendingStackHeartbeat.Describe(ch)
+
+	exporterUp.Describe(ch)
+	exporterCollectorSuccess.Describe(ch)
+	exporterCollectorDuration.Describe(ch)
+	exporterScrapeDuration.Describe(ch)
+	exporterAPIRequests.Describe(ch)
+	exporterAPIRequestDuration.Describe(ch)
+	exporterWebsocketConnected.Describe(ch)
+	exporterWebsocketConnections.Describe(ch)
+	exporterWebsocketReconnects.Describe(ch)
+	exporterWebsocketMessages.Describe(ch)
 }
 
 func (r *rancherExporter) Collect(ch chan<- prometheus.Metric) {
+	start := time.Now()
+
+	r.flushStateTimelines()
 	r.asyncMetrics(ch)
 
 	r.syncMetrics(ch)
+
+	r.inflightMetrics(ch)
+
+	r.healthMetrics(ch)
+
+	exporterScrapeDuration.Set(time.Since(start).Seconds())
+	r.exporterMetrics(ch)
 }
 
-func (r *rancherExporter) Stop() {
-	if r.websocketConn != nil {
-		r.websocketConn.Close()
+// Stop closes the websockets, drains the buffered events through the msg event handler, closes the record file and saves the state file,
+// the events which are not drained before the context is done are lost.
+func (r *rancherExporter) Stop(ctx context.Context) error {
+	for _, p := range r.projects {
+		p.close()
 	}
 
-	close(r.instancesBuff)
-	close(r.servicesBuff)
-	close(r.stacksBuff)
+	go func() {
+		r.watchers.Wait()
+		close(r.msgBuff)
+	}()
+
+	select {
+	case <-r.drained:
+		logger.Infoln("drained the buffered events")
+	case <-ctx.Done():
+		logger.Warnf("%d buffered events are not drained in time, %v", len(r.msgBuff), ctx.Err())
+	}
+
+	if err := r.recorder.close(); err != nil {
+		logger.Warnf("failed to close record file %s, %v", recordFilePath, err)
+	}
+	return r.saveState()
 }
 
 func (r *rancherExporter) asyncMetrics(ch chan<- prometheus.Metric) {
@@ -120,6 +254,7 @@ func (r *rancherExporter) asyncMetrics(ch chan<- prometheus.Metric) {
 	extendingTotalStackBootstraps.Collect(ch)
 	extendingTotalSuccessStackBootstrap.Collect(ch)
 	extendingTotalErrorStackBootstrap.Collect(ch)
+	extendingTotalTimeoutStackBootstrap.Collect(ch)
 	extendingTotalStackInitializations.Collect(ch)
 	extendingTotalSuccessStackInitialization.Collect(ch)
 	extendingTotalErrorStackInitialization.Collect(ch)
@@ -127,6 +262,7 @@ func (r *rancherExporter) asyncMetrics(ch chan<- prometheus.Metric) {
 	extendingTotalServiceBootstraps.Collect(ch)
 	extendingTotalSuccessServiceBootstrap.Collect(ch)
 	extendingTotalErrorServiceBootstrap.Collect(ch)
+	extendingTotalTimeoutServiceBootstrap.Collect(ch)
 	extendingTotalServiceInitializations.Collect(ch)
 	extendingTotalSuccessServiceInitialization.Collect(ch)
 	extendingTotalErrorServiceInitialization.Collect(ch)
@@ -134,11 +270,96 @@ func (r *rancherExporter) asyncMetrics(ch chan<- prometheus.Metric) {
 	extendingTotalInstanceBootstraps.Collect(ch)
 	extendingTotalSuccessInstanceBootstrap.Collect(ch)
 	extendingTotalErrorInstanceBootstrap.Collect(ch)
+	extendingTotalTimeoutInstanceBootstrap.Collect(ch)
 	extendingTotalInstanceInitializations.Collect(ch)
 	extendingTotalSuccessInstanceInitialization.Collect(ch)
 	extendingTotalErrorInstanceInitialization.Collect(ch)
 
 	extendingInstanceBootstrapMsCost.Collect(ch)
+	extendingStackBootstrapDuration.Collect(ch)
+	extendingServiceBootstrapDuration.Collect(ch)
+	extendingInstanceBootstrapDuration.Collect(ch)
+
+	extendingTotalServiceUpgrades.Collect(ch)
+	extendingTotalFinishedServiceUpgrade.Collect(ch)
+	extendingTotalRollbackServiceUpgrade.Collect(ch)
+	extendingTotalErrorServiceUpgrade.Collect(ch)
+
+	extendingTotalServiceHealthTransitions.Collect(ch)
+	extendingTotalInstanceHealthTransitions.Collect(ch)
+
+	extendingTotalStackStateSeconds.Collect(ch)
+	extendingTotalServiceStateSeconds.Collect(ch)
+	extendingTotalHostStateSeconds.Collect(ch)
+}
+
+func (r *rancherExporter) exporterMetrics(ch chan<- prometheus.Metric) {
+	exporterUp.Collect(ch)
+	exporterCollectorSuccess.Collect(ch)
+	exporterCollectorDuration.Collect(ch)
+	exporterScrapeDuration.Collect(ch)
+	exporterAPIRequests.Collect(ch)
+	exporterAPIRequestDuration.Collect(ch)
+	exporterWebsocketConnected.Collect(ch)
+	exporterWebsocketConnections.Collect(ch)
+	exporterWebsocketReconnects.Collect(ch)
+	exporterWebsocketMessages.Collect(ch)
+}
+
+// inflightMetrics sets the in-flight gauges from the bootstrap states, the gauges are shared by the concurrent scrapes,
+// so they are set and collected while holding the mutex of the exporter.
+func (r *rancherExporter) inflightMetrics(ch chan<- prometheus.Metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	type inflight struct {
+		count  float64
+		oldest time.Duration
+	}
+	levels := map[string]map[*project]*inflight{
+		"stack":    {},
+		"service":  {},
+		"instance": {},
+	}
+	for _, p := range r.projects {
+		for _, level := range levels {
+			level[p] = &inflight{}
+		}
+	}
+
+	r.states.mutex.Lock()
+	now := time.Now()
+	for id, since := range r.states.since {
+		baseType := "stack"
+		if kind, ok := r.states.machine.Lookup(id); ok {
+			baseType = kind.String()
+		}
+
+		for _, p := range r.projects {
+			if _, ok := p.inventory.get(inventoryCollections[baseType], id); ok {
+				level := levels[baseType][p]
+				level.count++
+				if age := now.Sub(since); age > level.oldest {
+					level.oldest = age
+				}
+				break
+			}
+		}
+	}
+	r.states.mutex.Unlock()
+
+	for baseType, gauges := range map[string][2]*prometheus.GaugeVec{
+		"stack":    {extendingStackBootstrapInflight, extendingStackBootstrapOldest},
+		"service":  {extendingServiceBootstrapInflight, extendingServiceBootstrapOldest},
+		"instance": {extendingInstanceBootstrapInflight, extendingInstanceBootstrapOldest},
+	} {
+		for p, level := range levels[baseType] {
+			gauges[0].WithLabelValues(p.id, p.name).Set(level.count)
+			gauges[1].WithLabelValues(p.id, p.name).Set(level.oldest.Seconds())
+		}
+		gauges[0].Collect(ch)
+		gauges[1].Collect(ch)
+	}
 }
 
 func (r *rancherExporter) syncMetrics(ch chan<- prometheus.Metric) {
@@ -153,6 +374,17 @@ func (r *rancherExporter) syncMetrics(ch chan<- prometheus.Metric) {
 
 	infinityWorksHostsState.Reset()
 	infinityWorksHostAgentsState.Reset()
+	hostMemoryTotal.Reset()
+	hostMemoryAvailable.Reset()
+	hostCPUCount.Reset()
+	hostLoadAverage.Reset()
+	hostFilesystemSize.Reset()
+	hostFilesystemUsed.Reset()
+	hostInfo.Reset()
+	hostLabelsInfo.Reset()
+	stackLabelsInfo.Reset()
+	serviceLabelsInfo.Reset()
+	instanceLabelsInfo.Reset()
 	infinityWorksStacksHealth.Reset()
 	infinityWorksStacksState.Reset()
 	extendingStackHeartbeat.Reset()
@@ -160,58 +392,70 @@ func (r *rancherExporter) syncMetrics(ch chan<- prometheus.Metric) {
 	infinityWorksServicesHealth.Reset()
 	infinityWorksServicesState.Reset()
 	extendingServiceHeartbeat.Reset()
+	extendingServiceUpgradePending.Reset()
 	extendingInstanceHeartbeat.Reset()
-
-	gwg := &sync.WaitGroup{}
-
-	// collect host metrics
-	gwg.Add(1)
-	go func() {
-		defer gwg.Done()
-		if err := hc.foreachCollection(hostSubpath, nil, gwg, setHostMetrics); err != nil {
-			logger.Warnf("failed to set host metrics, %v", err)
-		}
-	}()
-
-	gwg.Add(1)
-	go func() {
-		stwg := &sync.WaitGroup{}
-		swg := &sync.WaitGroup{}
+	instancesState.Reset()
+	instancesHealth.Reset()
+	instancesStartCount.Reset()
+	instancesExitCode.Reset()
+	instancesInfo.Reset()
+
+	for _, p := range r.projects {
+		hostMap := &sync.Map{}
 		stackMap := &sync.Map{}
 		serviceMap := &sync.Map{}
-		defer gwg.Done()
+		filtered := p.filteredIds()
+
+		// collect host metrics
+		p.inventory.foreach(hostSubpath, func(data []byte) {
+			hostID, hostName := setHostMetrics(p, data)
+			hostMap.Store(hostID, hostName)
+		})
+
 		// collect stack metrics
-		if err := hc.foreachCollection(stackSubpath, nil, stwg, func(data []byte) {
-			stackID, stackName := setStackMetrics(data)
+		p.inventory.foreach(stackSubpath, func(data []byte) {
+			if isFiltered(filtered, data) {
+				return
+			}
+			stackID, stackName := setStackMetrics(p, data)
 			stackMap.Store(stackID, stackName)
-		}); err != nil {
-			logger.Warnf("failed to set stack metrics, %v", err)
-		}
-		stwg.Wait()
+		})
 
 		// collect service metrics
-		if err := hc.foreachCollection(serviceSubpath, nil, swg, func(data []byte) {
-			serviceID, content := setServiceMetrics(stackMap, data)
+		p.inventory.foreach(serviceSubpath, func(data []byte) {
+			if isFiltered(filtered, data) {
+				return
+			}
+			serviceID, content := setServiceMetrics(p, stackMap, data)
 			serviceMap.Store(serviceID, content)
-		}); err != nil {
-			logger.Warnf("failed to set service metrics, %v", err)
-		}
-		swg.Wait()
+		})
 
 		// collect instance metrics
-
-		if err := hc.foreachCollection(instanceSubpath, nil, gwg, func(data []byte) {
-			setInstanceMetrics(serviceMap, data)
-		}); err != nil {
-			logrus.Warnf("failed to set instance metrics, %v", err)
-		}
-	}()
-
-	gwg.Wait()
+		p.inventory.foreach(instanceSubpath, func(data []byte) {
+			if isFiltered(filtered, data) {
+				return
+			}
+			stackName, serviceName := setInstanceMetrics(p, hostMap, serviceMap, data)
+			if containerStatsEnabled {
+				setInstanceStatsMetrics(p, hostMap, stackName, serviceName, data, ch)
+			}
+		})
+	}
 
 	// collect
 	infinityWorksHostsState.Collect(ch)
 	infinityWorksHostAgentsState.Collect(ch)
+	hostMemoryTotal.Collect(ch)
+	hostMemoryAvailable.Collect(ch)
+	hostCPUCount.Collect(ch)
+	hostLoadAverage.Collect(ch)
+	hostFilesystemSize.Collect(ch)
+	hostFilesystemUsed.Collect(ch)
+	hostInfo.Collect(ch)
+	hostLabelsInfo.Collect(ch)
+	stackLabelsInfo.Collect(ch)
+	serviceLabelsInfo.Collect(ch)
+	instanceLabelsInfo.Collect(ch)
 	infinityWorksStacksHealth.Collect(ch)
 	infinityWorksStacksState.Collect(ch)
 	extendingStackHeartbeat.Collect(ch)
@@ -219,628 +463,613 @@ func (r *rancherExporter) syncMetrics(ch chan<- prometheus.Metric) {
 	infinityWorksServicesHealth.Collect(ch)
 	infinityWorksServicesState.Collect(ch)
 	extendingServiceHeartbeat.Collect(ch)
+	extendingServiceUpgradePending.Collect(ch)
 	extendingInstanceHeartbeat.Collect(ch)
+	instancesState.Collect(ch)
+	instancesHealth.Collect(ch)
+	instancesStartCount.Collect(ch)
+	instancesExitCode.Collect(ch)
+	instancesInfo.Collect(ch)
 
 }
 
 func (r *rancherExporter) collectingExtending() {
-	stackMap, _ := loadAndInitAggregatedMetrics()
+	if err := r.restoreState(); err != nil {
+		logger.Warnf("failed to restore state file %s, %v", stateFilePath, err)
+	}
 
-	// event watcher
-	go func() {
-		for {
-		recall:
-			_, messageBytes, err := r.websocketConn.ReadMessage()
-			if err != nil {
-				logger.Warnln("reconnect websocket")
-				r.websocketConn = r.recreateWebsocket()
-				goto recall
-			}
+	for _, p := range r.projects {
+		r.watchers.Add(1)
+		go r.watchProject(p)
+	}
 
-			if resourceType, _ := jsonparser.GetString(messageBytes, "resourceType"); len(resourceType) != 0 {
-				resourceBytes, _, _, err := jsonparser.Get(messageBytes, "data", "resource")
-				if err != nil {
-					logger.Warnln(err)
-					continue
-				}
+	go r.handleEvents(r.newEventHandler())
 
-				baseType, _ := jsonparser.GetString(resourceBytes, "baseType")
-				id, _ := jsonparser.GetString(resourceBytes, "id")
-				name, _ := jsonparser.GetString(resourceBytes, "name")
-				state, _ := jsonparser.GetString(resourceBytes, "state")
-				healthState, _ := jsonparser.GetString(resourceBytes, "healthState")
-				transitioning, _ := jsonparser.GetString(resourceBytes, "transitioning")
-
-				switch baseType {
-				case "stack":
-					stackMap.LoadOrStore(id, name)
-
-					r.msgBuff <- buffMsg{
-						class:         "stack",
-						id:            id,
-						name:          name,
-						state:         state,
-						healthState:   healthState,
-						transitioning: transitioning,
-					}
-				case "service":
-					stackId, _ := jsonparser.GetString(resourceBytes, "stackId")
-					stackName := ""
-					if val, ok := stackMap.Load(stackId); ok {
-						stackName = val.(string)
-					} else {
-						if stackRespBytes, err := hc.getByProject(path.Join(stackSubpath, stackId), nil); err == nil {
-							stackName, _ = jsonparser.GetString(stackRespBytes, "name")
-							stackMap.LoadOrStore(stackId, stackName)
-						}
-					}
+	go r.saveStatePeriodically()
+	go r.cleanStaleSeriesPeriodically()
+}
 
-					r.msgBuff <- buffMsg{
-						class:         "service",
-						id:            id,
-						name:          name,
-						state:         state,
-						healthState:   healthState,
-						transitioning: transitioning,
-						parentId:      stackId,
-						stackName:     stackName,
-					}
-				case "instance":
-					labelStackServiceName, _ := jsonparser.GetString(resourceBytes, "labels", "io.rancher.stack_service.name")
-					labelStackServiceNameSplit := strings.Split(labelStackServiceName, "/")
-
-					serviceId, _ := jsonparser.GetString(resourceBytes, "serviceIds", "[0]")
-					var serviceName string
-					stackName := labelStackServiceNameSplit[0]
-					if len(labelStackServiceNameSplit) > 1 {
-						serviceName = labelStackServiceNameSplit[1]
-					}
+// watchProject connects the websocket of the environment, lists its resources and initializes its aggregated metrics,
+// then watches its events, so an unreachable environment never blocks the others.
+func (r *rancherExporter) watchProject(p *project) {
+	wbs := p.connect()
+	if wbs == nil || !p.setWebsocketConn(wbs) {
+		logger.Infof("closed websocket of environment [%s]", p.name)
+		r.watchers.Done()
+		return
+	}
 
-					r.msgBuff <- buffMsg{
-						class:         "instance",
-						id:            id,
-						name:          name,
-						state:         state,
-						healthState:   healthState,
-						transitioning: transitioning,
-						stackName:     stackName,
-						parentId:      serviceId,
-						serviceName:   serviceName,
-					}
-				}
-			}
+	if err := p.resync(); err != nil {
+		logger.Warnf("failed to list resources of environment [%s], %v", p.name, err)
+	}
+	loadAndInitAggregatedMetrics(p)
+	p.setInitialized()
+	r.msgBuff <- buffMsg{
+		project: p,
+		class:   "resync",
+	}
+
+	go r.resyncPeriodically(p)
+	if containerStatsEnabled {
+		go p.watchContainerStats()
+	}
+	r.watchEvents(p)
+}
+
+// newEventHandler creates the msg event handler, which feeds the messages to the bootstrap state machine and counts its outcomes,
+// and counts the upgrades, the health transitions and the seconds in the states, the handler must be called while holding the mutex of the states.
+func (r *rancherExporter) newEventHandler() func(msg buffMsg) {
+	machine := r.states.machine
+	sinceMap := r.states.since
+	upgrades := r.states.upgrades
+	health := r.states.health
+	timelines := r.states.timelines
+
+	observe := func(histogram *prometheus.HistogramVec, msg *buffMsg, outcome string, labelValues ...string) {
+		if since, ok := sinceMap[msg.id]; ok {
+			histogram.WithLabelValues(append(labelValues, outcome)...).Observe(r.clock().Sub(since).Seconds())
+			delete(sinceMap, msg.id)
 		}
+	}
 
-	}()
+	stkCount := func(stackMsg *buffMsg) {
+		extendingTotalStackBootstraps.WithLabelValues(stackMsg.project.id, stackMsg.project.name, specialTag).Inc()
+		extendingTotalStackBootstraps.WithLabelValues(stackMsg.project.id, stackMsg.project.name, stackMsg.name).Inc()
 
-	// msg event handler
-	go func() {
-		type state uint64
+		extendingTotalSuccessStackBootstrap.WithLabelValues(stackMsg.project.id, stackMsg.project.name, specialTag)
+		extendingTotalSuccessStackBootstrap.WithLabelValues(stackMsg.project.id, stackMsg.project.name, stackMsg.name)
 
-		const (
-			stk_active_initializing state = iota
-			//stk_active_degraded
-			stk_active_unhealthy
+		extendingTotalErrorStackBootstrap.WithLabelValues(stackMsg.project.id, stackMsg.project.name, specialTag)
+		extendingTotalErrorStackBootstrap.WithLabelValues(stackMsg.project.id, stackMsg.project.name, stackMsg.name)
 
-			svc_activating_healthy
-			svc_active_initializing
-			svc_restarting
-			svc_upgrading
+		extendingTotalTimeoutStackBootstrap.WithLabelValues(stackMsg.project.id, stackMsg.project.name, specialTag)
+		extendingTotalTimeoutStackBootstrap.WithLabelValues(stackMsg.project.id, stackMsg.project.name, stackMsg.name)
 
-			ins_starting
-			ins_stopping
-			ins_stopped
-			ins_running_reinitializing
-		)
+		logger.Infof("stack [%s] be count + 1", stackMsg.name)
+		sinceMap[stackMsg.id] = r.clock()
+	}
+	stkSuccess := func(stackMsg *buffMsg) {
+		extendingTotalSuccessStackBootstrap.WithLabelValues(stackMsg.project.id, stackMsg.project.name, specialTag).Inc()
+		extendingTotalSuccessStackBootstrap.WithLabelValues(stackMsg.project.id, stackMsg.project.name, stackMsg.name).Inc()
 
-		stkMap := make(map[string]state)
-		svcMap := make(map[string]state)
-		insMap := make(map[string]state)
-		svcParentIdMap := make(map[string]state)
+		logger.Infof("stack [%s] be success + 1", stackMsg.name)
+		observe(extendingStackBootstrapDuration, stackMsg, "success", stackMsg.project.id, stackMsg.project.name, stackMsg.name)
+	}
+	stkFail := func(stackMsg *buffMsg) {
+		extendingTotalErrorStackBootstrap.WithLabelValues(stackMsg.project.id, stackMsg.project.name, specialTag).Inc()
+		extendingTotalErrorStackBootstrap.WithLabelValues(stackMsg.project.id, stackMsg.project.name, stackMsg.name).Inc()
 
-		stkCount := func(stackMsg *buffMsg) {
-			extendingTotalStackBootstraps.WithLabelValues(projectName, specialTag).Inc()
-			extendingTotalStackBootstraps.WithLabelValues(projectName, stackMsg.name).Inc()
+		logger.Infof("stack [%s] be error + 1", stackMsg.name)
+		observe(extendingStackBootstrapDuration, stackMsg, "error", stackMsg.project.id, stackMsg.project.name, stackMsg.name)
+	}
+	stkTimeout := func(stackMsg *buffMsg) {
+		extendingTotalTimeoutStackBootstrap.WithLabelValues(stackMsg.project.id, stackMsg.project.name, specialTag).Inc()
+		extendingTotalTimeoutStackBootstrap.WithLabelValues(stackMsg.project.id, stackMsg.project.name, stackMsg.name).Inc()
 
-			extendingTotalSuccessStackBootstrap.WithLabelValues(projectName, specialTag)
-			extendingTotalSuccessStackBootstrap.WithLabelValues(projectName, stackMsg.name)
+		logger.Infof("stack [%s] be timeout + 1", stackMsg.name)
+		observe(extendingStackBootstrapDuration, stackMsg, "timeout", stackMsg.project.id, stackMsg.project.name, stackMsg.name)
+	}
 
-			extendingTotalErrorStackBootstrap.WithLabelValues(projectName, specialTag)
-			extendingTotalErrorStackBootstrap.WithLabelValues(projectName, stackMsg.name)
+	svcCount := func(serviceMsg *buffMsg) {
+		extendingTotalServiceBootstraps.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, specialTag, specialTag).Inc()
+		extendingTotalServiceBootstraps.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, specialTag).Inc()
+		extendingTotalServiceBootstraps.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, serviceMsg.name).Inc()
 
-			logger.Infof("stack [%s] be count + 1", stackMsg.name)
-		}
-		stkSuccess := func(stackMsg *buffMsg) {
-			extendingTotalSuccessStackBootstrap.WithLabelValues(projectName, specialTag).Inc()
-			extendingTotalSuccessStackBootstrap.WithLabelValues(projectName, stackMsg.name).Inc()
+		extendingTotalSuccessServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, specialTag, specialTag)
+		extendingTotalSuccessServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, specialTag)
+		extendingTotalSuccessServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, serviceMsg.name)
 
-			logger.Infof("stack [%s] be success + 1", stackMsg.name)
-			delete(stkMap, stackMsg.id)
-		}
-		stkFail := func(stackMsg *buffMsg) {
-			extendingTotalErrorStackBootstrap.WithLabelValues(projectName, specialTag).Inc()
-			extendingTotalErrorStackBootstrap.WithLabelValues(projectName, stackMsg.name).Inc()
+		extendingTotalErrorServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, specialTag, specialTag)
+		extendingTotalErrorServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, specialTag)
+		extendingTotalErrorServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, serviceMsg.name)
 
-			logger.Infof("stack [%s] be error + 1", stackMsg.name)
-			delete(stkMap, stackMsg.id)
-		}
+		extendingTotalTimeoutServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, specialTag, specialTag)
+		extendingTotalTimeoutServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, specialTag)
+		extendingTotalTimeoutServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, serviceMsg.name)
 
-		svcCount := func(serviceMsg *buffMsg) {
-			extendingTotalServiceBootstraps.WithLabelValues(projectName, specialTag, specialTag).Inc()
-			extendingTotalServiceBootstraps.WithLabelValues(projectName, serviceMsg.stackName, specialTag).Inc()
-			extendingTotalServiceBootstraps.WithLabelValues(projectName, serviceMsg.stackName, serviceMsg.name).Inc()
+		logger.Infof("service [%s] be count + 1", serviceMsg.name)
+		sinceMap[serviceMsg.id] = r.clock()
+	}
+	svcSuccess := func(serviceMsg *buffMsg) {
+		extendingTotalSuccessServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, specialTag, specialTag).Inc()
+		extendingTotalSuccessServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, specialTag).Inc()
+		extendingTotalSuccessServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, serviceMsg.name).Inc()
 
-			extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, specialTag, specialTag)
-			extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, serviceMsg.stackName, specialTag)
-			extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, serviceMsg.stackName, serviceMsg.name)
+		logger.Infof("service [%s] be success + 1", serviceMsg.name)
+		observe(extendingServiceBootstrapDuration, serviceMsg, "success", serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, serviceMsg.name)
+	}
+	svcFail := func(serviceMsg *buffMsg) {
+		extendingTotalErrorServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, specialTag, specialTag).Inc()
+		extendingTotalErrorServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, specialTag).Inc()
+		extendingTotalErrorServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, serviceMsg.name).Inc()
 
-			extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, specialTag, specialTag)
-			extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, serviceMsg.stackName, specialTag)
-			extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, serviceMsg.stackName, serviceMsg.name)
+		logger.Infof("service [%s] be error + 1", serviceMsg.name)
+		observe(extendingServiceBootstrapDuration, serviceMsg, "error", serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, serviceMsg.name)
+	}
+	svcTimeout := func(serviceMsg *buffMsg) {
+		extendingTotalTimeoutServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, specialTag, specialTag).Inc()
+		extendingTotalTimeoutServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, specialTag).Inc()
+		extendingTotalTimeoutServiceBootstrap.WithLabelValues(serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, serviceMsg.name).Inc()
 
-			logger.Infof("service [%s] be count + 1", serviceMsg.name)
-		}
-		svcSuccess := func(serviceMsg *buffMsg) {
-			extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, specialTag, specialTag).Inc()
-			extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, serviceMsg.stackName, specialTag).Inc()
-			extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, serviceMsg.stackName, serviceMsg.name).Inc()
+		logger.Infof("service [%s] be timeout + 1", serviceMsg.name)
+		observe(extendingServiceBootstrapDuration, serviceMsg, "timeout", serviceMsg.project.id, serviceMsg.project.name, serviceMsg.stackName, serviceMsg.name)
+	}
 
-			logger.Infof("service [%s] be success + 1", serviceMsg.name)
-			delete(svcMap, serviceMsg.id)
+	insCount := func(instanceMsg *buffMsg) {
+		extendingTotalInstanceBootstraps.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, specialTag, specialTag, specialTag).Inc()
+		extendingTotalInstanceBootstraps.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, specialTag, specialTag).Inc()
+		extendingTotalInstanceBootstraps.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, specialTag).Inc()
+		extendingTotalInstanceBootstraps.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, instanceMsg.name).Inc()
+
+		extendingTotalSuccessInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, specialTag, specialTag, specialTag)
+		extendingTotalSuccessInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, specialTag, specialTag)
+		extendingTotalSuccessInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, specialTag)
+		extendingTotalSuccessInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, instanceMsg.name)
+
+		extendingTotalErrorInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, specialTag, specialTag, specialTag)
+		extendingTotalErrorInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, specialTag, specialTag)
+		extendingTotalErrorInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, specialTag)
+		extendingTotalErrorInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, instanceMsg.name)
+
+		extendingTotalTimeoutInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, specialTag, specialTag, specialTag)
+		extendingTotalTimeoutInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, specialTag, specialTag)
+		extendingTotalTimeoutInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, specialTag)
+		extendingTotalTimeoutInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, instanceMsg.name)
+
+		logger.Infof("instance [%s] be count + 1", instanceMsg.name)
+		sinceMap[instanceMsg.id] = r.clock()
+	}
+	insSuccess := func(instanceMsg *buffMsg) {
+		extendingTotalSuccessInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, specialTag, specialTag, specialTag).Inc()
+		extendingTotalSuccessInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, specialTag, specialTag).Inc()
+		extendingTotalSuccessInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, specialTag).Inc()
+		extendingTotalSuccessInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, instanceMsg.name).Inc()
+
+		logger.Infof("instance [%s] be success + 1", instanceMsg.name)
+		observe(extendingInstanceBootstrapDuration, instanceMsg, "success", instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName)
+	}
+	insFail := func(instanceMsg *buffMsg) {
+		extendingTotalErrorInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, specialTag, specialTag, specialTag).Inc()
+		extendingTotalErrorInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, specialTag, specialTag).Inc()
+		extendingTotalErrorInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, specialTag).Inc()
+		extendingTotalErrorInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, instanceMsg.name).Inc()
+
+		logger.Infof("instance [%s] be fail + 1", instanceMsg.name)
+		observe(extendingInstanceBootstrapDuration, instanceMsg, "error", instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName)
+	}
+	insTimeout := func(instanceMsg *buffMsg) {
+		extendingTotalTimeoutInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, specialTag, specialTag, specialTag).Inc()
+		extendingTotalTimeoutInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, specialTag, specialTag).Inc()
+		extendingTotalTimeoutInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, specialTag).Inc()
+		extendingTotalTimeoutInstanceBootstrap.WithLabelValues(instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName, instanceMsg.name).Inc()
+
+		logger.Infof("instance [%s] be timeout + 1", instanceMsg.name)
+		observe(extendingInstanceBootstrapDuration, instanceMsg, "timeout", instanceMsg.project.id, instanceMsg.project.name, instanceMsg.stackName, instanceMsg.serviceName)
+	}
+
+	outcomes := map[bootstrap.Kind]map[bootstrap.Outcome]func(msg *buffMsg){
+		bootstrap.Stack:    {bootstrap.Counted: stkCount, bootstrap.Succeeded: stkSuccess, bootstrap.Failed: stkFail, bootstrap.TimedOut: stkTimeout},
+		bootstrap.Service:  {bootstrap.Counted: svcCount, bootstrap.Succeeded: svcSuccess, bootstrap.Failed: svcFail, bootstrap.TimedOut: svcTimeout},
+		bootstrap.Instance: {bootstrap.Counted: insCount, bootstrap.Succeeded: insSuccess, bootstrap.Failed: insFail, bootstrap.TimedOut: insTimeout},
+	}
+	machine.SetCallback(func(outcome bootstrap.Outcome, event bootstrap.Event) {
+		outcomes[event.Kind][outcome](event.Resource.(*buffMsg))
+	})
+
+	// replay feeds the current representation of a tracked resource through the state machine,
+	// the tracked resource which is not found in any environment was removed while disconnected.
+	var handle func(msg buffMsg)
+	replay := func(baseType, id string) bool {
+		msg, ok := r.lookupBuffMsg(baseType, id)
+		if ok {
+			handle(msg)
 		}
-		svcFail := func(serviceMsg *buffMsg) {
-			extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, specialTag, specialTag).Inc()
-			extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, serviceMsg.stackName, specialTag).Inc()
-			extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, serviceMsg.stackName, serviceMsg.name).Inc()
+		return ok
+	}
+
+	// sweep counts the bootstraps which are in-flight longer than the timeout of their level
+	sweep := func() {
+		now := r.clock()
+		for id, since := range sinceMap {
+			kind, ok := machine.Lookup(id)
+			if !ok {
+				continue
+			}
+
+			if timeout := bootstrapTimeout(kind); timeout <= 0 || now.Sub(since) < timeout {
+				continue
+			}
 
-			logger.Infof("service [%s] be error + 1", serviceMsg.name)
-			delete(svcMap, serviceMsg.id)
+			if msg, ok := r.lookupBuffMsg(kind.String(), id); ok {
+				machine.Timeout(msg.event())
+			} else {
+				logger.Warnf("%s [%s] is timeout but not found in any environment", kind, id)
+				machine.Forget(id)
+			}
 		}
+	}
 
-		insCount := func(instanceMsg *buffMsg) {
-			extendingTotalInstanceBootstraps.WithLabelValues(projectName, specialTag, specialTag, specialTag).Inc()
-			extendingTotalInstanceBootstraps.WithLabelValues(projectName, instanceMsg.stackName, specialTag, specialTag).Inc()
-			extendingTotalInstanceBootstraps.WithLabelValues(projectName, instanceMsg.stackName, instanceMsg.serviceName, specialTag).Inc()
-			extendingTotalInstanceBootstraps.WithLabelValues(projectName, instanceMsg.stackName, instanceMsg.serviceName, instanceMsg.name).Inc()
+	handle = func(msg buffMsg) {
+		logger.Debugf("[[%s]]: %+v", msg.class, msg)
+		switch msg.class {
+		case "sweep":
+			sweep()
+
+		case "resync":
+			// the tracked resources are only forgotten once every environment is listed,
+			// as a resource restored from the state file may belong to an environment which is not connected yet
+			listed := true
+			for _, p := range r.projects {
+				if !p.offline && !p.isInitialized() {
+					listed = false
+				}
+			}
 
-			extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, specialTag, specialTag, specialTag)
-			extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, instanceMsg.stackName, specialTag, specialTag)
-			extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, instanceMsg.stackName, instanceMsg.serviceName, specialTag)
-			extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, instanceMsg.stackName, instanceMsg.serviceName, instanceMsg.name)
+			// transitions may be missed while the websocket of the environment was disconnected
+			for _, kind := range bootstrap.Kinds {
+				for _, id := range machine.IDs(kind) {
+					if _, ok := machine.State(kind, id); ok && !replay(kind.String(), id) && listed {
+						machine.Forget(id)
+					}
+				}
+			}
+			// so are the upgrades, and the upgrades started while disconnected are tracked from the listed services
+			for id := range upgrades {
+				if _, ok := upgrades[id]; ok && !replay("service", id) && listed {
+					delete(upgrades, id)
+				}
+			}
 
-			extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, specialTag, specialTag, specialTag)
-			extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, instanceMsg.stackName, specialTag, specialTag)
-			extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, instanceMsg.stackName, instanceMsg.serviceName, specialTag)
-			extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, instanceMsg.stackName, instanceMsg.serviceName, instanceMsg.name)
+			projects := r.projects
+			if msg.project != nil {
+				projects = []*project{msg.project}
+			}
+			for _, p := range projects {
+				upgrades.track(p)
+				health.track(p, r.clock())
+				timelines.track(p, r.clock())
+			}
 
-			logger.Infof("instance [%s] be count + 1", instanceMsg.name)
-		}
-		insSuccess := func(instanceMsg *buffMsg) {
-			extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, specialTag, specialTag, specialTag).Inc()
-			extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, instanceMsg.stackName, specialTag, specialTag).Inc()
-			extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, instanceMsg.stackName, instanceMsg.serviceName, specialTag).Inc()
-			extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, instanceMsg.stackName, instanceMsg.serviceName, instanceMsg.name).Inc()
-
-			logger.Infof("instance [%s] be success + 1", instanceMsg.name)
-			delete(insMap, instanceMsg.id)
-		}
-		insFail := func(instanceMsg *buffMsg) {
-			extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, specialTag, specialTag, specialTag).Inc()
-			extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, instanceMsg.stackName, specialTag, specialTag).Inc()
-			extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, instanceMsg.stackName, instanceMsg.serviceName, specialTag).Inc()
-			extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, instanceMsg.stackName, instanceMsg.serviceName, instanceMsg.name).Inc()
-
-			logger.Infof("instance [%s] be fail + 1", instanceMsg.name)
-			delete(insMap, instanceMsg.id)
+		default:
+			// the hosts are only in the state timelines
+			if msg.class != "host" {
+				machine.Handle(msg.event())
+			}
+			upgrades.handle(&msg)
+			health.observe(&msg, r.clock())
+			timelines.observe(&msg, r.clock())
+			if msg.class == "stack" && msg.state == "removed" {
+				msg.project.stacks.Delete(msg.id)
+			}
 		}
+	}
 
-		for msg := range r.msgBuff {
-			logger.Debugf("[[%s]]: %+v", msg.class, msg)
-			switch msg.class {
-			case "stack":
-				// stack 1 service with 1 container with hc
-				// create: 					active(initializing) -> active(healthy)
-				// restart container:		active(initializing) -> active(healthy)
-				// stop container:			active(initializing) -> active(healthy)
-				// restart service:			active(initializing) -> active(healthy)
-				// stop service:			active(initializing) -> active(healthy)
-				// stop stack               active(initializing) -> active(healthy)
-				// upgrade service: 		active(initializing) -> active(healthy)
-				// rollback service:		active(initializing) -> active(healthy)
-
-				// stack add 1 service with 2 container with hc
-				// restart container: 		active(initializing) -> active(healthy)
-				// stop container:			active(initializing) -> active(healthy)
-				// restart service:			active(initializing) -> active(healthy)
-				// stop service:			active(initializing) -> active(healthy)
-				// stop stack:				active(initializing) -> active(healthy)
-				// upgrade service:			{ active(unhealthy) -> active(initializing) }-> active(initializing) -> active(healthy)
-				// rollback service:		active(initializing) -> active(healthy)
-
-				// stack add 2 service with 2 container with hc
-				// restart container:		active(initializing) -> active(healthy)
-				// stop container:			active(initializing) -> active(healthy)
-				// restart service:			active(initializing) -> active(healthy)
-				// stop service:			active(initializing) -> active(healthy)
-				// stop stack:				active(initializing) -> active(healthy)
-				// upgrade service:			{ active(unhealthy) -> active(initializing) }-> active(initializing) -> active(healthy)
-				// rollback service:		active(initializing) -> active(healthy)
-
-				switch msg.state {
-				case "active":
-					switch msg.healthState {
-					case "healthy":
-						if preState, ok := stkMap[msg.id]; ok {
-							switch preState {
-							case stk_active_initializing:
-								if svcParentIdMap[msg.id] == svc_restarting { // when restart Svc on 1Stk nSvc nIns, Stk want to know having Svc restarting in it or not.
-									continue
-								}
-								if svcParentIdMap[msg.id] == svc_upgrading { // when restart Svc on 1Stk nSvc nIns, Stk want to know having Svc upgrading in it or not.
-									continue
-								}
-
-								stkSuccess(&msg)
-								//case stk_active_degraded:
-								//	if svcParentIdMap[msg.id] == svc_restarting { // when restart Svc on 1Stk nSvc nIns, Stk want to know having Svc restarting in it or not.
-								//		continue
-								//	}
-								//
-								//	if svcParentIdMap[msg.id] == svc_upgrading { // when restart Svc on 1Stk nSvc nIns, Stk want to know having Svc upgrading in it or not.
-								//		continue
-								//	}
-								//
-								//	stkSuccess(&msg)
-							}
-						}
-					case "initializing":
-						if preState, ok := stkMap[msg.id]; !ok {
-							stkMap[msg.id] = stk_active_initializing
-							stkCount(&msg)
-						} else {
-							switch preState {
-							case stk_active_unhealthy:
-								delete(stkMap, msg.id)
-							}
-						}
-					case "unhealthy":
-						if preState, ok := stkMap[msg.id]; !ok { // try
-							stkMap[msg.id] = stk_active_unhealthy
-						} else {
-							if preState != stk_active_initializing {
-								delete(stkMap, msg.id)
-							}
-						}
-						//case "degraded":
-						//	if _, ok := stkMap[msg.id]; !ok {
-						//		stkMap[msg.id] = stk_active_degraded
-						//		stkCount(&msg)
-						//	}
-					}
-				case "error":
-					if _, ok := stkMap[msg.id]; ok { // try
-						stkFail(&msg)
-					}
-				case "removed":
-					if preState, ok := stkMap[msg.id]; ok {
-						switch preState {
-						case stk_active_initializing:
-							stkFail(&msg)
-						}
-					}
+	return handle
+}
 
-					delete(stkMap, msg.id)
-					stackMap.Delete(msg.id)
-				}
+// bootstrapTimeout returns the timeout of the bootstraps of the kind.
+func bootstrapTimeout(kind bootstrap.Kind) time.Duration {
+	switch kind {
+	case bootstrap.Service:
+		return serviceBootstrapTimeout
+	case bootstrap.Instance:
+		return instanceBootstrapTimeout
+	}
+	return stackBootstrapTimeout
+}
 
-			case "service":
-				// stack 1 service with 1 container with hc
-				// create: 					activating(healthy) -> active(healthy)
-				// restart container:		active(initializing) -> active(healthy)
-				// stop container:			active(initializing) -> active(healthy)
-				// restart service:			restarting(initializing) -> active(healthy)
-				// stop service:			active(initializing) -> active(healthy)
-				// stop stack:				active(initializing) -> active(healthy)
-				// upgrade service:         upgrading(initializing) -> upgraded(healthy)
-				// rollback service:		active(initializing) -> active(healthy)
-
-				// stack add 1 service with 2 container with hc
-				// restart container: 		active(initializing) -> active(healthy)
-				// stop container:			active(initializing) -> active(healthy)
-				// restart service:         restarting(degraded) -> restarting(initializing) -> active(healthy)
-				// stop service:			active(initializing) -> active(healthy)
-				// stop stack:				active(initializing) -> active(healthy)
-				// upgrade service:			upgrading(degraded) -> upgraded(healthy)
-				// rollback service:		active(initializing) -> active(healthy)
-
-				// stack add 2 service with 2 container with hc
-				// restart container:		active(initializing) -> active(healthy)
-				// stop container:			active(initializing) -> active(healthy)
-				// restart service:			restarting(degraded) -> restarting(initializing) -> active(healthy)
-				// stop service:			active(initializing) -> active(healthy)
-				// stop stack:				active(initializing) -> active(healthy)
-				// upgrade service:			upgrading(degraded) -> upgraded(healthy)
-				// rollback service:		active(initializing) -> active(healthy)
-
-				switch msg.state {
-				case "activating":
-					switch msg.healthState {
-					case "healthy":
-						if _, ok := svcMap[msg.id]; !ok {
-							svcMap[msg.id] = svc_activating_healthy
-							svcCount(&msg)
-						}
-					}
-				case "active":
-					if svcParentIdMap[msg.parentId] == svc_restarting { // when restart Svc on 1Stk nSvc nIns, Stk want to know having Svc restarting in it or not.
-						delete(svcParentIdMap, msg.parentId)
-					}
+// event converts the message of a stack, a service or an instance to the event of the state machine.
+func (msg *buffMsg) event() bootstrap.Event {
+	kind := bootstrap.Stack
+	switch msg.class {
+	case "service":
+		kind = bootstrap.Service
+	case "instance":
+		kind = bootstrap.Instance
+	}
 
-					switch msg.healthState {
-					case "healthy":
-						if preState, ok := svcMap[msg.id]; ok {
-							switch preState {
-							case svc_activating_healthy:
-								svcSuccess(&msg)
-							case svc_active_initializing:
-								svcSuccess(&msg)
-							case svc_restarting:
-								svcSuccess(&msg)
-							}
-						}
-					case "initializing":
-						if _, ok := svcMap[msg.id]; !ok {
-							svcMap[msg.id] = svc_active_initializing
-							svcCount(&msg)
-						}
-					case "unhealthy":
-						if _, ok := svcMap[msg.id]; ok { // try
-							svcFail(&msg)
-						}
-					}
-				case "upgraded":
-					if svcParentIdMap[msg.parentId] == svc_upgrading { // when restart Svc on 1Stk nSvc nIns, Stk want to know having Svc upgrading in it or not.
-						delete(svcParentIdMap, msg.parentId)
-					}
+	return bootstrap.Event{
+		Kind:        kind,
+		ID:          msg.id,
+		ParentID:    msg.parentId,
+		State:       msg.state,
+		HealthState: msg.healthState,
+		Resource:    msg,
+	}
+}
 
-					switch msg.healthState {
-					case "healthy":
-						if preState, ok := svcMap[msg.id]; ok {
-							switch preState {
-							case svc_upgrading:
-								svcSuccess(&msg)
-							}
-						}
-					case "unhealthy":
-						if _, ok := svcMap[msg.id]; ok { // try
-							svcFail(&msg)
-						}
-					}
-				case "upgrading":
-					svcParentIdMap[msg.parentId] = svc_upgrading // when restart Svc on 1Stk nSvc nIns, Stk want to know having Svc upgrading in it or not.
-
-					switch msg.healthState {
-					case "initializing":
-						if _, ok := svcMap[msg.id]; !ok {
-							svcMap[msg.id] = svc_upgrading
-							svcCount(&msg)
-						}
-					case "degraded":
-						if _, ok := svcMap[msg.id]; !ok {
-							svcMap[msg.id] = svc_upgrading
-							svcCount(&msg)
-						}
-					}
-				case "restarting":
-					svcParentIdMap[msg.parentId] = svc_restarting // when restart Svc on 1Stk nSvc nIns, Stk want to know having Svc restarting in it or not.
-
-					switch msg.healthState {
-					case "initializing":
-						if _, ok := svcMap[msg.id]; !ok {
-							svcMap[msg.id] = svc_restarting
-							svcCount(&msg)
-						}
-					case "degraded":
-						if _, ok := svcMap[msg.id]; !ok {
-							svcMap[msg.id] = svc_restarting
-							svcCount(&msg)
-						}
-					}
-				case "inactive":
-					delete(svcMap, msg.id)
-				case "removed":
-					if _, ok := svcMap[msg.id]; ok {
-						switch msg.healthState {
-						case "initializing":
-							svcFail(&msg)
-						}
-					}
+// handleEvents handles the buffered events and sweeps the timeout bootstraps until msgBuff is closed.
+func (r *rancherExporter) handleEvents(handle func(msg buffMsg)) {
+	// the restored in-flight states may be finished while the exporter was down
+	r.states.mutex.Lock()
+	handle(buffMsg{class: "resync"})
+	r.states.pruneSince()
+	r.states.mutex.Unlock()
+
+	ticker := time.NewTicker(bootstrapSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-r.msgBuff:
+			if !ok {
+				close(r.drained)
+				return
+			}
+			r.states.mutex.Lock()
+			handle(msg)
+			r.states.pruneSince()
+			r.states.mutex.Unlock()
+		case <-ticker.C:
+			r.states.mutex.Lock()
+			handle(buffMsg{class: "sweep"})
+			r.states.pruneSince()
+			r.states.mutex.Unlock()
+		}
+	}
+}
 
-					delete(svcMap, msg.id)
-				}
+func (r *rancherExporter) watchEvents(p *project) {
+	defer r.watchers.Done()
 
-			case "instance":
-				// stack add 1 service with 1 container with hc
-				// create service: 	    starting() -> running(healthy)
-				// restart container:	stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// stop container:		stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// restart service:     stopping(healthy) -> stopped(healthy) -> running(reinitializing) -> running(healthy)
-				// stop service:        stopping(healthy) -> stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// stop stack:          stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// upgrade service:     old: stopping(healthy) -> stopped(healthy) | new: starting() -> running(initializing) -> running(healthy)
-				// rollback service:    new: stopping(healthy) -> stopped(healthy) -> removed(healthy) | old: running(updating-reinitializing) -> running(reinitializing) -> running(healthy)
-
-				// stack add 1 service with 2 container with hc
-				// restart container: 	stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// stop container:		stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// restart service:		stopping(healthy) -> stopped(healthy) -> running(reinitializing) -> running(healthy)
-				// stop service:		stopping(healthy) -> stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// stop stack:			stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// upgrade service:		old: stopping(healthy) -> stopped(healthy) | new: starting() -> running(initializing) -> running(healthy)
-				// rollback service:	new: stopping(healthy) -> stopped(healthy) -> removed(healthy) | old: running(updating-reinitializing) -> running(reinitializing) -> running(healthy)
-
-				// stack add 2 service with 2 container with hc
-				// restart container:	stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// stop container:		stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// restart service:		stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// stop service:		stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// stop stack:			stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
-				// upgrade service:		old: stopping(healthy) -> stopped(healthy) | new: starting() -> running(initializing) -> running(healthy)
-				// rollback service:	new: stopping(healthy) -> stopped(healthy) -> removed(healthy) | old: running(updating-reinitializing) -> running(reinitializing) -> running(healthy)
-
-				switch msg.state {
-				case "starting":
-					if preState, ok := insMap[msg.id]; !ok {
-						insMap[msg.id] = ins_starting
-						insCount(&msg)
-					} else {
-						if len(msg.healthState) != 0 {
-							switch preState {
-							case ins_stopping:
-								insMap[msg.id] = ins_starting
-							case ins_stopped:
-								insMap[msg.id] = ins_starting
-							}
-						}
-					}
-				case "stopping":
-					if len(msg.healthState) != 0 {
-						switch msg.healthState {
-						case "healthy":
-							if _, ok := insMap[msg.id]; !ok {
-								insMap[msg.id] = ins_stopping
-							}
-						}
-					}
-				case "stopped":
-					if len(msg.healthState) != 0 {
-						switch msg.healthState {
-						case "healthy":
-							if preState, ok := insMap[msg.id]; !ok {
-								insMap[msg.id] = ins_stopped
-							} else {
-								switch preState {
-								case ins_stopping:
-									insMap[msg.id] = ins_stopped
-								}
-							}
-						}
-					}
-				case "running":
-					if len(msg.healthState) != 0 {
-						switch msg.healthState {
-						case "healthy":
-							if preState, ok := insMap[msg.id]; ok {
-								switch preState {
-								case ins_starting:
-									insSuccess(&msg)
-								case ins_running_reinitializing:
-									insSuccess(&msg)
-								}
-							}
-						case "reinitializing":
-							if preState, ok := insMap[msg.id]; ok {
-								switch preState {
-								case ins_stopping:
-									insMap[msg.id] = ins_running_reinitializing
-									insCount(&msg)
-								case ins_stopped:
-									insMap[msg.id] = ins_running_reinitializing
-									insCount(&msg)
-								case ins_starting:
-									insMap[msg.id] = ins_running_reinitializing
-									insCount(&msg)
-								}
-							}
-						case "updating-reinitializing":
-							if _, ok := insMap[msg.id]; !ok {
-								insMap[msg.id] = ins_running_reinitializing
-								insCount(&msg)
-							}
-						case "unhealthy":
-							if _, ok := insMap[msg.id]; ok { // try
-								insFail(&msg)
-							}
-						}
-					}
-				case "error":
-					insFail(&msg)
-				case "removed":
-					if _, ok := insMap[msg.id]; ok {
-						switch msg.healthState {
-						case "initializing":
-							insFail(&msg)
-						}
-					}
+	for {
+		wbs := p.getWebsocketConn()
+		_, messageBytes, err := wbs.ReadMessage()
+		if err != nil {
+			p.setConnected(false)
+			_ = wbs.Close()
+			if p.isClosing() {
+				logger.Infof("closed websocket of environment [%s]", p.name)
+				return
+			}
 
-					delete(insMap, msg.id)
+			logger.Warnf("reconnect websocket of environment [%s], %v", p.name, err)
+			exporterWebsocketReconnects.WithLabelValues(p.id, p.name).Inc()
+			if wbs = p.connect(); wbs == nil || !p.setWebsocketConn(wbs) {
+				logger.Infof("closed websocket of environment [%s]", p.name)
+				return
+			}
 
-				}
+			if err := p.resync(); err != nil {
+				logger.Warnf("failed to resync resources of environment [%s], %v", p.name, err)
 			}
+			r.msgBuff <- buffMsg{
+				project: p,
+				class:   "resync",
+			}
+			continue
 		}
-	}()
+		_ = wbs.SetReadDeadline(websocketReadDeadline())
+		exporterWebsocketMessages.WithLabelValues(p.id, p.name).Inc()
+		r.recorder.record(p, messageBytes)
 
+		if msg, ok := p.parseMessage(messageBytes); ok {
+			r.msgBuff <- msg
+		}
+	}
 }
 
-func newRancherExporter() *rancherExporter {
-	initHttpClient()
-	initProjectInfo()
+// parseMessage stores the resource of a resource.change message into the inventory,
+// and converts it to the message of the state machine.
+func (p *project) parseMessage(messageBytes []byte) (buffMsg, bool) {
+	if resourceType, _ := jsonparser.GetString(messageBytes, "resourceType"); len(resourceType) == 0 {
+		return buffMsg{}, false
+	}
 
-	projectLinksSelf := getSubAddress(hc.endpoint, "projects", projectID).String()
+	resourceBytes, _, _, err := jsonparser.Get(messageBytes, "data", "resource")
+	if err != nil {
+		logger.Warnln(err)
+		return buffMsg{}, false
+	}
 
-	if strings.HasPrefix(projectLinksSelf, "http://") {
-		projectLinksSelf = strings.Replace(projectLinksSelf, "http://", "ws://", -1)
-	} else {
-		projectLinksSelf = strings.Replace(projectLinksSelf, "https://", "wss://", -1)
+	baseType, _ := jsonparser.GetString(resourceBytes, "baseType")
+	p.inventory.storeEvent(baseType, resourceBytes)
+	if baseType == "service" || baseType == "instance" {
+		stackId, _ := jsonparser.GetString(resourceBytes, "stackId")
+		p.resolveStack(stackId)
+	}
+	if !isInventoryResource(resourceBytes) {
+		p.markRemoved(inventoryCollections[baseType], resourceBytes)
 	}
 
-	wbsFactory := func() *websocket.Conn {
-		dialAddress := projectLinksSelf + "/subscribe?eventNames=resource.change&limit=-1&sockId=1"
-		httpHeaders := http.Header{}
-		httpHeaders.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(cattleAccessKey+":"+cattleSecretKey)))
-		wbs, _, err := websocket.DefaultDialer.Dial(dialAddress, httpHeaders)
-		if err != nil {
-			panic(err)
-		}
+	return p.newBuffMsg(baseType, resourceBytes)
+}
 
-		return wbs
+// resolveStack requests a stack which is not known yet, e.g. a service is reported before its stack,
+// and stores it into the inventory for naming and filtering the resources of the stack.
+// It must be called before the message is handled, as the msg event handler never requests Rancher Server while holding the mutex of the states.
+func (p *project) resolveStack(stackId string) {
+	if len(stackId) == 0 || p.offline {
+		return
+	}
+	if _, ok := p.inventory.get(stackSubpath, stackId); ok {
+		return
+	}
+	// only the filters need the stack besides its name
+	if _, ok := p.stackName(stackId); ok && !filter.enabled() {
+		return
 	}
 
-	result := &rancherExporter{
-		mutex:         &sync.Mutex{},
-		websocketConn: wbsFactory(),
+	stackRespBytes, err := getHttpClient().getByProject(p.id, path.Join(stackSubpath, stackId), nil)
+	if err != nil {
+		logger.Warnf("failed to get stack %s of environment [%s], %v", stackId, p.name, err)
+		return
+	}
+	p.inventory.storeEvent("stack", stackRespBytes)
+	stackName, _ := jsonparser.GetString(stackRespBytes, "name")
+	p.stacks.LoadOrStore(stackId, stackName)
+}
 
-		msgBuff: make(chan buffMsg, 1<<20),
+// stackName finds the name of a stack in the known stacks or the inventory without requesting Rancher Server.
+func (p *project) stackName(stackId string) (string, bool) {
+	if value, ok := p.stacks.Load(stackId); ok {
+		return value.(string), true
+	}
+	if data, ok := p.inventory.get(stackSubpath, stackId); ok {
+		name, _ := jsonparser.GetString(data, "name")
+		return name, true
+	}
+	return "", false
+}
 
-		recreateWebsocket: wbsFactory,
+// lookupBuffMsg finds the current representation of a resource in all environments.
+func (r *rancherExporter) lookupBuffMsg(baseType, id string) (buffMsg, bool) {
+	for _, p := range r.projects {
+		if data, ok := p.inventory.get(inventoryCollections[baseType], id); ok {
+			return p.newBuffMsg(baseType, data)
+		}
 	}
+	return buffMsg{}, false
+}
 
-	result.collectingExtending()
+// newBuffMsg converts a resource to the message of the state machine, only hosts, stacks, services and instances are converted,
+// the filtered resources are never tracked. A service of an unknown stack is labeled by an empty stack name.
+func (p *project) newBuffMsg(baseType string, resourceBytes []byte) (buffMsg, bool) {
+	if p.isEventFiltered(baseType, resourceBytes) {
+		return buffMsg{}, false
+	}
 
-	return result
+	id, _ := jsonparser.GetString(resourceBytes, "id")
+	name, _ := jsonparser.GetString(resourceBytes, "name")
+	state, _ := jsonparser.GetString(resourceBytes, "state")
+	healthState, _ := jsonparser.GetString(resourceBytes, "healthState")
+	transitioning, _ := jsonparser.GetString(resourceBytes, "transitioning")
+
+	switch baseType {
+	case "host":
+		if len(name) == 0 {
+			name, _ = jsonparser.GetString(resourceBytes, "hostname")
+		}
+		agentState, _ := jsonparser.GetString(resourceBytes, "agentState")
+
+		return buffMsg{
+			project:       p,
+			class:         "host",
+			id:            id,
+			name:          name,
+			state:         state,
+			transitioning: transitioning,
+			agentState:    agentState,
+		}, true
+	case "stack":
+		p.stacks.LoadOrStore(id, name)
+
+		return buffMsg{
+			project:       p,
+			class:         "stack",
+			id:            id,
+			name:          name,
+			state:         state,
+			healthState:   healthState,
+			transitioning: transitioning,
+		}, true
+	case "service":
+		stackId, _ := jsonparser.GetString(resourceBytes, "stackId")
+		stackName, _ := p.stackName(stackId)
+		previousImage, image := upgradeImages(resourceBytes)
+
+		return buffMsg{
+			project:       p,
+			class:         "service",
+			id:            id,
+			name:          name,
+			state:         state,
+			healthState:   healthState,
+			transitioning: transitioning,
+			parentId:      stackId,
+			stackName:     stackName,
+			previousImage: previousImage,
+			image:         image,
+		}, true
+	case "instance":
+		labelStackServiceName, _ := jsonparser.GetString(resourceBytes, "labels", "io.rancher.stack_service.name")
+		labelStackServiceNameSplit := strings.Split(labelStackServiceName, "/")
+
+		serviceId, _ := jsonparser.GetString(resourceBytes, "serviceIds", "[0]")
+		var serviceName string
+		stackName := labelStackServiceNameSplit[0]
+		if len(labelStackServiceNameSplit) > 1 {
+			serviceName = labelStackServiceNameSplit[1]
+		}
+
+		return buffMsg{
+			project:       p,
+			class:         "instance",
+			id:            id,
+			name:          name,
+			state:         state,
+			healthState:   healthState,
+			transitioning: transitioning,
+			stackName:     stackName,
+			parentId:      serviceId,
+			serviceName:   serviceName,
+		}, true
+	}
+
+	return buffMsg{}, false
 }
 
-func initProjectInfo() {
-	// get project self link
-	projectsResponseBytes, err := hc.get("projects", nil)
-	if err != nil {
-		panic(fmt.Errorf("cannot get project info, %v", err))
+func (r *rancherExporter) resyncPeriodically(p *project) {
+	if resyncInterval <= 0 {
+		return
 	}
 
-	projectBytes, _, _, err := jsonparser.Get(projectsResponseBytes, "data", "[0]")
-	if err != nil {
-		panic(fmt.Errorf("cannot get project, %v", err))
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := p.resync(); err != nil {
+			logger.Warnf("failed to resync resources of environment [%s], %v", p.name, err)
+		}
 	}
+}
 
-	projectID, err = jsonparser.GetString(projectBytes, "id")
+func newRancherExporter() *rancherExporter {
+	if err := initHttpClient(); err != nil {
+		panic(err)
+	}
+	recorder, err := newEventRecorder(recordFilePath)
 	if err != nil {
-		panic(fmt.Errorf("cannot get project id, %v", err))
+		panic(err)
 	}
 
-	projectName, err = jsonparser.GetString(projectBytes, "name")
-	if err != nil {
-		panic(fmt.Errorf("cannot get project name, %v", err))
+	result := &rancherExporter{
+		mutex:    &sync.Mutex{},
+		projects: initProjects(),
+		states:   newBootstrapStates(),
+
+		msgBuff:  make(chan buffMsg, 1<<20),
+		watchers: &sync.WaitGroup{},
+		drained:  make(chan struct{}),
+
+		clock:    time.Now,
+		recorder: recorder,
 	}
+	exporterReadiness.setProjects(result.projects)
+
+	result.collectingExtending()
+
+	return result
 }
 
 func getSubAddress(base *url.URL, sub ...string) *url.URL {
@@ -850,38 +1079,33 @@ func getSubAddress(base *url.URL, sub ...string) *url.URL {
 	return newURL
 }
 
-func loadAndInitAggregatedMetrics() (*sync.Map, *sync.Map) {
+func loadAndInitAggregatedMetrics(p *project) {
 	// initialization
-	gwg := &sync.WaitGroup{}
-	stwg := &sync.WaitGroup{}
-	swg := &sync.WaitGroup{}
-	stackMap := &sync.Map{}
 	serviceMap := &sync.Map{}
+	filtered := p.filteredIds()
 
-	if err := hc.foreachCollection(stackSubpath, nil, stwg, func(data []byte) {
-		stackID, stackName := setStackAggregatedMetrics(data)
-		stackMap.Store(stackID, stackName)
-	}); err != nil {
-		logger.Warnf("failed to set stack metrics, %v", err)
-	}
-	stwg.Wait()
+	p.inventory.foreach(stackSubpath, func(data []byte) {
+		if isFiltered(filtered, data) {
+			return
+		}
+		stackID, stackName := setStackAggregatedMetrics(p, data)
+		p.stacks.Store(stackID, stackName)
+	})
 
 	// collect service metrics
-	if err := hc.foreachCollection(serviceSubpath, nil, swg, func(data []byte) {
-		serviceID, content := setServiceAggregatedMetrics(stackMap, data)
+	p.inventory.foreach(serviceSubpath, func(data []byte) {
+		if isFiltered(filtered, data) {
+			return
+		}
+		serviceID, content := setServiceAggregatedMetrics(p, p.stacks, data)
 		serviceMap.Store(serviceID, content)
-	}); err != nil {
-		logger.Warnf("failed to set service metrics, %v", err)
-	}
-	swg.Wait()
+	})
 
 	// collect instance metrics
-	if err := hc.foreachCollection(instanceSubpath, nil, gwg, func(data []byte) {
-		setInstanceAggregatedMetrics(serviceMap, data)
-	}); err != nil {
-		logrus.Warnf("failed to set instance metrics, %v", err)
-	}
-	gwg.Wait()
-
-	return stackMap, serviceMap
+	p.inventory.foreach(instanceSubpath, func(data []byte) {
+		if isFiltered(filtered, data) {
+			return
+		}
+		setInstanceAggregatedMetrics(p, serviceMap, data)
+	})
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/buger/jsonparser"
+)
+
+// resourceFilter keeps the stacks and services matched by the include filters and not matched by the exclude filters,
+// a service is only kept in a kept stack, and an instance is only kept in a kept service.
+type resourceFilter struct {
+	includeStacks   *regexp.Regexp
+	excludeStacks   *regexp.Regexp
+	includeServices *regexp.Regexp
+	excludeServices *regexp.Regexp
+
+	includeStackLabels   labelSelectors
+	excludeStackLabels   labelSelectors
+	includeServiceLabels labelSelectors
+	excludeServiceLabels labelSelectors
+}
+
+// labelSelector matches a Rancher label of a resource, a selector without the regex matches the existence of the label.
+type labelSelector struct {
+	key   string
+	value *regexp.Regexp
+}
+
+type labelSelectors []labelSelector
+
+// filter of the stacks, services and instances, parsed by initResourceFilter
+var filter = &resourceFilter{}
+
+func initResourceFilter() error {
+	f := &resourceFilter{}
+
+	for _, r := range []struct {
+		name    string
+		pattern string
+		regexp  **regexp.Regexp
+	}{
+		{"include_stacks", includeStacks, &f.includeStacks},
+		{"exclude_stacks", excludeStacks, &f.excludeStacks},
+		{"include_services", includeServices, &f.includeServices},
+		{"exclude_services", excludeServices, &f.excludeServices},
+	} {
+		if len(r.pattern) == 0 {
+			continue
+		}
+		compiled, err := compileAnchored(r.pattern)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q, %v", r.name, r.pattern, err)
+		}
+		*r.regexp = compiled
+	}
+
+	for _, s := range []struct {
+		name      string
+		selectors string
+		parsed    *labelSelectors
+	}{
+		{"include_stack_labels", includeStackLabels, &f.includeStackLabels},
+		{"exclude_stack_labels", excludeStackLabels, &f.excludeStackLabels},
+		{"include_service_labels", includeServiceLabels, &f.includeServiceLabels},
+		{"exclude_service_labels", excludeServiceLabels, &f.excludeServiceLabels},
+	} {
+		parsed, err := parseLabelSelectors(s.selectors)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q, %v", s.name, s.selectors, err)
+		}
+		*s.parsed = parsed
+	}
+
+	filter = f
+	return nil
+}
+
+// compileAnchored compiles a regex matching the whole name, as the regexes of Prometheus.
+func compileAnchored(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// parseLabelSelectors parses the comma-separated label selectors, e.g. "team=ci|qa,io.rancher.stack.temporary".
+func parseLabelSelectors(selectors string) (labelSelectors, error) {
+	var result labelSelectors
+	for _, selector := range strings.Split(selectors, ",") {
+		if selector = strings.TrimSpace(selector); len(selector) == 0 {
+			continue
+		}
+
+		s := labelSelector{key: selector}
+		if i := strings.Index(selector, "="); i >= 0 {
+			s.key = strings.TrimSpace(selector[:i])
+			value, err := compileAnchored(strings.TrimSpace(selector[i+1:]))
+			if err != nil {
+				return nil, err
+			}
+			s.value = value
+		}
+		if len(s.key) == 0 {
+			return nil, fmt.Errorf("empty label in %q", selector)
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+func (s labelSelector) matches(resourceBytes []byte) bool {
+	value, err := jsonparser.GetString(resourceBytes, "labels", s.key)
+	if err != nil {
+		return false
+	}
+	return s.value == nil || s.value.MatchString(value)
+}
+
+// matchesAll is true for empty selectors.
+func (l labelSelectors) matchesAll(resourceBytes []byte) bool {
+	for _, s := range l {
+		if !s.matches(resourceBytes) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l labelSelectors) matchesAny(resourceBytes []byte) bool {
+	for _, s := range l {
+		if s.matches(resourceBytes) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *resourceFilter) enabled() bool {
+	return f.includeStacks != nil || f.excludeStacks != nil || f.includeServices != nil || f.excludeServices != nil ||
+		len(f.includeStackLabels) != 0 || len(f.excludeStackLabels) != 0 ||
+		len(f.includeServiceLabels) != 0 || len(f.excludeServiceLabels) != 0
+}
+
+func (f *resourceFilter) keepStack(stackBytes []byte) bool {
+	name, _ := jsonparser.GetString(stackBytes, "name")
+	return keepName(name, f.includeStacks, f.excludeStacks) &&
+		f.includeStackLabels.matchesAll(stackBytes) && !f.excludeStackLabels.matchesAny(stackBytes)
+}
+
+// keepService only checks the service itself, the stack of the service is checked by the callers.
+func (f *resourceFilter) keepService(serviceBytes []byte) bool {
+	name, _ := jsonparser.GetString(serviceBytes, "name")
+	return keepName(name, f.includeServices, f.excludeServices) &&
+		f.includeServiceLabels.matchesAll(serviceBytes) && !f.excludeServiceLabels.matchesAny(serviceBytes)
+}
+
+func keepName(name string, include, exclude *regexp.Regexp) bool {
+	if include != nil && !include.MatchString(name) {
+		return false
+	}
+	return exclude == nil || !exclude.MatchString(name)
+}
+
+// filteredIds returns the ids of the filtered stacks and services of the project, which is nil without any filter,
+// it is computed before iterating the inventory as the inventory must not be read while iterating it.
+func (p *project) filteredIds() map[string]bool {
+	if !filter.enabled() {
+		return nil
+	}
+
+	filtered := make(map[string]bool)
+	p.inventory.foreach(stackSubpath, func(data []byte) {
+		if !filter.keepStack(data) {
+			id, _ := jsonparser.GetString(data, "id")
+			filtered[id] = true
+		}
+	})
+	p.inventory.foreach(serviceSubpath, func(data []byte) {
+		stackId, _ := jsonparser.GetString(data, "stackId")
+		if filtered[stackId] || !filter.keepService(data) {
+			id, _ := jsonparser.GetString(data, "id")
+			filtered[id] = true
+		}
+	})
+	return filtered
+}
+
+// isFiltered checks a stack, a service or an instance with the filtered ids of its project,
+// an instance without a stack and a service, e.g. a standalone container, is never filtered.
+func isFiltered(filtered map[string]bool, resourceBytes []byte) bool {
+	if len(filtered) == 0 {
+		return false
+	}
+
+	for _, keys := range [][]string{{"id"}, {"stackId"}, {"serviceIds", "[0]"}} {
+		if id, _ := jsonparser.GetString(resourceBytes, keys...); len(id) != 0 && filtered[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// isEventFiltered checks the resource of an event with its stack and service in the inventory,
+// the stack is resolved into the inventory by parseMessage before, and a stack or a service not in the inventory yet
+// is checked by the names in the label of the instance, e.g. io.rancher.stack_service.name=shop/api.
+func (p *project) isEventFiltered(baseType string, resourceBytes []byte) bool {
+	if !filter.enabled() {
+		return false
+	}
+
+	switch baseType {
+	case "stack":
+		return !filter.keepStack(resourceBytes)
+	case "service":
+		if !filter.keepService(resourceBytes) {
+			return true
+		}
+		stackId, _ := jsonparser.GetString(resourceBytes, "stackId")
+		if stackBytes, ok := p.inventory.get(stackSubpath, stackId); ok {
+			return !filter.keepStack(stackBytes)
+		}
+	case "instance":
+		if serviceId, _ := jsonparser.GetString(resourceBytes, "serviceIds", "[0]"); len(serviceId) != 0 {
+			if serviceBytes, ok := p.inventory.get(serviceSubpath, serviceId); ok {
+				return p.isEventFiltered("service", serviceBytes)
+			}
+		}
+		stackServiceName, _ := jsonparser.GetString(resourceBytes, "labels", "io.rancher.stack_service.name")
+		i := strings.Index(stackServiceName, "/")
+		if i >= 0 && !keepName(stackServiceName[i+1:], filter.includeServices, filter.excludeServices) {
+			return true
+		}
+		if stackId, _ := jsonparser.GetString(resourceBytes, "stackId"); len(stackId) != 0 {
+			if stackBytes, ok := p.inventory.get(stackSubpath, stackId); ok {
+				return !filter.keepStack(stackBytes)
+			}
+		}
+		// the stack cannot be resolved, e.g. Rancher Server is unreachable
+		if i >= 0 {
+			return !keepName(stackServiceName[:i], filter.includeStacks, filter.excludeStacks)
+		}
+	}
+	return false
+}
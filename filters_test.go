@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cnrancher/rancher1.x-exporter/internal/fakerancher"
+)
+
+// TestFilterEventBeforeStack filters the services and instances reported before their stacks,
+// e.g. a stack is created with its services and the events of the services arrive first.
+func TestFilterEventBeforeStack(t *testing.T) {
+	server := fakerancher.NewServer(e2eAccessKey, e2eSecretKey, &fakerancher.Project{
+		ID:   "1a7",
+		Name: "Filtered",
+		Stacks: []string{
+			`{"id":"1st7","name":"ci","state":"active","healthState":"healthy","system":false,"type":"stack"}`,
+			`{"id":"1st8","name":"web","state":"active","healthState":"healthy","system":false,"type":"stack"}`,
+		},
+	})
+	defer server.Close()
+
+	cattleURL = server.URL + "/v2-beta"
+	cattleAccessKey = e2eAccessKey
+	cattleSecretKey = e2eSecretKey
+	timeout = 5 * time.Second
+	excludeStacks = "ci"
+	defer func() {
+		excludeStacks = ""
+		_ = initResourceFilter()
+	}()
+	for _, init := range []func() error{initResourceFilter, initHttpClient} {
+		if err := init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := newOfflineProject("1a7", "Filtered")
+	p.offline = false
+
+	message := func(baseType, resource string) []byte {
+		return []byte(fmt.Sprintf(`{"name":"resource.change","resourceType":"%s","data":{"resource":%s}}`, baseType, resource))
+	}
+	for _, c := range []struct {
+		name     string
+		message  []byte
+		filtered bool
+	}{
+		{"service of excluded stack", message("service", `{"baseType":"service","id":"1s7","name":"job","stackId":"1st7","state":"activating","type":"service"}`), true},
+		{"service of kept stack", message("service", `{"baseType":"service","id":"1s8","name":"nginx","stackId":"1st8","state":"activating","type":"service"}`), false},
+		{"instance of excluded stack", message("instance", `{"baseType":"instance","id":"1i7","name":"ci-job-1","stackId":"1st7","serviceIds":["1s9"],"state":"starting","type":"container","labels":{"io.rancher.stack_service.name":"ci/job"}}`), true},
+		{"instance of kept stack", message("instance", `{"baseType":"instance","id":"1i8","name":"web-nginx-1","stackId":"1st8","serviceIds":["1s10"],"state":"starting","type":"container","labels":{"io.rancher.stack_service.name":"web/nginx"}}`), false},
+		// the stack is not found in Rancher Server, so the stack name of the label is checked
+		{"instance of unknown excluded stack", message("instance", `{"baseType":"instance","id":"1i9","name":"ci-test-1","stackId":"1st9","serviceIds":["1s11"],"state":"starting","type":"container","labels":{"io.rancher.stack_service.name":"ci/test"}}`), true},
+	} {
+		if _, ok := p.parseMessage(c.message); ok == c.filtered {
+			t.Errorf("%s is filtered %v, want %v", c.name, !ok, c.filtered)
+		}
+	}
+
+	if name, ok := p.stackName("1st7"); !ok || name != "ci" {
+		t.Errorf("stack 1st7 is resolved as %q, %v", name, ok)
+	}
+}
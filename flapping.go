@@ -0,0 +1,151 @@
+package main
+
+import (
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// healthTimeline is the current health state of a service or an instance with its recent transitions.
+type healthTimeline struct {
+	project *project
+	class   string
+	// the label values of the series without the environment labels
+	labelValues []string
+
+	healthState string
+	since       time.Time
+	// the times of the transitions in the flap window
+	transitions []time.Time
+}
+
+// healthTimelines are the health timelines of the services and the instances by their ids,
+// they are only changed by the msg event handler while holding the mutex of the states.
+type healthTimelines map[string]*healthTimeline
+
+func newHealthTimeline(msg *buffMsg, now time.Time) *healthTimeline {
+	labelValues := []string{msg.stackName, msg.name}
+	if msg.class == "instance" {
+		labelValues = []string{msg.stackName, msg.serviceName, msg.name}
+	}
+
+	return &healthTimeline{
+		project:     msg.project,
+		class:       msg.class,
+		labelValues: labelValues,
+		healthState: msg.healthState,
+		since:       now,
+	}
+}
+
+// observe counts the health transition of a service or an instance,
+// the first health state of a resource is not a transition as the previous one is unknown.
+func (h healthTimelines) observe(msg *buffMsg, now time.Time) {
+	if msg.class != "service" && msg.class != "instance" {
+		return
+	}
+
+	switch msg.state {
+	case "removed", "purging", "purged":
+		delete(h, msg.id)
+		return
+	}
+	// the instances without a health check have no health state
+	if len(msg.healthState) == 0 {
+		return
+	}
+
+	timeline, ok := h[msg.id]
+	if !ok {
+		h[msg.id] = newHealthTimeline(msg, now)
+		return
+	}
+	if timeline.healthState == msg.healthState {
+		return
+	}
+
+	timeline.healthState = msg.healthState
+	timeline.since = now
+	timeline.transitions = append(timeline.pruneTransitions(now), now)
+
+	counter := extendingTotalServiceHealthTransitions
+	if timeline.class == "instance" {
+		counter = extendingTotalInstanceHealthTransitions
+	}
+	counter.WithLabelValues(append(append([]string{msg.project.id, msg.project.name}, timeline.labelValues...), msg.healthState)...).Inc()
+}
+
+// pruneTransitions drops the transitions out of the flap window.
+func (timeline *healthTimeline) pruneTransitions(now time.Time) []time.Time {
+	i := 0
+	for i < len(timeline.transitions) && now.Sub(timeline.transitions[i]) > healthFlapWindow {
+		i++
+	}
+	timeline.transitions = timeline.transitions[i:]
+	return timeline.transitions
+}
+
+// track starts the timelines of the listed services and instances at their current health states,
+// and forgets the ones which are not listed anymore.
+func (h healthTimelines) track(p *project, now time.Time) {
+	for id, timeline := range h {
+		if timeline.project != p {
+			continue
+		}
+		if _, ok := p.inventory.get(inventoryCollections[timeline.class], id); !ok {
+			delete(h, id)
+		}
+	}
+
+	for _, baseType := range []string{"service", "instance"} {
+		var untracked [][]byte
+		p.inventory.foreach(inventoryCollections[baseType], func(data []byte) {
+			id, _ := jsonparser.GetString(data, "id")
+			if _, ok := h[id]; !ok {
+				untracked = append(untracked, append([]byte(nil), data...))
+			}
+		})
+
+		for _, data := range untracked {
+			if msg, ok := p.newBuffMsg(baseType, data); ok {
+				h.observe(&msg, now)
+			}
+		}
+	}
+}
+
+// healthMetrics refills the health gauges from the timelines, the gauges are shared by the concurrent scrapes,
+// so they are reset, refilled and collected while holding the mutex of the exporter.
+func (r *rancherExporter) healthMetrics(ch chan<- prometheus.Metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	extendingServiceHealthStateSeconds.Reset()
+	extendingInstanceHealthStateSeconds.Reset()
+	extendingServiceHealthFlapping.Reset()
+	extendingInstanceHealthFlapping.Reset()
+
+	r.states.mutex.Lock()
+	now := r.clock()
+	for _, timeline := range r.states.health {
+		seconds, flapping := extendingServiceHealthStateSeconds, extendingServiceHealthFlapping
+		if timeline.class == "instance" {
+			seconds, flapping = extendingInstanceHealthStateSeconds, extendingInstanceHealthFlapping
+		}
+
+		labelValues := append([]string{timeline.project.id, timeline.project.name}, timeline.labelValues...)
+		seconds.WithLabelValues(append(labelValues, timeline.healthState)...).Set(now.Sub(timeline.since).Seconds())
+		if healthFlapThreshold > 0 && len(timeline.pruneTransitions(now)) >= healthFlapThreshold {
+			flapping.WithLabelValues(labelValues...).Set(1)
+		} else {
+			flapping.WithLabelValues(labelValues...).Set(0)
+		}
+	}
+	r.states.mutex.Unlock()
+
+	extendingServiceHealthStateSeconds.Collect(ch)
+	extendingInstanceHealthStateSeconds.Collect(ch)
+	extendingServiceHealthFlapping.Collect(ch)
+	extendingInstanceHealthFlapping.Collect(ch)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gaugeValue(t *testing.T, vec *prometheus.GaugeVec, labelValues ...string) float64 {
+	t.Helper()
+
+	gauge, err := vec.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb := &dto.Metric{}
+	if err := gauge.Write(pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetGauge().GetValue()
+}
+
+func TestHealthTimelines(t *testing.T) {
+	healthFlapWindow = time.Minute
+	healthFlapThreshold = 3
+	aggregationMode = aggregationModeSentinel
+	extendingTotalServiceHealthTransitions.Reset()
+
+	p := newOfflineProject("1a7", "Flapping")
+	start := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)
+	now := start
+
+	r := newReplayExporter()
+	r.projects = []*project{p}
+	r.clock = func() time.Time {
+		return now
+	}
+
+	service := func(healthState string) buffMsg {
+		return buffMsg{project: p, class: "service", id: "1s7", name: "api", stackName: "shop", state: "active", healthState: healthState}
+	}
+	scrapeHealth := func() {
+		ch := make(chan prometheus.Metric)
+		go func() {
+			r.healthMetrics(ch)
+			close(ch)
+		}()
+		for range ch {
+		}
+	}
+
+	// healthy at start, then unhealthy, healthy and unhealthy again 20s apart
+	for i, healthState := range []string{"healthy", "healthy", "unhealthy", "healthy", "unhealthy"} {
+		now = start.Add(time.Duration(i) * 10 * time.Second)
+		msg := service(healthState)
+		r.states.health.observe(&msg, now)
+	}
+
+	for _, c := range []struct {
+		healthState string
+		want        float64
+	}{
+		{"unhealthy", 2},
+		{"healthy", 1},
+	} {
+		counters, err := collectCounters(extendingTotalServiceHealthTransitions.name, extendingTotalServiceHealthTransitions.CounterVec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := 0.0
+		for _, counter := range counters {
+			if counter.Labels["environment_id"] == p.id && counter.Labels["health_state"] == c.healthState {
+				got = counter.Value
+			}
+		}
+		if got != c.want {
+			t.Errorf("transitions to %s = %v, want %v", c.healthState, got, c.want)
+		}
+	}
+
+	now = now.Add(15 * time.Second)
+	scrapeHealth()
+	if got := gaugeValue(t, extendingServiceHealthStateSeconds, p.id, p.name, "shop", "api", "unhealthy"); got != 15 {
+		t.Errorf("seconds in unhealthy = %v, want 15", got)
+	}
+	if got := gaugeValue(t, extendingServiceHealthFlapping, p.id, p.name, "shop", "api"); got != 1 {
+		t.Errorf("flapping = %v, want 1", got)
+	}
+
+	// the first transitions leave the window
+	now = now.Add(time.Minute)
+	scrapeHealth()
+	if got := gaugeValue(t, extendingServiceHealthFlapping, p.id, p.name, "shop", "api"); got != 0 {
+		t.Errorf("flapping = %v after the window, want 0", got)
+	}
+
+	removed := service("unhealthy")
+	removed.state = "removed"
+	r.states.health.observe(&removed, now)
+	if len(r.states.health) != 0 {
+		t.Errorf("%d timelines are kept after the service is removed", len(r.states.health))
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthStatusOK          = "ok"
+	healthStatusUnavailable = "unavailable"
+)
+
+// healthCheck is the status of a dependency of serving the metrics.
+type healthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string        `json:"status"`
+	Uptime string        `json:"uptime,omitempty"`
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+// readiness reports whether the exporter is ready to serve the metrics,
+// the web is served before the environments are initialized, so the projects are set after initProjects.
+type readiness struct {
+	mutex    *sync.RWMutex
+	started  time.Time
+	projects []*project
+}
+
+var exporterReadiness = newReadiness()
+
+func newReadiness() *readiness {
+	return &readiness{
+		mutex:   &sync.RWMutex{},
+		started: time.Now(),
+	}
+}
+
+func (r *readiness) setProjects(projects []*project) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.projects = projects
+}
+
+// checks returns the dependencies of every environment: the inventory is listed and the aggregated metrics are
+// initialized once by loadAndInitAggregatedMetrics, and the websocket is connected.
+func (r *readiness) checks() []healthCheck {
+	r.mutex.RLock()
+	projects := r.projects
+	r.mutex.RUnlock()
+
+	if projects == nil {
+		return []healthCheck{{
+			Name:   "environments",
+			Status: healthStatusUnavailable,
+			Error:  "the environments are not initialized yet",
+		}}
+	}
+
+	checks := []healthCheck{{Name: "environments", Status: healthStatusOK}}
+	for _, p := range projects {
+		initialized := healthCheck{Name: fmt.Sprintf("environment [%s] metrics", p.name), Status: healthStatusOK}
+		if !p.isInitialized() {
+			initialized.Status = healthStatusUnavailable
+			initialized.Error = "the resources are not listed and the aggregated metrics are not initialized yet"
+		}
+
+		connected := healthCheck{Name: fmt.Sprintf("environment [%s] websocket", p.name), Status: healthStatusOK}
+		if !p.isConnected() {
+			connected.Status = healthStatusUnavailable
+			connected.Error = "the websocket is not connected"
+		}
+
+		checks = append(checks, initialized, connected)
+	}
+	return checks
+}
+
+// healthzHandler reports the liveness of the process, which never depends on Rancher Server.
+func (r *readiness) healthzHandler(w http.ResponseWriter, req *http.Request) {
+	writeHealthResponse(w, http.StatusOK, healthResponse{
+		Status: healthStatusOK,
+		Uptime: time.Since(r.started).Round(time.Second).String(),
+	})
+}
+
+// readyzHandler reports the readiness, the failing dependencies are explained in the checks.
+func (r *readiness) readyzHandler(w http.ResponseWriter, req *http.Request) {
+	response := healthResponse{
+		Status: healthStatusOK,
+		Checks: r.checks(),
+	}
+	for _, check := range response.Checks {
+		if check.Status != healthStatusOK {
+			response.Status = healthStatusUnavailable
+			break
+		}
+	}
+
+	if response.Status == healthStatusOK {
+		writeHealthResponse(w, http.StatusOK, response)
+	} else {
+		writeHealthResponse(w, http.StatusServiceUnavailable, response)
+	}
+}
+
+func writeHealthResponse(w http.ResponseWriter, code int, response healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func (p *project) setInitialized() {
+	atomic.StoreInt32(&p.initialized, 1)
+}
+
+func (p *project) isInitialized() bool {
+	return atomic.LoadInt32(&p.initialized) == 1
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"strconv"
+
 	"github.com/buger/jsonparser"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
 	hostSubpath = "hosts"
+
+	// the memory and the disk of host info are reported in MiB
+	hostInfoUnit = 1024 * 1024
 )
 
-func setHostMetrics(hostBytes []byte) {
+var hostLoadAveragePeriods = []string{"1m", "5m", "15m"}
+
+func setHostMetrics(p *project, hostBytes []byte) (string, string) {
 	hostName, _ := jsonparser.GetString(hostBytes, "name")
 	hostState, _ := jsonparser.GetString(hostBytes, "state")
 	hostId, _ := jsonparser.GetString(hostBytes, "id")
@@ -18,19 +26,86 @@ func setHostMetrics(hostBytes []byte) {
 		hostName, _ = jsonparser.GetString(hostBytes, "hostname")
 	}
 
+	curried := hostLabels.curry(hostBytes)
+	hostsState := infinityWorksHostsState.MustCurryWith(curried)
+	hostAgentsState := infinityWorksHostAgentsState.MustCurryWith(curried)
+
 	for _, y := range hostStates {
 		if hostState == y {
-			infinityWorksHostsState.WithLabelValues(hostId, hostName, y).Set(1)
+			hostsState.WithLabelValues(p.id, p.name, hostId, hostName, y).Set(1)
 		} else {
-			infinityWorksHostsState.WithLabelValues(hostId, hostName, y).Set(0)
+			hostsState.WithLabelValues(p.id, p.name, hostId, hostName, y).Set(0)
 		}
 	}
 
 	for _, y := range agentStates {
 		if hostAgentState == y {
-			infinityWorksHostAgentsState.WithLabelValues(hostId, hostName, y).Set(1)
+			hostAgentsState.WithLabelValues(p.id, p.name, hostId, hostName, y).Set(1)
 		} else {
-			infinityWorksHostAgentsState.WithLabelValues(hostId, hostName, y).Set(0)
+			hostAgentsState.WithLabelValues(p.id, p.name, hostId, hostName, y).Set(0)
 		}
 	}
+
+	setHostInfoMetrics(p, hostId, hostName, hostBytes, curried)
+
+	if len(hostLabels) != 0 {
+		hostLabelsInfo.WithLabelValues(append([]string{p.id, p.name, hostId, hostName}, hostLabels.values(hostBytes)...)...).Set(1)
+	}
+
+	return hostId, hostName
+}
+
+// setHostInfoMetrics exports the resources reported by the agent in the info of host,
+// a host without info, e.g. a host still being provisioned, only has the info series.
+func setHostInfoMetrics(p *project, hostId, hostName string, hostBytes []byte, curried prometheus.Labels) {
+	if value, ok := getHostInfoFloat(hostBytes, "info", "memoryInfo", "memTotal"); ok {
+		hostMemoryTotal.MustCurryWith(curried).WithLabelValues(p.id, p.name, hostId, hostName).Set(value * hostInfoUnit)
+	}
+	if value, ok := getHostInfoFloat(hostBytes, "info", "memoryInfo", "memAvailable"); ok {
+		hostMemoryAvailable.MustCurryWith(curried).WithLabelValues(p.id, p.name, hostId, hostName).Set(value * hostInfoUnit)
+	}
+	if value, ok := getHostInfoFloat(hostBytes, "info", "cpuInfo", "count"); ok {
+		hostCPUCount.MustCurryWith(curried).WithLabelValues(p.id, p.name, hostId, hostName).Set(value)
+	}
+
+	i := 0
+	_, _ = jsonparser.ArrayEach(hostBytes, func(loadAvgBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+		if i < len(hostLoadAveragePeriods) {
+			if value, err := strconv.ParseFloat(string(loadAvgBytes), 64); err == nil {
+				hostLoadAverage.MustCurryWith(curried).WithLabelValues(p.id, p.name, hostId, hostName, hostLoadAveragePeriods[i]).Set(value)
+			}
+		}
+		i++
+	}, "info", "cpuInfo", "loadAvg")
+
+	_ = jsonparser.ObjectEach(hostBytes, func(mountBytes []byte, mountPointBytes []byte, dataType jsonparser.ValueType, offset int) error {
+		mount := string(mountBytes)
+		if value, ok := getHostInfoFloat(mountPointBytes, "total"); ok {
+			hostFilesystemSize.MustCurryWith(curried).WithLabelValues(p.id, p.name, hostId, hostName, mount).Set(value * hostInfoUnit)
+		}
+		if value, ok := getHostInfoFloat(mountPointBytes, "used"); ok {
+			hostFilesystemUsed.MustCurryWith(curried).WithLabelValues(p.id, p.name, hostId, hostName, mount).Set(value * hostInfoUnit)
+		}
+		return nil
+	}, "info", "diskInfo", "mountPoints")
+
+	dockerVersion, _ := jsonparser.GetString(hostBytes, "info", "osInfo", "dockerVersion")
+	kernelVersion, _ := jsonparser.GetString(hostBytes, "info", "osInfo", "kernelVersion")
+	operatingSystem, _ := jsonparser.GetString(hostBytes, "info", "osInfo", "operatingSystem")
+
+	hostInfo.MustCurryWith(curried).WithLabelValues(p.id, p.name, hostId, hostName, dockerVersion, kernelVersion, operatingSystem).Set(1)
+}
+
+// getHostInfoFloat reads a number of host info, which may be reported as a string by some agents.
+func getHostInfoFloat(data []byte, keys ...string) (float64, bool) {
+	valueBytes, dataType, _, err := jsonparser.Get(data, keys...)
+	if err != nil || (dataType != jsonparser.Number && dataType != jsonparser.String) {
+		return 0, false
+	}
+
+	value, err := strconv.ParseFloat(string(valueBytes), 64)
+	if err != nil {
+		return 0, false
+	}
+	return value, true
 }
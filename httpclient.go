@@ -1,37 +1,139 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/buger/jsonparser"
+	"github.com/gorilla/websocket"
 	logger "github.com/sirupsen/logrus"
 )
 
+// apiIDRegexp matches the resource ids of Rancher, e.g. 1a5, 1st12, 1i3456.
+var apiIDRegexp = regexp.MustCompile(`^[0-9]+[a-z]+[0-9]+$`)
+
+var (
+	// guards hc, which is replaced by reloading the options while the requests are in flight
+	hcMutex = &sync.RWMutex{}
+	hc      *httpClient
+)
+
 type httpClient struct {
-	ak, sk   string
-	endpoint *url.URL
-	client   *http.Client
+	ak, sk    string
+	endpoint  *url.URL
+	client    *http.Client
+	transport *http.Transport
+	// dialer of the websockets, which shares the TLS and the proxy settings with the transport
+	dialer *websocket.Dialer
 }
 
-func initHttpClient() {
+func initHttpClient() error {
 	endpoint, err := url.Parse(cattleURL)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	tlsConfig, err := newCattleTLSConfig()
+	if err != nil {
+		return err
+	}
+	proxy, err := newCattleProxy()
+	if err != nil {
+		return err
 	}
-	hc = &httpClient{
-		ak:       cattleAccessKey,
-		sk:       cattleSecretKey,
-		endpoint: endpoint,
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+
+	dialer := &websocket.Dialer{
+		Proxy:            proxy,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+	}
+	if timeout > 0 {
+		dialer.HandshakeTimeout = timeout
+	}
+
+	client := &httpClient{
+		ak:        cattleAccessKey,
+		sk:        cattleSecretKey,
+		endpoint:  endpoint,
+		transport: transport,
+		dialer:    dialer,
 		client: &http.Client{
 			Timeout: timeout,
 		},
 	}
-	hc.client.Transport = hc
+	client.client.Transport = client
+
+	hcMutex.Lock()
+	previous := hc
+	hc = client
+	hcMutex.Unlock()
+
+	// the requests in flight keep using the previous transport, only its idle connections are closed
+	if previous != nil {
+		previous.transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// getHttpClient returns the current client, which is got for every request as it is replaced by reloading the options.
+func getHttpClient() *httpClient {
+	hcMutex.RLock()
+	defer hcMutex.RUnlock()
+	return hc
+}
+
+func newCattleTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cattleServerName,
+		InsecureSkipVerify: cattleInsecureSkipVerify,
+	}
+
+	if len(cattleCAFile) != 0 {
+		ca, err := ioutil.ReadFile(cattleCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA file %s, %v", cattleCAFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate in CA file %s", cattleCAFile)
+		}
+	}
+
+	if len(cattleCertFile) != 0 || len(cattleKeyFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(cattleCertFile, cattleKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate %s and key %s, %v", cattleCertFile, cattleKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// newCattleProxy uses the proxy of cattleProxyURL, or the proxy of HTTP_PROXY, HTTPS_PROXY and NO_PROXY if it is empty.
+func newCattleProxy() (func(*http.Request) (*url.URL, error), error) {
+	if len(cattleProxyURL) == 0 {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := url.Parse(cattleProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url %s, %v", cattleProxyURL, err)
+	}
+	return http.ProxyURL(proxyURL), nil
 }
 
 func (r *httpClient) get(uri string, queries url.Values) ([]byte, error) {
@@ -42,19 +144,61 @@ func (r *httpClient) get(uri string, queries url.Values) ([]byte, error) {
 		return nil, err
 	}
 	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("unexpected status %s of %s", resp.Status, uri)
+	}
 	return ioutil.ReadAll(resp.Body)
 }
 
-func (r *httpClient) getByProject(uri string, queries url.Values) ([]byte, error) {
+func (r *httpClient) getByProject(projectID, uri string, queries url.Values) ([]byte, error) {
 	return r.get(path.Join("projects", projectID, uri), queries)
 }
 
+// getLink gets a link of a resource, which is an absolute url under the endpoint.
+func (r *httpClient) getLink(link string) ([]byte, error) {
+	resp, err := r.client.Get(link)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("unexpected status %s of %s", resp.Status, link)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
 func (r *httpClient) RoundTrip(req *http.Request) (*http.Response, error) {
 	req.SetBasicAuth(r.ak, r.sk)
-	return http.DefaultTransport.RoundTrip(req)
+
+	apiPath := r.apiPath(req.URL.Path)
+	start := time.Now()
+	resp, err := r.transport.RoundTrip(req)
+	exporterAPIRequestDuration.WithLabelValues(apiPath).Observe(time.Since(start).Seconds())
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	exporterAPIRequests.WithLabelValues(apiPath, code).Inc()
+
+	return resp, err
+}
+
+// apiPath trims the endpoint prefix and masks the resource ids to keep the cardinality of the path label low,
+// e.g. /v2-beta/projects/1a5/stacks/1st12 -> projects/:id/stacks/:id.
+func (r *httpClient) apiPath(urlPath string) string {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(urlPath, r.endpoint.Path), "/"), "/")
+	for i, segment := range segments {
+		if apiIDRegexp.MatchString(segment) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
 }
 
-func (r *httpClient) foreachCollection(uri string, queries url.Values, wg *sync.WaitGroup, contentHandler func(data []byte)) error {
+func (r *httpClient) foreachCollection(projectID, uri string, queries url.Values, wg *sync.WaitGroup, contentHandler func(data []byte)) error {
 	defaultQuery := url.Values{
 		"limit": []string{"100"},
 		"sort":  []string{"id"},
@@ -70,7 +214,7 @@ func (r *httpClient) foreachCollection(uri string, queries url.Values, wg *sync.
 	hasNext := true
 
 	for hasNext {
-		collectionData, err := r.getByProject(uri, defaultQuery)
+		collectionData, err := r.getByProject(projectID, uri, defaultQuery)
 		if err != nil {
 			return err
 		}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"sync"
 
 	"github.com/buger/jsonparser"
@@ -11,14 +12,14 @@ const (
 	instanceSubpath = "instances"
 )
 
-func setInstanceMetrics(services *sync.Map, instanceBytes []byte) {
+func setInstanceMetrics(p *project, hosts, services *sync.Map, instanceBytes []byte) (string, string) {
 	instanceName, _ := jsonparser.GetString(instanceBytes, "name")
 	instanceId, _ := jsonparser.GetString(instanceBytes, "id")
 	instanceSystem, _ := jsonparser.GetUnsafeString(instanceBytes, "system")
 	instanceType, _ := jsonparser.GetString(instanceBytes, "type")
 
 	var stackName, serviceName string
-	labels := []string{projectName}
+	labels := []string{p.id, p.name}
 
 	serviceId, err := jsonparser.GetString(instanceBytes, "serviceIds", "[0]")
 	if err != nil {
@@ -33,15 +34,66 @@ func setInstanceMetrics(services *sync.Map, instanceBytes []byte) {
 	}
 
 	labels = append(labels, stackName, serviceName, instanceName, instanceSystem, instanceType)
-	extendingInstanceHeartbeat.WithLabelValues(labels...).Set(float64(1))
+
+	curried := instanceLabels.curry(instanceBytes)
+	instancesStateCurried := instancesState.MustCurryWith(curried)
+	instancesHealthCurried := instancesHealth.MustCurryWith(curried)
+
+	extendingInstanceHeartbeat.MustCurryWith(curried).WithLabelValues(labels...).Set(float64(1))
+
+	instanceState, _ := jsonparser.GetString(instanceBytes, "state")
+	instanceHealthState, _ := jsonparser.GetString(instanceBytes, "healthState")
+
+	for _, y := range instanceStates {
+		if instanceState == y {
+			instancesStateCurried.WithLabelValues(p.id, p.name, instanceId, serviceId, instanceName, stackName, serviceName, y, instanceSystem).Set(1)
+		} else {
+			instancesStateCurried.WithLabelValues(p.id, p.name, instanceId, serviceId, instanceName, stackName, serviceName, y, instanceSystem).Set(0)
+		}
+	}
+
+	// the instances without health check have no health state
+	if len(instanceHealthState) != 0 {
+		for _, y := range instanceHealthStates {
+			if instanceHealthState == y {
+				instancesHealthCurried.WithLabelValues(p.id, p.name, instanceId, serviceId, instanceName, stackName, serviceName, y, instanceSystem).Set(1)
+			} else {
+				instancesHealthCurried.WithLabelValues(p.id, p.name, instanceId, serviceId, instanceName, stackName, serviceName, y, instanceSystem).Set(0)
+			}
+		}
+	}
+
+	instanceStartCountValue, _ := jsonparser.GetInt(instanceBytes, "startCount")
+	instancesStartCount.MustCurryWith(curried).WithLabelValues(p.id, p.name, instanceId, instanceName, stackName, serviceName, instanceSystem).Set(float64(instanceStartCountValue))
+
+	if instanceState == "stopped" {
+		if instanceExitCodeValue, err := jsonparser.GetInt(instanceBytes, "exitCode"); err == nil {
+			instancesExitCode.MustCurryWith(curried).WithLabelValues(p.id, p.name, instanceId, instanceName, stackName, serviceName, instanceSystem).Set(float64(instanceExitCodeValue))
+		}
+	}
+
+	hostId, _ := jsonparser.GetString(instanceBytes, "hostId")
+	var hostName string
+	if value, ok := hosts.Load(hostId); ok {
+		hostName = value.(string)
+	}
+	instanceImage, _ := jsonparser.GetString(instanceBytes, "imageUuid")
+	instanceImage = strings.TrimPrefix(instanceImage, "docker:")
+	instancesInfo.MustCurryWith(curried).WithLabelValues(p.id, p.name, instanceId, instanceName, stackName, serviceName, hostId, hostName, instanceImage).Set(1)
+
+	if len(instanceLabels) != 0 {
+		instanceLabelsInfo.WithLabelValues(append([]string{p.id, p.name, instanceId, stackName, serviceName, instanceName}, instanceLabels.values(instanceBytes)...)...).Set(1)
+	}
 
 	if instanceFirstRunningTS, _ := jsonparser.GetInt(instanceBytes, "firstRunningTS"); instanceFirstRunningTS != 0 {
 		instanceCreatedTS, _ := jsonparser.GetInt(instanceBytes, "createdTS")
 		extendingInstanceBootstrapMsCost.WithLabelValues(labels...).Set(float64(instanceFirstRunningTS - instanceCreatedTS))
 	}
+
+	return stackName, serviceName
 }
 
-func setInstanceAggregatedMetrics(services *sync.Map, instanceBytes []byte) {
+func setInstanceAggregatedMetrics(p *project, services *sync.Map, instanceBytes []byte) {
 	instanceName, _ := jsonparser.GetString(instanceBytes, "name")
 	instanceId, _ := jsonparser.GetString(instanceBytes, "id")
 	instanceSystem, _ := jsonparser.GetUnsafeString(instanceBytes, "system")
@@ -52,7 +104,7 @@ func setInstanceAggregatedMetrics(services *sync.Map, instanceBytes []byte) {
 
 	var stackName, serviceName string
 
-	labels := []string{projectName}
+	labels := []string{p.id, p.name}
 
 	serviceId, err := jsonparser.GetString(instanceBytes, "serviceIds", "[0]")
 	if err != nil {
@@ -68,35 +120,35 @@ func setInstanceAggregatedMetrics(services *sync.Map, instanceBytes []byte) {
 
 	labels = append(labels, stackName, serviceName, instanceName, instanceSystem, instanceType)
 
-	extendingTotalInstanceBootstraps.WithLabelValues(projectName, specialTag, specialTag, specialTag)
-	extendingTotalInstanceBootstraps.WithLabelValues(projectName, stackName, specialTag, specialTag)
-	extendingTotalInstanceBootstraps.WithLabelValues(projectName, stackName, serviceName, specialTag)
-	extendingTotalInstanceBootstraps.WithLabelValues(projectName, stackName, serviceName, instanceName)
-	extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, specialTag, specialTag, specialTag)
-	extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, stackName, specialTag, specialTag)
-	extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, stackName, serviceName, specialTag)
-	extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, stackName, serviceName, instanceName)
-	extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, specialTag, specialTag, specialTag)
-	extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, stackName, specialTag, specialTag)
-	extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, stackName, serviceName, specialTag)
-	extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, stackName, serviceName, instanceName)
+	extendingTotalInstanceBootstraps.WithLabelValues(p.id, p.name, specialTag, specialTag, specialTag)
+	extendingTotalInstanceBootstraps.WithLabelValues(p.id, p.name, stackName, specialTag, specialTag)
+	extendingTotalInstanceBootstraps.WithLabelValues(p.id, p.name, stackName, serviceName, specialTag)
+	extendingTotalInstanceBootstraps.WithLabelValues(p.id, p.name, stackName, serviceName, instanceName)
+	extendingTotalSuccessInstanceBootstrap.WithLabelValues(p.id, p.name, specialTag, specialTag, specialTag)
+	extendingTotalSuccessInstanceBootstrap.WithLabelValues(p.id, p.name, stackName, specialTag, specialTag)
+	extendingTotalSuccessInstanceBootstrap.WithLabelValues(p.id, p.name, stackName, serviceName, specialTag)
+	extendingTotalSuccessInstanceBootstrap.WithLabelValues(p.id, p.name, stackName, serviceName, instanceName)
+	extendingTotalErrorInstanceBootstrap.WithLabelValues(p.id, p.name, specialTag, specialTag, specialTag)
+	extendingTotalErrorInstanceBootstrap.WithLabelValues(p.id, p.name, stackName, specialTag, specialTag)
+	extendingTotalErrorInstanceBootstrap.WithLabelValues(p.id, p.name, stackName, serviceName, specialTag)
+	extendingTotalErrorInstanceBootstrap.WithLabelValues(p.id, p.name, stackName, serviceName, instanceName)
 
 	switch instanceState {
 	case "stopped":
 		fallthrough
 	case "running":
-		extendingTotalInstanceInitializations.WithLabelValues(projectName, specialTag, specialTag, specialTag).Inc()
-		extendingTotalInstanceInitializations.WithLabelValues(projectName, stackName, specialTag, specialTag).Inc()
-		extendingTotalInstanceInitializations.WithLabelValues(projectName, stackName, serviceName, specialTag).Inc()
-		extendingTotalInstanceInitializations.WithLabelValues(projectName, stackName, serviceName, instanceName).Inc()
-		extendingTotalSuccessInstanceInitialization.WithLabelValues(projectName, specialTag, specialTag, specialTag).Inc()
-		extendingTotalSuccessInstanceInitialization.WithLabelValues(projectName, stackName, specialTag, specialTag).Inc()
-		extendingTotalSuccessInstanceInitialization.WithLabelValues(projectName, stackName, serviceName, specialTag).Inc()
-		extendingTotalSuccessInstanceInitialization.WithLabelValues(projectName, stackName, serviceName, instanceName).Inc()
-		extendingTotalErrorInstanceInitialization.WithLabelValues(projectName, specialTag, specialTag, specialTag)
-		extendingTotalErrorInstanceInitialization.WithLabelValues(projectName, stackName, specialTag, specialTag)
-		extendingTotalErrorInstanceInitialization.WithLabelValues(projectName, stackName, serviceName, specialTag)
-		extendingTotalErrorInstanceInitialization.WithLabelValues(projectName, stackName, serviceName, instanceName)
+		extendingTotalInstanceInitializations.WithLabelValues(p.id, p.name, specialTag, specialTag, specialTag).Inc()
+		extendingTotalInstanceInitializations.WithLabelValues(p.id, p.name, stackName, specialTag, specialTag).Inc()
+		extendingTotalInstanceInitializations.WithLabelValues(p.id, p.name, stackName, serviceName, specialTag).Inc()
+		extendingTotalInstanceInitializations.WithLabelValues(p.id, p.name, stackName, serviceName, instanceName).Inc()
+		extendingTotalSuccessInstanceInitialization.WithLabelValues(p.id, p.name, specialTag, specialTag, specialTag).Inc()
+		extendingTotalSuccessInstanceInitialization.WithLabelValues(p.id, p.name, stackName, specialTag, specialTag).Inc()
+		extendingTotalSuccessInstanceInitialization.WithLabelValues(p.id, p.name, stackName, serviceName, specialTag).Inc()
+		extendingTotalSuccessInstanceInitialization.WithLabelValues(p.id, p.name, stackName, serviceName, instanceName).Inc()
+		extendingTotalErrorInstanceInitialization.WithLabelValues(p.id, p.name, specialTag, specialTag, specialTag)
+		extendingTotalErrorInstanceInitialization.WithLabelValues(p.id, p.name, stackName, specialTag, specialTag)
+		extendingTotalErrorInstanceInitialization.WithLabelValues(p.id, p.name, stackName, serviceName, specialTag)
+		extendingTotalErrorInstanceInitialization.WithLabelValues(p.id, p.name, stackName, serviceName, instanceName)
 
 		if instanceFirstRunningTS != 0 {
 			instanceStartupTime := instanceFirstRunningTS - instanceCreatedTS
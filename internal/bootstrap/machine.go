@@ -0,0 +1,242 @@
+// Package bootstrap is the state machine of the bootstrapping stacks, services and instances of Rancher 1.6,
+// it tracks the resources by the state and the health state of their resource.change events,
+// and reports the bootstraps counted, succeeded, failed and timed out to a callback.
+package bootstrap
+
+// Kind is the type of a tracked resource.
+type Kind int
+
+const (
+	Stack Kind = iota
+	Service
+	Instance
+)
+
+// Kinds are all kinds, in the order of the parents before their children.
+var Kinds = []Kind{Stack, Service, Instance}
+
+// String returns the base type of the kind in Rancher API.
+func (k Kind) String() string {
+	switch k {
+	case Stack:
+		return "stack"
+	case Service:
+		return "service"
+	case Instance:
+		return "instance"
+	}
+	return "unknown"
+}
+
+// State is the in-flight state of a tracked resource, the values are persisted in the state file of the exporter,
+// so they must never be renumbered.
+type State uint64
+
+const (
+	StackActiveInitializing State = iota
+	StackActiveUnhealthy
+
+	ServiceActivatingHealthy
+	ServiceActiveInitializing
+	ServiceRestarting
+	ServiceUpgrading
+
+	InstanceStarting
+	InstanceStopping
+	InstanceStopped
+	InstanceRunningReinitializing
+)
+
+// Outcome is the result of a transition reported to the callback.
+type Outcome int
+
+const (
+	// NoOutcome is a transition which only tracks or forgets the resource
+	NoOutcome Outcome = iota
+	// Counted is the start of a bootstrap
+	Counted
+	// Succeeded, Failed and TimedOut finish a bootstrap, the resource is forgotten
+	Succeeded
+	Failed
+	TimedOut
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Counted:
+		return "count"
+	case Succeeded:
+		return "success"
+	case Failed:
+		return "error"
+	case TimedOut:
+		return "timeout"
+	}
+	return "none"
+}
+
+// Event is a resource.change event of a stack, a service or an instance.
+type Event struct {
+	Kind Kind
+	ID   string
+	// the stack id of a service, or the service id of an instance
+	ParentID    string
+	State       string
+	HealthState string
+
+	// the representation of the resource of the caller, which is passed back to the callback
+	Resource interface{}
+}
+
+// Callback receives the outcomes of the transitions.
+type Callback func(outcome Outcome, event Event)
+
+// Machine tracks the bootstrapping resources, it is not safe for concurrent use.
+type Machine struct {
+	states map[Kind]map[string]State
+	// stack id -> the restarting or upgrading state of a service in it
+	stackServices map[string]State
+	callback      Callback
+}
+
+func NewMachine() *Machine {
+	m := &Machine{
+		states:        make(map[Kind]map[string]State, len(Kinds)),
+		stackServices: make(map[string]State),
+		callback:      func(Outcome, Event) {},
+	}
+	for _, kind := range Kinds {
+		m.states[kind] = make(map[string]State)
+	}
+	return m
+}
+
+// SetCallback sets the callback of the outcomes, which must not call the machine.
+func (m *Machine) SetCallback(callback Callback) {
+	m.callback = callback
+}
+
+// Handle applies the first transition of the kind matching the event, an event without any matching transition is ignored.
+func (m *Machine) Handle(e Event) {
+	if e.Kind == Service {
+		m.markStack(e)
+	}
+
+	states := m.states[e.Kind]
+	current, tracked := states[e.ID]
+	for _, t := range Transitions[e.Kind] {
+		if !t.matches(e, current, tracked, m.stackServices) {
+			continue
+		}
+
+		if t.Track {
+			states[e.ID] = t.To
+		}
+		if t.Outcome != NoOutcome {
+			m.callback(t.Outcome, e)
+		}
+		if t.Forget || t.Outcome.finishes() {
+			delete(states, e.ID)
+		}
+		return
+	}
+}
+
+// markStack records the restarting or upgrading service in its stack, which holds the success of the stack.
+func (m *Machine) markStack(e Event) {
+	for _, mark := range StackServiceMarks {
+		if mark.ServiceState != e.State {
+			continue
+		}
+
+		if !mark.Clear {
+			m.stackServices[e.ParentID] = mark.Mark
+		} else if current, ok := m.stackServices[e.ParentID]; ok && current == mark.Mark {
+			delete(m.stackServices, e.ParentID)
+		}
+	}
+}
+
+// Timeout finishes the bootstrap of a tracked resource as timed out.
+func (m *Machine) Timeout(e Event) {
+	if _, ok := m.states[e.Kind][e.ID]; !ok {
+		return
+	}
+
+	m.callback(TimedOut, e)
+	delete(m.states[e.Kind], e.ID)
+}
+
+// Forget stops tracking a resource of any kind without an outcome.
+func (m *Machine) Forget(id string) {
+	for _, states := range m.states {
+		delete(states, id)
+	}
+}
+
+// State returns the state of a tracked resource.
+func (m *Machine) State(kind Kind, id string) (State, bool) {
+	state, ok := m.states[kind][id]
+	return state, ok
+}
+
+// Lookup returns the kind of a tracked resource, the ids of Rancher are unique across the kinds.
+func (m *Machine) Lookup(id string) (Kind, bool) {
+	for _, kind := range Kinds {
+		if _, ok := m.states[kind][id]; ok {
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+// IDs returns the ids of the tracked resources of the kind.
+func (m *Machine) IDs(kind Kind) []string {
+	ids := make([]string, 0, len(m.states[kind]))
+	for id := range m.states[kind] {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Len returns the number of the tracked resources of the kind.
+func (m *Machine) Len(kind Kind) int {
+	return len(m.states[kind])
+}
+
+// Snapshot is a copy of the tracked states, which is persisted across restarts.
+type Snapshot struct {
+	Stacks        map[string]State
+	Services      map[string]State
+	Instances     map[string]State
+	StackServices map[string]State
+}
+
+func (m *Machine) Snapshot() Snapshot {
+	return Snapshot{
+		Stacks:        copyStates(m.states[Stack]),
+		Services:      copyStates(m.states[Service]),
+		Instances:     copyStates(m.states[Instance]),
+		StackServices: copyStates(m.stackServices),
+	}
+}
+
+// Restore adds the states of a snapshot, the states tracked already are overwritten.
+func (m *Machine) Restore(s Snapshot) {
+	for kind, states := range map[Kind]map[string]State{Stack: s.Stacks, Service: s.Services, Instance: s.Instances} {
+		for id, state := range states {
+			m.states[kind][id] = state
+		}
+	}
+	for id, state := range s.StackServices {
+		m.stackServices[id] = state
+	}
+}
+
+func copyStates(states map[string]State) map[string]State {
+	result := make(map[string]State, len(states))
+	for id, s := range states {
+		result[id] = s
+	}
+	return result
+}
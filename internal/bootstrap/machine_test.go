@@ -0,0 +1,517 @@
+package bootstrap
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recorder collects the outcomes of a machine by resource id.
+type recorder map[string][]Outcome
+
+func newRecordedMachine() (*Machine, recorder) {
+	outcomes := recorder{}
+	m := NewMachine()
+	m.SetCallback(func(outcome Outcome, e Event) {
+		outcomes[e.ID] = append(outcomes[e.ID], outcome)
+	})
+	return m, outcomes
+}
+
+// parseTransitions parses the notation of the comments, e.g. "stopping(healthy) -> starting() -> running(healthy)".
+func parseTransitions(t *testing.T, transitions string) [][2]string {
+	var result [][2]string
+	for _, transition := range strings.Split(transitions, "->") {
+		transition = strings.TrimSpace(transition)
+		open := strings.Index(transition, "(")
+		if open < 0 || !strings.HasSuffix(transition, ")") {
+			t.Fatalf("invalid transition %q", transition)
+		}
+		result = append(result, [2]string{transition[:open], transition[open+1 : len(transition)-1]})
+	}
+	return result
+}
+
+func handleAll(t *testing.T, m *Machine, kind Kind, id, parentID, transitions string) {
+	for _, transition := range parseTransitions(t, transitions) {
+		m.Handle(Event{Kind: kind, ID: id, ParentID: parentID, State: transition[0], HealthState: transition[1]})
+	}
+}
+
+// lane is the transitions of an instance in a scenario, an upgrade or a rollback has the lanes of the old and the new instances.
+type lane struct {
+	suffix      string
+	transitions string
+	want        []Outcome
+	// the state left tracked after the lane, nil if the instance is not tracked
+	tracked *State
+}
+
+type scenario struct {
+	name string
+	// the changed resources, the whole stack or the first service, or only the first instance
+	scope string
+
+	stack     map[string]string
+	service   map[string]string
+	instances map[string][]lane
+}
+
+const (
+	scopeStack     = "stack"
+	scopeService   = "service"
+	scopeContainer = "container"
+)
+
+var (
+	counted   = []Outcome{Counted, Succeeded}
+	unchanged []Outcome
+
+	stopped = InstanceStopped
+)
+
+func sameForAll(transitions string) map[string]string {
+	return map[string]string{"1x1": transitions, "1x2": transitions, "2x2": transitions}
+}
+
+func sameLanesForAll(lanes ...lane) map[string][]lane {
+	return map[string][]lane{"1x1": lanes, "1x2": lanes, "2x2": lanes}
+}
+
+// scenarios are the transitions listed in the comments of the transition tables.
+var scenarios = []scenario{
+	{
+		name:      "create",
+		scope:     scopeStack,
+		stack:     sameForAll("active(initializing) -> active(healthy)"),
+		service:   sameForAll("activating(healthy) -> active(healthy)"),
+		instances: sameLanesForAll(lane{transitions: "starting() -> running(healthy)", want: counted}),
+	},
+	{
+		name:    "restart container",
+		scope:   scopeContainer,
+		stack:   sameForAll("active(initializing) -> active(healthy)"),
+		service: sameForAll("active(initializing) -> active(healthy)"),
+		instances: sameLanesForAll(lane{
+			transitions: "stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)",
+			want:        counted,
+		}),
+	},
+	{
+		name:    "stop container",
+		scope:   scopeContainer,
+		stack:   sameForAll("active(initializing) -> active(healthy)"),
+		service: sameForAll("active(initializing) -> active(healthy)"),
+		instances: sameLanesForAll(lane{
+			transitions: "stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)",
+			want:        counted,
+		}),
+	},
+	{
+		name:  "restart service",
+		scope: scopeService,
+		stack: sameForAll("active(initializing) -> active(healthy)"),
+		service: map[string]string{
+			"1x1": "restarting(initializing) -> active(healthy)",
+			"1x2": "restarting(degraded) -> restarting(initializing) -> active(healthy)",
+			"2x2": "restarting(degraded) -> restarting(initializing) -> active(healthy)",
+		},
+		instances: map[string][]lane{
+			"1x1": {{transitions: "stopping(healthy) -> stopped(healthy) -> running(reinitializing) -> running(healthy)", want: counted}},
+			"1x2": {{transitions: "stopping(healthy) -> stopped(healthy) -> running(reinitializing) -> running(healthy)", want: counted}},
+			"2x2": {{transitions: "stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)", want: counted}},
+		},
+	},
+	{
+		name:    "stop service",
+		scope:   scopeService,
+		stack:   sameForAll("active(initializing) -> active(healthy)"),
+		service: sameForAll("active(initializing) -> active(healthy)"),
+		instances: map[string][]lane{
+			"1x1": {{transitions: "stopping(healthy) -> stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)", want: counted}},
+			"1x2": {{transitions: "stopping(healthy) -> stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)", want: counted}},
+			"2x2": {{transitions: "stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)", want: counted}},
+		},
+	},
+	{
+		name:    "stop stack",
+		scope:   scopeStack,
+		stack:   sameForAll("active(initializing) -> active(healthy)"),
+		service: sameForAll("active(initializing) -> active(healthy)"),
+		instances: sameLanesForAll(lane{
+			transitions: "stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)",
+			want:        counted,
+		}),
+	},
+	{
+		name:  "upgrade service",
+		scope: scopeService,
+		stack: map[string]string{
+			"1x1": "active(initializing) -> active(healthy)",
+			"1x2": "active(unhealthy) -> active(initializing) -> active(initializing) -> active(healthy)",
+			"2x2": "active(unhealthy) -> active(initializing) -> active(initializing) -> active(healthy)",
+		},
+		service: map[string]string{
+			"1x1": "upgrading(initializing) -> upgraded(healthy)",
+			"1x2": "upgrading(degraded) -> upgraded(healthy)",
+			"2x2": "upgrading(degraded) -> upgraded(healthy)",
+		},
+		instances: sameLanesForAll(
+			// the old instance is stopped for the rollback, it stays tracked until it is removed or timed out
+			lane{transitions: "stopping(healthy) -> stopped(healthy)", want: unchanged, tracked: &stopped},
+			lane{suffix: "-new", transitions: "starting() -> running(initializing) -> running(healthy)", want: counted},
+		),
+	},
+	{
+		name:    "rollback service",
+		scope:   scopeService,
+		stack:   sameForAll("active(initializing) -> active(healthy)"),
+		service: sameForAll("active(initializing) -> active(healthy)"),
+		instances: sameLanesForAll(
+			lane{suffix: "-new", transitions: "stopping(healthy) -> stopped(healthy) -> removed(healthy)", want: unchanged},
+			lane{transitions: "running(updating-reinitializing) -> running(reinitializing) -> running(healthy)", want: counted},
+		),
+	},
+}
+
+// topologies are the services of a stack with their instances.
+var topologies = []struct {
+	name     string
+	services map[string][]string
+}{
+	{"1x1", map[string][]string{"1s1": {"1i1"}}},
+	{"1x2", map[string][]string{"1s1": {"1i1", "1i2"}}},
+	{"2x2", map[string][]string{"1s1": {"1i1", "1i2"}, "1s2": {"1i3", "1i4"}}},
+}
+
+func lastTransition(transitions string) (string, string) {
+	i := strings.LastIndex(transitions, "->")
+	if i < 0 {
+		return "", transitions
+	}
+	return strings.TrimSpace(transitions[:i]), strings.TrimSpace(transitions[i+2:])
+}
+
+// TestScenarios replays every scenario on every topology, the stack and the services start their bootstraps first,
+// then the instances bootstrap, and the services and the stack finish last, as Rancher reports them.
+func TestScenarios(t *testing.T) {
+	const stackID = "1st1"
+
+	for _, s := range scenarios {
+		for _, topology := range topologies {
+			t.Run(fmt.Sprintf("%s/%s", s.name, topology.name), func(t *testing.T) {
+				m, outcomes := newRecordedMachine()
+				want := recorder{}
+
+				services := []string{"1s1"}
+				if s.scope == scopeStack {
+					services = services[:0]
+					for id := range topology.services {
+						services = append(services, id)
+					}
+				}
+
+				stackFirst, stackLast := lastTransition(s.stack[topology.name])
+				serviceFirst, serviceLast := lastTransition(s.service[topology.name])
+
+				if len(stackFirst) != 0 {
+					handleAll(t, m, Stack, stackID, "", stackFirst)
+				}
+				for _, service := range services {
+					if len(serviceFirst) != 0 {
+						handleAll(t, m, Service, service, stackID, serviceFirst)
+					}
+				}
+
+				wantTracked := map[string]State{}
+				for _, service := range services {
+					instances := topology.services[service]
+					if s.scope == scopeContainer {
+						instances = instances[:1]
+					}
+					for _, instance := range instances {
+						for _, l := range s.instances[topology.name] {
+							handleAll(t, m, Instance, instance+l.suffix, service, l.transitions)
+							if len(l.want) != 0 {
+								want[instance+l.suffix] = l.want
+							}
+							if l.tracked != nil {
+								wantTracked[instance+l.suffix] = *l.tracked
+							}
+						}
+					}
+				}
+
+				for _, service := range services {
+					handleAll(t, m, Service, service, stackID, serviceLast)
+					want[service] = counted
+				}
+				handleAll(t, m, Stack, stackID, "", stackLast)
+				want[stackID] = counted
+
+				if !reflect.DeepEqual(outcomes, want) {
+					t.Errorf("outcomes = %v, want %v", outcomes, want)
+				}
+
+				if m.Len(Stack) != 0 || m.Len(Service) != 0 {
+					t.Errorf("%d stacks and %d services are still tracked", m.Len(Stack), m.Len(Service))
+				}
+				if m.Len(Instance) != len(wantTracked) {
+					t.Errorf("%v instances are tracked, want %v", m.IDs(Instance), wantTracked)
+				}
+				for id, state := range wantTracked {
+					if got, ok := m.State(Instance, id); !ok || got != state {
+						t.Errorf("state of instance %s = %v, %v, want %v", id, got, ok, state)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// the events handled before the event
+		before []Event
+		event  Event
+		want   []Outcome
+		// the state after the event, nil if the resource is not tracked
+		state *State
+	}{
+		{
+			name: "stack error fails the tracked stack",
+			before: []Event{
+				{Kind: Stack, ID: "1st1", State: "active", HealthState: "initializing"},
+			},
+			event: Event{Kind: Stack, ID: "1st1", State: "error", HealthState: "unhealthy"},
+			want:  []Outcome{Counted, Failed},
+		},
+		{
+			name:  "stack error of an untracked stack is ignored",
+			event: Event{Kind: Stack, ID: "1st1", State: "error", HealthState: "unhealthy"},
+		},
+		{
+			name: "stack removed while initializing fails",
+			before: []Event{
+				{Kind: Stack, ID: "1st1", State: "active", HealthState: "initializing"},
+			},
+			event: Event{Kind: Stack, ID: "1st1", State: "removed", HealthState: "initializing"},
+			want:  []Outcome{Counted, Failed},
+		},
+		{
+			name: "stack removed while unhealthy is forgotten",
+			before: []Event{
+				{Kind: Stack, ID: "1st1", State: "active", HealthState: "unhealthy"},
+			},
+			event: Event{Kind: Stack, ID: "1st1", State: "removed", HealthState: "unhealthy"},
+		},
+		{
+			name: "stack unhealthy while initializing keeps the bootstrap",
+			before: []Event{
+				{Kind: Stack, ID: "1st1", State: "active", HealthState: "initializing"},
+			},
+			event: Event{Kind: Stack, ID: "1st1", State: "active", HealthState: "unhealthy"},
+			want:  []Outcome{Counted},
+			state: statePtr(StackActiveInitializing),
+		},
+		{
+			name: "stack success waits for its restarting service",
+			before: []Event{
+				{Kind: Stack, ID: "1st1", State: "active", HealthState: "initializing"},
+				{Kind: Service, ID: "1s1", ParentID: "1st1", State: "restarting", HealthState: "initializing"},
+			},
+			event: Event{Kind: Stack, ID: "1st1", State: "active", HealthState: "healthy"},
+			want:  []Outcome{Counted},
+			state: statePtr(StackActiveInitializing),
+		},
+		{
+			name: "stack success waits for its upgrading service",
+			before: []Event{
+				{Kind: Stack, ID: "1st1", State: "active", HealthState: "initializing"},
+				{Kind: Service, ID: "1s1", ParentID: "1st1", State: "upgrading", HealthState: "degraded"},
+			},
+			event: Event{Kind: Stack, ID: "1st1", State: "active", HealthState: "healthy"},
+			want:  []Outcome{Counted},
+			state: statePtr(StackActiveInitializing),
+		},
+		{
+			name: "stack succeeds once its service is active",
+			before: []Event{
+				{Kind: Stack, ID: "1st1", State: "active", HealthState: "initializing"},
+				{Kind: Service, ID: "1s1", ParentID: "1st1", State: "restarting", HealthState: "initializing"},
+				{Kind: Service, ID: "1s1", ParentID: "1st1", State: "active", HealthState: "initializing"},
+			},
+			event: Event{Kind: Stack, ID: "1st1", State: "active", HealthState: "healthy"},
+			want:  []Outcome{Counted, Succeeded},
+		},
+		{
+			name: "service unhealthy fails",
+			before: []Event{
+				{Kind: Service, ID: "1s1", ParentID: "1st1", State: "active", HealthState: "initializing"},
+			},
+			event: Event{Kind: Service, ID: "1s1", ParentID: "1st1", State: "active", HealthState: "unhealthy"},
+			want:  []Outcome{Counted, Failed},
+		},
+		{
+			name: "service upgraded unhealthy fails",
+			before: []Event{
+				{Kind: Service, ID: "1s1", ParentID: "1st1", State: "upgrading", HealthState: "initializing"},
+			},
+			event: Event{Kind: Service, ID: "1s1", ParentID: "1st1", State: "upgraded", HealthState: "unhealthy"},
+			want:  []Outcome{Counted, Failed},
+		},
+		{
+			name: "service upgrading is not finished by active",
+			before: []Event{
+				{Kind: Service, ID: "1s1", ParentID: "1st1", State: "upgrading", HealthState: "initializing"},
+			},
+			event: Event{Kind: Service, ID: "1s1", ParentID: "1st1", State: "active", HealthState: "healthy"},
+			want:  []Outcome{Counted},
+			state: statePtr(ServiceUpgrading),
+		},
+		{
+			name: "service deactivated is forgotten",
+			before: []Event{
+				{Kind: Service, ID: "1s1", ParentID: "1st1", State: "active", HealthState: "initializing"},
+			},
+			event: Event{Kind: Service, ID: "1s1", ParentID: "1st1", State: "inactive", HealthState: "initializing"},
+			want:  []Outcome{Counted},
+		},
+		{
+			name: "service removed while initializing fails",
+			before: []Event{
+				{Kind: Service, ID: "1s1", ParentID: "1st1", State: "activating", HealthState: "healthy"},
+			},
+			event: Event{Kind: Service, ID: "1s1", ParentID: "1st1", State: "removed", HealthState: "initializing"},
+			want:  []Outcome{Counted, Failed},
+		},
+		{
+			name: "service removed while healthy is forgotten",
+			before: []Event{
+				{Kind: Service, ID: "1s1", ParentID: "1st1", State: "activating", HealthState: "healthy"},
+			},
+			event: Event{Kind: Service, ID: "1s1", ParentID: "1st1", State: "removed", HealthState: "healthy"},
+			want:  []Outcome{Counted},
+		},
+		{
+			name:  "instance error fails even if untracked",
+			event: Event{Kind: Instance, ID: "1i1", State: "error"},
+			want:  []Outcome{Failed},
+		},
+		{
+			name: "instance unhealthy fails",
+			before: []Event{
+				{Kind: Instance, ID: "1i1", State: "starting"},
+			},
+			event: Event{Kind: Instance, ID: "1i1", State: "running", HealthState: "unhealthy"},
+			want:  []Outcome{Counted, Failed},
+		},
+		{
+			name: "instance starting without health state keeps stopping",
+			before: []Event{
+				{Kind: Instance, ID: "1i1", State: "stopping", HealthState: "healthy"},
+			},
+			event: Event{Kind: Instance, ID: "1i1", State: "starting"},
+			state: statePtr(InstanceStopping),
+		},
+		{
+			name: "instance removed while initializing fails",
+			before: []Event{
+				{Kind: Instance, ID: "1i1", State: "starting"},
+			},
+			event: Event{Kind: Instance, ID: "1i1", State: "removed", HealthState: "initializing"},
+			want:  []Outcome{Counted, Failed},
+		},
+		{
+			name:  "instance running healthy without a bootstrap is ignored",
+			event: Event{Kind: Instance, ID: "1i1", State: "running", HealthState: "healthy"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m, outcomes := newRecordedMachine()
+			for _, e := range c.before {
+				m.Handle(e)
+			}
+			m.Handle(c.event)
+
+			if got := outcomes[c.event.ID]; !reflect.DeepEqual(got, c.want) {
+				t.Errorf("outcomes = %v, want %v", got, c.want)
+			}
+
+			state, tracked := m.State(c.event.Kind, c.event.ID)
+			switch {
+			case c.state == nil && tracked:
+				t.Errorf("%s is tracked in %v", c.event.ID, state)
+			case c.state != nil && (!tracked || state != *c.state):
+				t.Errorf("state = %v, %v, want %v", state, tracked, *c.state)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	m, outcomes := newRecordedMachine()
+	m.Handle(Event{Kind: Service, ID: "1s1", ParentID: "1st1", State: "restarting", HealthState: "initializing"})
+
+	if kind, ok := m.Lookup("1s1"); !ok || kind != Service {
+		t.Fatalf("Lookup(1s1) = %v, %v", kind, ok)
+	}
+	m.Timeout(Event{Kind: Service, ID: "1s1"})
+	m.Timeout(Event{Kind: Service, ID: "1s1"})
+
+	if want := []Outcome{Counted, TimedOut}; !reflect.DeepEqual(outcomes["1s1"], want) {
+		t.Errorf("outcomes = %v, want %v", outcomes["1s1"], want)
+	}
+	if _, ok := m.Lookup("1s1"); ok {
+		t.Error("1s1 is still tracked after the timeout")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	m, _ := newRecordedMachine()
+	m.Handle(Event{Kind: Stack, ID: "1st1", State: "active", HealthState: "initializing"})
+	m.Handle(Event{Kind: Service, ID: "1s1", ParentID: "1st1", State: "upgrading", HealthState: "degraded"})
+	m.Handle(Event{Kind: Instance, ID: "1i1", State: "stopped", HealthState: "healthy"})
+
+	restored, outcomes := newRecordedMachine()
+	restored.Restore(m.Snapshot())
+	if !reflect.DeepEqual(restored.Snapshot(), m.Snapshot()) {
+		t.Fatalf("restored %+v, want %+v", restored.Snapshot(), m.Snapshot())
+	}
+
+	// the restored stack still waits for its upgrading service
+	restored.Handle(Event{Kind: Stack, ID: "1st1", State: "active", HealthState: "healthy"})
+	restored.Handle(Event{Kind: Service, ID: "1s1", ParentID: "1st1", State: "upgraded", HealthState: "healthy"})
+	restored.Handle(Event{Kind: Stack, ID: "1st1", State: "active", HealthState: "healthy"})
+
+	want := recorder{"1st1": {Succeeded}, "1s1": {Succeeded}}
+	if !reflect.DeepEqual(outcomes, want) {
+		t.Errorf("outcomes = %v, want %v", outcomes, want)
+	}
+}
+
+// TestStateValues pins the values persisted in the state files.
+func TestStateValues(t *testing.T) {
+	for state, want := range map[State]uint64{
+		StackActiveInitializing:       0,
+		StackActiveUnhealthy:          1,
+		ServiceActivatingHealthy:      2,
+		ServiceActiveInitializing:     3,
+		ServiceRestarting:             4,
+		ServiceUpgrading:              5,
+		InstanceStarting:              6,
+		InstanceStopping:              7,
+		InstanceStopped:               8,
+		InstanceRunningReinitializing: 9,
+	} {
+		if uint64(state) != want {
+			t.Errorf("state %d is persisted as %d", state, want)
+		}
+	}
+}
+
+func statePtr(s State) *State {
+	return &s
+}
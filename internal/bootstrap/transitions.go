@@ -0,0 +1,238 @@
+package bootstrap
+
+const (
+	// AnyHealthState matches the events of any health state, including none
+	AnyHealthState = "*"
+	// SomeHealthState matches the events of any health state but none
+	SomeHealthState = "+"
+)
+
+// Match is the tracking condition of a transition.
+type Match int
+
+const (
+	// Untracked matches the resources which are not tracked
+	Untracked Match = iota
+	// Tracked matches the tracked resources in the From states, or in any state if From is empty
+	Tracked
+	// Any matches the resources whether they are tracked or not
+	Any
+)
+
+// Transition is a row of the transition tables, the first row matching an event is applied.
+type Transition struct {
+	State       string
+	HealthState string
+	Match       Match
+	From        []State
+	// the stack transition is skipped while a service of the stack is in one of these states
+	UnlessStackServices []State
+
+	// Track sets the state of the resource to To
+	Track bool
+	To    State
+	// Outcome is reported to the callback, the finishing outcomes forget the resource
+	Outcome Outcome
+	Forget  bool
+}
+
+// StackServiceMark records a service state in the stack of the service, or clears it.
+type StackServiceMark struct {
+	ServiceState string
+	Mark         State
+	Clear        bool
+}
+
+// StackServiceMarks hold the success of a stack while a service in it is restarting or upgrading,
+// as the stack of 1 stack n services n instances turns healthy before its services.
+var StackServiceMarks = []StackServiceMark{
+	{ServiceState: "restarting", Mark: ServiceRestarting},
+	{ServiceState: "upgrading", Mark: ServiceUpgrading},
+	{ServiceState: "active", Mark: ServiceRestarting, Clear: true},
+	{ServiceState: "upgraded", Mark: ServiceUpgrading, Clear: true},
+}
+
+// StackTransitions are observed on
+//
+// stack 1 service with 1 container with hc
+// create:              active(initializing) -> active(healthy)
+// restart container:   active(initializing) -> active(healthy)
+// stop container:      active(initializing) -> active(healthy)
+// restart service:     active(initializing) -> active(healthy)
+// stop service:        active(initializing) -> active(healthy)
+// stop stack           active(initializing) -> active(healthy)
+// upgrade service:     active(initializing) -> active(healthy)
+// rollback service:    active(initializing) -> active(healthy)
+//
+// stack add 1 service with 2 container with hc
+// restart container:   active(initializing) -> active(healthy)
+// stop container:      active(initializing) -> active(healthy)
+// restart service:     active(initializing) -> active(healthy)
+// stop service:        active(initializing) -> active(healthy)
+// stop stack:          active(initializing) -> active(healthy)
+// upgrade service:     { active(unhealthy) -> active(initializing) }-> active(initializing) -> active(healthy)
+// rollback service:    active(initializing) -> active(healthy)
+//
+// stack add 2 service with 2 container with hc
+// restart container:   active(initializing) -> active(healthy)
+// stop container:      active(initializing) -> active(healthy)
+// restart service:     active(initializing) -> active(healthy)
+// stop service:        active(initializing) -> active(healthy)
+// stop stack:          active(initializing) -> active(healthy)
+// upgrade service:     { active(unhealthy) -> active(initializing) }-> active(initializing) -> active(healthy)
+// rollback service:    active(initializing) -> active(healthy)
+var StackTransitions = []Transition{
+	{State: "active", HealthState: "healthy", Match: Tracked, From: []State{StackActiveInitializing},
+		UnlessStackServices: []State{ServiceRestarting, ServiceUpgrading}, Outcome: Succeeded},
+	{State: "active", HealthState: "initializing", Match: Untracked, Track: true, To: StackActiveInitializing, Outcome: Counted},
+	{State: "active", HealthState: "initializing", Match: Tracked, From: []State{StackActiveUnhealthy}, Forget: true},
+	{State: "active", HealthState: "unhealthy", Match: Untracked, Track: true, To: StackActiveUnhealthy},
+	{State: "active", HealthState: "unhealthy", Match: Tracked, From: []State{StackActiveUnhealthy}, Forget: true},
+	{State: "error", HealthState: AnyHealthState, Match: Tracked, Outcome: Failed},
+	{State: "removed", HealthState: AnyHealthState, Match: Tracked, From: []State{StackActiveInitializing}, Outcome: Failed},
+	{State: "removed", HealthState: AnyHealthState, Match: Any, Forget: true},
+}
+
+// ServiceTransitions are observed on
+//
+// stack 1 service with 1 container with hc
+// create:              activating(healthy) -> active(healthy)
+// restart container:   active(initializing) -> active(healthy)
+// stop container:      active(initializing) -> active(healthy)
+// restart service:     restarting(initializing) -> active(healthy)
+// stop service:        active(initializing) -> active(healthy)
+// stop stack:          active(initializing) -> active(healthy)
+// upgrade service:     upgrading(initializing) -> upgraded(healthy)
+// rollback service:    active(initializing) -> active(healthy)
+//
+// stack add 1 service with 2 container with hc
+// restart container:   active(initializing) -> active(healthy)
+// stop container:      active(initializing) -> active(healthy)
+// restart service:     restarting(degraded) -> restarting(initializing) -> active(healthy)
+// stop service:        active(initializing) -> active(healthy)
+// stop stack:          active(initializing) -> active(healthy)
+// upgrade service:     upgrading(degraded) -> upgraded(healthy)
+// rollback service:    active(initializing) -> active(healthy)
+//
+// stack add 2 service with 2 container with hc
+// restart container:   active(initializing) -> active(healthy)
+// stop container:      active(initializing) -> active(healthy)
+// restart service:     restarting(degraded) -> restarting(initializing) -> active(healthy)
+// stop service:        active(initializing) -> active(healthy)
+// stop stack:          active(initializing) -> active(healthy)
+// upgrade service:     upgrading(degraded) -> upgraded(healthy)
+// rollback service:    active(initializing) -> active(healthy)
+var ServiceTransitions = []Transition{
+	{State: "activating", HealthState: "healthy", Match: Untracked, Track: true, To: ServiceActivatingHealthy, Outcome: Counted},
+	{State: "active", HealthState: "healthy", Match: Tracked,
+		From: []State{ServiceActivatingHealthy, ServiceActiveInitializing, ServiceRestarting}, Outcome: Succeeded},
+	{State: "active", HealthState: "initializing", Match: Untracked, Track: true, To: ServiceActiveInitializing, Outcome: Counted},
+	{State: "active", HealthState: "unhealthy", Match: Tracked, Outcome: Failed},
+	{State: "upgraded", HealthState: "healthy", Match: Tracked, From: []State{ServiceUpgrading}, Outcome: Succeeded},
+	{State: "upgraded", HealthState: "unhealthy", Match: Tracked, Outcome: Failed},
+	{State: "upgrading", HealthState: "initializing", Match: Untracked, Track: true, To: ServiceUpgrading, Outcome: Counted},
+	{State: "upgrading", HealthState: "degraded", Match: Untracked, Track: true, To: ServiceUpgrading, Outcome: Counted},
+	{State: "restarting", HealthState: "initializing", Match: Untracked, Track: true, To: ServiceRestarting, Outcome: Counted},
+	{State: "restarting", HealthState: "degraded", Match: Untracked, Track: true, To: ServiceRestarting, Outcome: Counted},
+	{State: "inactive", HealthState: AnyHealthState, Match: Any, Forget: true},
+	{State: "removed", HealthState: "initializing", Match: Tracked, Outcome: Failed},
+	{State: "removed", HealthState: AnyHealthState, Match: Any, Forget: true},
+}
+
+// InstanceTransitions are observed on
+//
+// stack add 1 service with 1 container with hc
+// create service:      starting() -> running(healthy)
+// restart container:   stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// stop container:      stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// restart service:     stopping(healthy) -> stopped(healthy) -> running(reinitializing) -> running(healthy)
+// stop service:        stopping(healthy) -> stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// stop stack:          stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// upgrade service:     old: stopping(healthy) -> stopped(healthy) | new: starting() -> running(initializing) -> running(healthy)
+// rollback service:    new: stopping(healthy) -> stopped(healthy) -> removed(healthy) | old: running(updating-reinitializing) -> running(reinitializing) -> running(healthy)
+//
+// stack add 1 service with 2 container with hc
+// restart container:   stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// stop container:      stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// restart service:     stopping(healthy) -> stopped(healthy) -> running(reinitializing) -> running(healthy)
+// stop service:        stopping(healthy) -> stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// stop stack:          stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// upgrade service:     old: stopping(healthy) -> stopped(healthy) | new: starting() -> running(initializing) -> running(healthy)
+// rollback service:    new: stopping(healthy) -> stopped(healthy) -> removed(healthy) | old: running(updating-reinitializing) -> running(reinitializing) -> running(healthy)
+//
+// stack add 2 service with 2 container with hc
+// restart container:   stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// stop container:      stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// restart service:     stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// stop service:        stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// stop stack:          stopped(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy)
+// upgrade service:     old: stopping(healthy) -> stopped(healthy) | new: starting() -> running(initializing) -> running(healthy)
+// rollback service:    new: stopping(healthy) -> stopped(healthy) -> removed(healthy) | old: running(updating-reinitializing) -> running(reinitializing) -> running(healthy)
+var InstanceTransitions = []Transition{
+	{State: "starting", HealthState: AnyHealthState, Match: Untracked, Track: true, To: InstanceStarting, Outcome: Counted},
+	{State: "starting", HealthState: SomeHealthState, Match: Tracked, From: []State{InstanceStopping, InstanceStopped}, Track: true, To: InstanceStarting},
+	{State: "stopping", HealthState: "healthy", Match: Untracked, Track: true, To: InstanceStopping},
+	{State: "stopped", HealthState: "healthy", Match: Untracked, Track: true, To: InstanceStopped},
+	{State: "stopped", HealthState: "healthy", Match: Tracked, From: []State{InstanceStopping}, Track: true, To: InstanceStopped},
+	{State: "running", HealthState: "healthy", Match: Tracked, From: []State{InstanceStarting, InstanceRunningReinitializing}, Outcome: Succeeded},
+	{State: "running", HealthState: "reinitializing", Match: Tracked, From: []State{InstanceStopping, InstanceStopped, InstanceStarting},
+		Track: true, To: InstanceRunningReinitializing, Outcome: Counted},
+	{State: "running", HealthState: "updating-reinitializing", Match: Untracked, Track: true, To: InstanceRunningReinitializing, Outcome: Counted},
+	{State: "running", HealthState: "unhealthy", Match: Tracked, Outcome: Failed},
+	{State: "error", HealthState: AnyHealthState, Match: Any, Outcome: Failed},
+	{State: "removed", HealthState: "initializing", Match: Tracked, Outcome: Failed},
+	{State: "removed", HealthState: AnyHealthState, Match: Any, Forget: true},
+}
+
+// Transitions are the transition tables of the kinds.
+var Transitions = map[Kind][]Transition{
+	Stack:    StackTransitions,
+	Service:  ServiceTransitions,
+	Instance: InstanceTransitions,
+}
+
+func (t Transition) matches(e Event, current State, tracked bool, stackServices map[string]State) bool {
+	if t.State != e.State {
+		return false
+	}
+	switch t.HealthState {
+	case AnyHealthState:
+	case SomeHealthState:
+		if len(e.HealthState) == 0 {
+			return false
+		}
+	default:
+		if t.HealthState != e.HealthState {
+			return false
+		}
+	}
+
+	switch t.Match {
+	case Untracked:
+		if tracked {
+			return false
+		}
+	case Tracked:
+		if !tracked || (len(t.From) != 0 && !containsState(t.From, current)) {
+			return false
+		}
+	}
+
+	if mark, ok := stackServices[e.ID]; ok && containsState(t.UnlessStackServices, mark) {
+		return false
+	}
+	return true
+}
+
+func (o Outcome) finishes() bool {
+	return o == Succeeded || o == Failed || o == TimedOut
+}
+
+func containsState(states []State, state State) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
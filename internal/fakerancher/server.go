@@ -0,0 +1,350 @@
+// Package fakerancher is a stand-in of the Rancher 1.6 API server for the offline tests,
+// it serves the projects, the paginated collections of the projects and the resource.change events of /subscribe.
+package fakerancher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// the collections of a project, which are named as the base types of their resources
+var collections = map[string]string{
+	"hosts":     "host",
+	"stacks":    "stack",
+	"services":  "service",
+	"instances": "instance",
+}
+
+// Project is an environment of the fake server, the resources are the raw JSON of Rancher,
+// e.g. {"id":"1st1","name":"web","state":"active","healthState":"healthy"}.
+type Project struct {
+	ID    string
+	Name  string
+	State string
+
+	Hosts     []string
+	Stacks    []string
+	Services  []string
+	Instances []string
+
+	// the resources played as resource.change events to every subscription of the project, in order
+	Events []string
+}
+
+// Server is the fake Rancher server, the clients must authenticate with the access key and the secret key.
+type Server struct {
+	*httptest.Server
+
+	AccessKey string
+	SecretKey string
+	// PageSize caps the limit of the collections, which paginates the collections with pagination.next
+	PageSize int
+
+	mutex    *sync.Mutex
+	projects []*Project
+	// project id -> collection -> resources
+	resources map[string]map[string][]json.RawMessage
+	// project id -> the connected subscriptions
+	subscribers map[string][]*websocket.Conn
+	requests    []string
+}
+
+// NewServer starts a fake server of the projects, it is closed by Close.
+func NewServer(accessKey, secretKey string, projects ...*Project) *Server {
+	s := &Server{
+		AccessKey:   accessKey,
+		SecretKey:   secretKey,
+		mutex:       &sync.Mutex{},
+		projects:    projects,
+		resources:   make(map[string]map[string][]json.RawMessage),
+		subscribers: make(map[string][]*websocket.Conn),
+	}
+
+	for _, p := range projects {
+		s.resources[p.ID] = map[string][]json.RawMessage{
+			"hosts":     rawMessages(p.Hosts),
+			"stacks":    rawMessages(p.Stacks),
+			"services":  rawMessages(p.Services),
+			"instances": rawMessages(p.Instances),
+		}
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close closes the subscriptions and the server.
+func (s *Server) Close() {
+	s.mutex.Lock()
+	for _, conns := range s.subscribers {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	s.subscribers = make(map[string][]*websocket.Conn)
+	s.mutex.Unlock()
+
+	s.Server.Close()
+}
+
+// Subscribers returns the number of the connected subscriptions of the project.
+func (s *Server) Subscribers(projectID string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.subscribers[projectID])
+}
+
+// Requests returns the paths and the queries of the served requests, in order.
+func (s *Server) Requests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Publish stores the resource into its collection and sends it as a resource.change event to the subscriptions of the project.
+func (s *Server) Publish(projectID, resource string) error {
+	var meta struct {
+		ID       string `json:"id"`
+		BaseType string `json:"baseType"`
+	}
+	if err := json.Unmarshal([]byte(resource), &meta); err != nil {
+		return err
+	}
+
+	collection := ""
+	for c, baseType := range collections {
+		if baseType == meta.BaseType {
+			collection = c
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if resources, ok := s.resources[projectID]; ok && len(collection) != 0 {
+		resources[collection] = upsert(resources[collection], meta.ID, json.RawMessage(resource))
+	}
+
+	event := resourceChange(meta.BaseType, resource)
+	for _, conn := range s.subscribers[projectID] {
+		if err := conn.WriteMessage(websocket.TextMessage, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.requests = append(s.requests, r.URL.RequestURI())
+	s.mutex.Unlock()
+
+	if ak, sk, ok := r.BasicAuth(); !ok || ak != s.AccessKey || sk != s.SecretKey {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Enter API access key and secret key as username and password"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"type": "error", "status": 401, "code": "Unauthorized"})
+		return
+	}
+
+	// v2-beta/projects[/<id>[/<collection>[/<resource id>]]]
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) < 2 || segments[0] != "v2-beta" || segments[1] != "projects" {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"type": "error", "status": 404, "code": "NotFound"})
+		return
+	}
+
+	switch len(segments) {
+	case 2:
+		s.serveProjects(w)
+	case 4:
+		if segments[3] == "subscribe" {
+			s.serveSubscribe(w, r, segments[2])
+			return
+		}
+		s.serveCollection(w, r, segments[2], segments[3])
+	case 5:
+		s.serveResource(w, segments[2], segments[3], segments[4])
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"type": "error", "status": 404, "code": "NotFound"})
+	}
+}
+
+func (s *Server) serveProjects(w http.ResponseWriter) {
+	var data []json.RawMessage
+	for _, p := range s.projects {
+		state := p.State
+		if len(state) == 0 {
+			state = "active"
+		}
+		project, _ := json.Marshal(map[string]string{"id": p.ID, "name": p.Name, "state": state, "type": "project"})
+		data = append(data, project)
+	}
+	writeJSON(w, http.StatusOK, collection("project", data, nil))
+}
+
+// serveCollection paginates the collection by the limit and the marker, which is the offset of the next page.
+func (s *Server) serveCollection(w http.ResponseWriter, r *http.Request, projectID, name string) {
+	s.mutex.Lock()
+	resources, ok := s.resources[projectID][name]
+	resources = append([]json.RawMessage(nil), resources...)
+	s.mutex.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"type": "error", "status": 404, "code": "NotFound"})
+		return
+	}
+
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 || (s.PageSize > 0 && limit > s.PageSize) {
+		limit = s.PageSize
+	}
+	offset, _ := strconv.Atoi(query.Get("marker"))
+	if offset > len(resources) {
+		offset = len(resources)
+	}
+
+	page := resources[offset:]
+	var pagination map[string]interface{}
+	if limit > 0 && len(page) > limit {
+		page = page[:limit]
+
+		next := url.Values{}
+		for k, v := range query {
+			next[k] = v
+		}
+		next.Set("marker", strconv.Itoa(offset+limit))
+		pagination = map[string]interface{}{
+			"limit": limit,
+			"next":  fmt.Sprintf("%s%s?%s", s.URL, r.URL.Path, next.Encode()),
+		}
+	}
+	writeJSON(w, http.StatusOK, collection(collections[name], page, pagination))
+}
+
+func (s *Server) serveResource(w http.ResponseWriter, projectID, name, id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, resource := range s.resources[projectID][name] {
+		var meta struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(resource, &meta); err == nil && meta.ID == id {
+			writeJSON(w, http.StatusOK, resource)
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]interface{}{"type": "error", "status": 404, "code": "NotFound"})
+}
+
+// serveSubscribe plays the events of the project, then keeps the subscription for Publish until the client closes it.
+func (s *Server) serveSubscribe(w http.ResponseWriter, r *http.Request, projectID string) {
+	var project *Project
+	for _, p := range s.projects {
+		if p.ID == projectID {
+			project = p
+		}
+	}
+	if project == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"type": "error", "status": 404, "code": "NotFound"})
+		return
+	}
+
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	for _, resource := range project.Events {
+		var meta struct {
+			BaseType string `json:"baseType"`
+		}
+		_ = json.Unmarshal([]byte(resource), &meta)
+		if err := conn.WriteMessage(websocket.TextMessage, resourceChange(meta.BaseType, resource)); err != nil {
+			s.mutex.Unlock()
+			_ = conn.Close()
+			return
+		}
+	}
+	s.subscribers[projectID] = append(s.subscribers[projectID], conn)
+	s.mutex.Unlock()
+
+	// the client never sends anything but the control frames, which are handled while reading
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	s.mutex.Lock()
+	conns := s.subscribers[projectID]
+	for i, c := range conns {
+		if c == conn {
+			s.subscribers[projectID] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	s.mutex.Unlock()
+	_ = conn.Close()
+}
+
+func resourceChange(baseType, resource string) []byte {
+	event, _ := json.Marshal(map[string]interface{}{
+		"name":         "resource.change",
+		"resourceType": baseType,
+		"data": map[string]interface{}{
+			"resource": json.RawMessage(resource),
+		},
+	})
+	return event
+}
+
+func collection(resourceType string, data []json.RawMessage, pagination map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		data = []json.RawMessage{}
+	}
+	result := map[string]interface{}{
+		"type":         "collection",
+		"resourceType": resourceType,
+		"data":         data,
+	}
+	if pagination != nil {
+		result["pagination"] = pagination
+	}
+	return result
+}
+
+func upsert(resources []json.RawMessage, id string, resource json.RawMessage) []json.RawMessage {
+	for i, r := range resources {
+		var meta struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(r, &meta); err == nil && meta.ID == id {
+			resources[i] = resource
+			return resources
+		}
+	}
+	return append(resources, resource)
+}
+
+func rawMessages(resources []string) []json.RawMessage {
+	result := make([]json.RawMessage, 0, len(resources))
+	for _, resource := range resources {
+		result = append(result, json.RawMessage(resource))
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
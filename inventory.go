@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/buger/jsonparser"
+)
+
+// inventory keeps the latest representation of the hosts, stacks, services and instances of a project,
+// it is seeded by listing the collections once and then kept current from the resource.change events.
+type inventory struct {
+	mutex *sync.RWMutex
+
+	// collection subpath -> id -> resource
+	resources map[string]map[string][]byte
+}
+
+var inventoryCollections = map[string]string{
+	"host":     hostSubpath,
+	"stack":    stackSubpath,
+	"service":  serviceSubpath,
+	"instance": instanceSubpath,
+}
+
+func newInventory() *inventory {
+	return &inventory{
+		mutex:     &sync.RWMutex{},
+		resources: newInventoryResources(),
+	}
+}
+
+func newInventoryResources() map[string]map[string][]byte {
+	resources := make(map[string]map[string][]byte, len(inventoryCollections))
+	for _, collection := range inventoryCollections {
+		resources[collection] = make(map[string][]byte)
+	}
+	return resources
+}
+
+// storeEvent applies the resource of a resource.change event, the resources which are not kept are ignored.
+func (i *inventory) storeEvent(baseType string, resourceBytes []byte) {
+	collection, ok := inventoryCollections[baseType]
+	if !ok {
+		return
+	}
+
+	id, _ := jsonparser.GetString(resourceBytes, "id")
+	if len(id) == 0 {
+		return
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if isInventoryResource(resourceBytes) {
+		i.resources[collection][id] = resourceBytes
+	} else {
+		delete(i.resources[collection], id)
+	}
+}
+
+// replace swaps in the result of a full listing of the collection and returns the resources no longer listed,
+// an event received while listing may be overwritten until the next event of that resource.
+func (i *inventory) replace(collection string, resources map[string][]byte) [][]byte {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	var removed [][]byte
+	for id, data := range i.resources[collection] {
+		if _, ok := resources[id]; !ok {
+			removed = append(removed, data)
+		}
+	}
+	i.resources[collection] = resources
+	return removed
+}
+
+func (i *inventory) foreach(collection string, handler func(data []byte)) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	for _, data := range i.resources[collection] {
+		handler(data)
+	}
+}
+
+func (i *inventory) get(collection, id string) ([]byte, bool) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	data, ok := i.resources[collection][id]
+	return data, ok
+}
+
+func isInventoryResource(resourceBytes []byte) bool {
+	state, _ := jsonparser.GetString(resourceBytes, "state")
+	switch state {
+	case "removed", "purging", "purged":
+		return false
+	}
+
+	if hideSys {
+		if system, _ := jsonparser.GetBoolean(resourceBytes, "system"); system {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// the mapped labels are only exported on the *_labels metrics
+	labelsModeInfo = "info"
+	// the mapped labels are also exported on every gauge of the resource, the counters, the histograms and the in-flight gauges
+	// of the events are not labeled, as they outlive the labels of the resources and are aggregated across the resources
+	labelsModeSeries = "series"
+)
+
+var (
+	labelNameRegexp       = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	labelNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+	// reservedLabelNames are the label names of the exporter, a mapped label must not shadow them,
+	// including the ones of the series which are not labeled, which are joined with the *_labels metrics.
+	reservedLabelNames = []string{
+		"environment_id", "environment_name", "id", "name", "stack_id", "stack_name", "service_id", "service_name",
+		"state", "health_state", "system", "type", "host", "host_id", "image", "docker_version", "kernel_version",
+		"operating_system", "period", "mount", "interface", "outcome", "le",
+		"agent_state", "old_image", "new_image", "collector", "path", "code",
+	}
+
+	// mapped labels of each resource type, parsed by initResourceMetrics
+	hostLabels     resourceLabels
+	stackLabels    resourceLabels
+	serviceLabels  resourceLabels
+	instanceLabels resourceLabels
+)
+
+// resourceLabel maps a Rancher label of a resource to a Prometheus label.
+type resourceLabel struct {
+	key  string
+	name string
+}
+
+type resourceLabels []resourceLabel
+
+// parseResourceLabels parses the comma-separated resource labels, e.g. "io.rancher.host.region=region,team",
+// a label without the Prometheus name is exported as label_ with the invalid characters replaced by '_'.
+func parseResourceLabels(labels string) (resourceLabels, error) {
+	names := make(map[string]bool)
+	for _, name := range reservedLabelNames {
+		names[name] = true
+	}
+
+	var result resourceLabels
+	for _, label := range strings.Split(labels, ",") {
+		if label = strings.TrimSpace(label); len(label) == 0 {
+			continue
+		}
+
+		key, name := label, ""
+		if i := strings.Index(label, "="); i >= 0 {
+			key, name = strings.TrimSpace(label[:i]), strings.TrimSpace(label[i+1:])
+		} else {
+			name = "label_" + labelNameInvalidChars.ReplaceAllString(key, "_")
+		}
+
+		if len(key) == 0 {
+			return nil, fmt.Errorf("empty label in %q", label)
+		}
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q of label %q", name, key)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate label name %q of label %q", name, key)
+		}
+		names[name] = true
+
+		result = append(result, resourceLabel{key: key, name: name})
+	}
+	return result, nil
+}
+
+func (l resourceLabels) names() []string {
+	result := make([]string, 0, len(l))
+	for _, label := range l {
+		result = append(result, label.name)
+	}
+	return result
+}
+
+func (l resourceLabels) values(resourceBytes []byte) []string {
+	result := make([]string, 0, len(l))
+	for _, label := range l {
+		value, _ := jsonparser.GetString(resourceBytes, "labels", label.key)
+		result = append(result, value)
+	}
+	return result
+}
+
+// series appends the mapped label names to the label names of a series of the resource in the series mode.
+func (l resourceLabels) series(labelNames ...string) []string {
+	if labelsMode == labelsModeSeries {
+		labelNames = append(labelNames, l.names()...)
+	}
+	return labelNames
+}
+
+// curry returns the mapped label values of the resource to curry the vectors created with series,
+// which is empty out of the series mode.
+func (l resourceLabels) curry(resourceBytes []byte) prometheus.Labels {
+	result := prometheus.Labels{}
+	if labelsMode == labelsModeSeries {
+		for i, value := range l.values(resourceBytes) {
+			result[l[i].name] = value
+		}
+	}
+	return result
+}
+
+// seriesValues appends the mapped label values to the label values of a const series of the resource in the series mode.
+func (l resourceLabels) seriesValues(resourceBytes []byte, labelValues ...string) []string {
+	if labelsMode == labelsModeSeries {
+		labelValues = append(labelValues, l.values(resourceBytes)...)
+	}
+	return labelValues
+}
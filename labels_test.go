@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseResourceLabels(t *testing.T) {
+	for _, c := range []struct {
+		labels string
+		want   resourceLabels
+		err    bool
+	}{
+		{labels: "", want: nil},
+		{labels: "team, cost-center=cost_center", want: resourceLabels{{key: "team", name: "label_team"}, {key: "cost-center", name: "cost_center"}}},
+		{labels: "io.rancher.host.region", want: resourceLabels{{key: "io.rancher.host.region", name: "label_io_rancher_host_region"}}},
+		{labels: "team=1team", err: true},
+		{labels: "team=__team", err: true},
+		{labels: "team=owner,group=owner", err: true},
+		{labels: "=team", err: true},
+		// the labels of the series which are never labeled are reserved as well, so they can be joined
+		{labels: "io.rancher.image=old_image", err: true},
+		{labels: "io.rancher.agent=agent_state", err: true},
+		{labels: "io.rancher.stack.name=stack_name", err: true},
+	} {
+		got, err := parseResourceLabels(c.labels)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q is parsed as %v, want an error", c.labels, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q is not parsed, %v", c.labels, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q is parsed as %v, want %v", c.labels, got, c.want)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -22,6 +26,67 @@ var (
 	cattleSecretKey string
 	hideSys         bool
 	timeout         time.Duration
+	resyncInterval  time.Duration
+
+	cattleCAFile             string
+	cattleCertFile           string
+	cattleKeyFile            string
+	cattleServerName         string
+	cattleInsecureSkipVerify bool
+	cattleProxyURL           string
+
+	websocketPingInterval     time.Duration
+	websocketMaxBackoff       time.Duration
+	websocketReconnectTimeout time.Duration
+
+	stateFilePath         string
+	stateSnapshotInterval time.Duration
+
+	stackBootstrapBuckets    string
+	serviceBootstrapBuckets  string
+	instanceBootstrapBuckets string
+
+	stackBootstrapTimeout    time.Duration
+	serviceBootstrapTimeout  time.Duration
+	instanceBootstrapTimeout time.Duration
+
+	healthFlapWindow    time.Duration
+	healthFlapThreshold int
+
+	hostLabelMapping      string
+	stackLabelMapping     string
+	serviceLabelMapping   string
+	instanceLabelMapping  string
+	labelsMode            string
+	containerStatsEnabled bool
+
+	includeEnvironments string
+	excludeEnvironments string
+
+	includeStacks        string
+	excludeStacks        string
+	includeServices      string
+	excludeServices      string
+	includeStackLabels   string
+	excludeStackLabels   string
+	includeServiceLabels string
+	excludeServiceLabels string
+
+	webTLSCertFile     string
+	webTLSKeyFile      string
+	webTLSClientCAFile string
+	webAuthUsername    string
+	webAuthPassword    string
+	webAuthBearerToken string
+	webAuthPaths       string
+
+	shutdownGracePeriod time.Duration
+
+	staleSeriesRetention time.Duration
+
+	aggregationMode string
+
+	recordFilePath string
 )
 
 func main() {
@@ -38,6 +103,11 @@ func main() {
 	app.Action = appAction
 
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   configFileFlag,
+			Usage:  "The YAML or JSON file of the options, which are named as the flags, the flags set explicitly override the file",
+			EnvVar: "CONFIG_FILE",
+		},
 		cli.StringFlag{
 			Name:        "listen_address",
 			Usage:       "The address of scraping the metrics",
@@ -70,11 +140,159 @@ func main() {
 			EnvVar:      "CATTLE_SECRET_KEY",
 			Destination: &cattleSecretKey,
 		},
+		cli.StringFlag{
+			Name:        "cattle_ca_file",
+			Usage:       "The PEM bundle of the CAs verifying Rancher Server, the system CAs are used if empty",
+			EnvVar:      "CATTLE_CA_FILE",
+			Destination: &cattleCAFile,
+		},
+		cli.StringFlag{
+			Name:        "cattle_cert_file",
+			Usage:       "The PEM client certificate for Rancher Server with mutual TLS",
+			EnvVar:      "CATTLE_CERT_FILE",
+			Destination: &cattleCertFile,
+		},
+		cli.StringFlag{
+			Name:        "cattle_key_file",
+			Usage:       "The PEM client key for Rancher Server with mutual TLS",
+			EnvVar:      "CATTLE_KEY_FILE",
+			Destination: &cattleKeyFile,
+		},
+		cli.StringFlag{
+			Name:        "cattle_server_name",
+			Usage:       "The server name verified in the certificate of Rancher Server, the host of cattle_url is verified if empty",
+			EnvVar:      "CATTLE_SERVER_NAME",
+			Destination: &cattleServerName,
+		},
+		cli.BoolFlag{
+			Name:        "cattle_insecure_skip_verify",
+			Usage:       "Skip verifying the certificate of Rancher Server, which is insecure",
+			EnvVar:      "CATTLE_INSECURE_SKIP_VERIFY",
+			Destination: &cattleInsecureSkipVerify,
+		},
+		cli.StringFlag{
+			Name:        "cattle_proxy_url",
+			Usage:       "The proxy of Rancher Server API and websockets, e.g. http://proxy:3128, HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used if empty",
+			EnvVar:      "CATTLE_PROXY_URL",
+			Destination: &cattleProxyURL,
+		},
 		cli.DurationFlag{
 			Name:        "http_timeout",
 			Value:       30 * time.Second,
 			Destination: &timeout,
 		},
+		cli.DurationFlag{
+			Name:        "resync_interval",
+			Usage:       "The interval of listing all resources again besides the websocket events, 0 disables the resync",
+			EnvVar:      "RESYNC_INTERVAL",
+			Value:       5 * time.Minute,
+			Destination: &resyncInterval,
+		},
+		cli.DurationFlag{
+			Name:        "websocket_ping_interval",
+			Usage:       "The interval of pinging the websocket, the connection is recreated if nothing is received in twice the interval, 0 disables the keepalive",
+			EnvVar:      "WEBSOCKET_PING_INTERVAL",
+			Value:       30 * time.Second,
+			Destination: &websocketPingInterval,
+		},
+		cli.DurationFlag{
+			Name:        "websocket_max_backoff",
+			Usage:       "The maximum delay between the websocket reconnections, at least 1s",
+			EnvVar:      "WEBSOCKET_MAX_BACKOFF",
+			Value:       time.Minute,
+			Destination: &websocketMaxBackoff,
+		},
+		cli.DurationFlag{
+			Name:        "websocket_reconnect_timeout",
+			Usage:       "The websocket is reported as an error and retried every websocket_max_backoff once it cannot be reconnected in the duration, 0 always backs off",
+			EnvVar:      "WEBSOCKET_RECONNECT_TIMEOUT",
+			Destination: &websocketReconnectTimeout,
+		},
+		cli.StringFlag{
+			Name:        "state_file",
+			Usage:       "The file of persisting the bootstrap counters and the in-flight bootstraps across restarts, e.g. /data/state.json",
+			EnvVar:      "STATE_FILE",
+			Destination: &stateFilePath,
+		},
+		cli.DurationFlag{
+			Name:        "state_snapshot_interval",
+			Usage:       "The interval of writing the state file",
+			EnvVar:      "STATE_SNAPSHOT_INTERVAL",
+			Value:       time.Minute,
+			Destination: &stateSnapshotInterval,
+		},
+		cli.StringFlag{
+			Name:        "record_file",
+			Usage:       "The JSONL file of appending the websocket messages with their timestamps, which can be replayed by the replay command",
+			EnvVar:      "RECORD_FILE",
+			Destination: &recordFilePath,
+		},
+		cli.StringFlag{
+			Name:        "aggregation_mode",
+			Usage:       "Export the aggregates of the bootstrap counters as the __rancher__ series (sentinel), as the *_environment_total, *_stack_total and *_service_total families (families), or not at all (none)",
+			Value:       aggregationModeSentinel,
+			EnvVar:      "AGGREGATION_MODE",
+			Destination: &aggregationMode,
+		},
+		cli.DurationFlag{
+			Name:        "stale_series_retention",
+			Usage:       "The duration of keeping the accumulated series of the removed hosts, stacks, services and instances, 0 keeps them forever",
+			EnvVar:      "STALE_SERIES_RETENTION",
+			Destination: &staleSeriesRetention,
+		},
+		cli.StringFlag{
+			Name:        "stack_bootstrap_buckets",
+			Usage:       "Comma-separated seconds of the buckets of the stack bootstrap duration histogram",
+			EnvVar:      "STACK_BOOTSTRAP_BUCKETS",
+			Value:       "10,30,60,120,300,600,1200,1800,3600",
+			Destination: &stackBootstrapBuckets,
+		},
+		cli.StringFlag{
+			Name:        "service_bootstrap_buckets",
+			Usage:       "Comma-separated seconds of the buckets of the service bootstrap duration histogram",
+			EnvVar:      "SERVICE_BOOTSTRAP_BUCKETS",
+			Value:       "5,10,30,60,120,300,600,1200,1800",
+			Destination: &serviceBootstrapBuckets,
+		},
+		cli.StringFlag{
+			Name:        "instance_bootstrap_buckets",
+			Usage:       "Comma-separated seconds of the buckets of the instance bootstrap duration histogram",
+			EnvVar:      "INSTANCE_BOOTSTRAP_BUCKETS",
+			Value:       "1,5,10,30,60,120,300,600",
+			Destination: &instanceBootstrapBuckets,
+		},
+		cli.DurationFlag{
+			Name:        "stack_bootstrap_timeout",
+			Usage:       "The bootstrap stacks which are not healthy and active in the duration are counted as timeout, 0 disables the timeout",
+			EnvVar:      "STACK_BOOTSTRAP_TIMEOUT",
+			Destination: &stackBootstrapTimeout,
+		},
+		cli.DurationFlag{
+			Name:        "service_bootstrap_timeout",
+			Usage:       "The bootstrap services which are not healthy and active in the duration are counted as timeout, 0 disables the timeout",
+			EnvVar:      "SERVICE_BOOTSTRAP_TIMEOUT",
+			Destination: &serviceBootstrapTimeout,
+		},
+		cli.DurationFlag{
+			Name:        "instance_bootstrap_timeout",
+			Usage:       "The bootstrap instances which are not healthy and running in the duration are counted as timeout, 0 disables the timeout",
+			EnvVar:      "INSTANCE_BOOTSTRAP_TIMEOUT",
+			Destination: &instanceBootstrapTimeout,
+		},
+		cli.DurationFlag{
+			Name:        "health_flap_window",
+			Usage:       "The window of counting the health state transitions of a service or an instance for detecting the flapping",
+			EnvVar:      "HEALTH_FLAP_WINDOW",
+			Value:       10 * time.Minute,
+			Destination: &healthFlapWindow,
+		},
+		cli.IntFlag{
+			Name:        "health_flap_threshold",
+			Usage:       "A service or an instance is flapping with at least the health state transitions in health_flap_window, 0 disables the flapping",
+			EnvVar:      "HEALTH_FLAP_THRESHOLD",
+			Value:       4,
+			Destination: &healthFlapThreshold,
+		},
 		cli.StringFlag{
 			Name:   "log_level",
 			Usage:  "Set the logging level",
@@ -87,6 +305,161 @@ func main() {
 			EnvVar:      "HIDE_SYS",
 			Destination: &hideSys,
 		},
+		cli.StringFlag{
+			Name:        "host_labels",
+			Usage:       "Comma-separated labels of hosts to export, a label is renamed by label=name, e.g. io.rancher.host.region=region",
+			EnvVar:      "HOST_LABELS",
+			Destination: &hostLabelMapping,
+		},
+		cli.StringFlag{
+			Name:        "stack_labels",
+			Usage:       "Comma-separated labels of stacks to export, a label is renamed by label=name, e.g. team,cost-center=cost_center",
+			EnvVar:      "STACK_LABELS",
+			Destination: &stackLabelMapping,
+		},
+		cli.StringFlag{
+			Name:        "service_labels",
+			Usage:       "Comma-separated labels of services to export, a label is renamed by label=name, e.g. team,cost-center=cost_center",
+			EnvVar:      "SERVICE_LABELS",
+			Destination: &serviceLabelMapping,
+		},
+		cli.StringFlag{
+			Name:        "instance_labels",
+			Usage:       "Comma-separated labels of instances to export, a label is renamed by label=name, e.g. io.rancher.scheduler.affinity=affinity",
+			EnvVar:      "INSTANCE_LABELS",
+			Destination: &instanceLabelMapping,
+		},
+		cli.StringFlag{
+			Name:        "labels_mode",
+			Usage:       "Export the mapped labels only on the rancher_*_labels metrics (info) or also on every gauge of the resource (series)",
+			EnvVar:      "LABELS_MODE",
+			Value:       labelsModeInfo,
+			Destination: &labelsMode,
+		},
+		cli.BoolFlag{
+			Name:        "container_stats",
+			Usage:       "Export the cpu, memory, network and block io of instances from the container stats of hosts",
+			EnvVar:      "CONTAINER_STATS",
+			Destination: &containerStatsEnabled,
+		},
+		cli.StringFlag{
+			Name:        "include_environments",
+			Usage:       "Comma-separated names of the environments to export, all visible environments are exported if empty",
+			EnvVar:      "INCLUDE_ENVIRONMENTS",
+			Destination: &includeEnvironments,
+		},
+		cli.StringFlag{
+			Name:        "exclude_environments",
+			Usage:       "Comma-separated names of the environments not to export",
+			EnvVar:      "EXCLUDE_ENVIRONMENTS",
+			Destination: &excludeEnvironments,
+		},
+		cli.StringFlag{
+			Name:        "include_stacks",
+			Usage:       "The regex of the names of the stacks to export, e.g. 'web|db-.*'",
+			EnvVar:      "INCLUDE_STACKS",
+			Destination: &includeStacks,
+		},
+		cli.StringFlag{
+			Name:        "exclude_stacks",
+			Usage:       "The regex of the names of the stacks not to export, e.g. 'ci-.*'",
+			EnvVar:      "EXCLUDE_STACKS",
+			Destination: &excludeStacks,
+		},
+		cli.StringFlag{
+			Name:        "include_services",
+			Usage:       "The regex of the names of the services to export",
+			EnvVar:      "INCLUDE_SERVICES",
+			Destination: &includeServices,
+		},
+		cli.StringFlag{
+			Name:        "exclude_services",
+			Usage:       "The regex of the names of the services not to export",
+			EnvVar:      "EXCLUDE_SERVICES",
+			Destination: &excludeServices,
+		},
+		cli.StringFlag{
+			Name:        "include_stack_labels",
+			Usage:       "Comma-separated label=regex selectors which the stacks to export must all match, a label without regex must exist, e.g. team=infra|web",
+			EnvVar:      "INCLUDE_STACK_LABELS",
+			Destination: &includeStackLabels,
+		},
+		cli.StringFlag{
+			Name:        "exclude_stack_labels",
+			Usage:       "Comma-separated label=regex selectors, the stacks matching any of them are not exported, e.g. ci.temporary",
+			EnvVar:      "EXCLUDE_STACK_LABELS",
+			Destination: &excludeStackLabels,
+		},
+		cli.StringFlag{
+			Name:        "include_service_labels",
+			Usage:       "Comma-separated label=regex selectors which the services to export must all match, a label without regex must exist",
+			EnvVar:      "INCLUDE_SERVICE_LABELS",
+			Destination: &includeServiceLabels,
+		},
+		cli.StringFlag{
+			Name:        "exclude_service_labels",
+			Usage:       "Comma-separated label=regex selectors, the services matching any of them are not exported",
+			EnvVar:      "EXCLUDE_SERVICE_LABELS",
+			Destination: &excludeServiceLabels,
+		},
+		cli.StringFlag{
+			Name:        "web_tls_cert_file",
+			Usage:       "The PEM certificate of serving the metrics over HTTPS",
+			EnvVar:      "WEB_TLS_CERT_FILE",
+			Destination: &webTLSCertFile,
+		},
+		cli.StringFlag{
+			Name:        "web_tls_key_file",
+			Usage:       "The PEM key of serving the metrics over HTTPS",
+			EnvVar:      "WEB_TLS_KEY_FILE",
+			Destination: &webTLSKeyFile,
+		},
+		cli.StringFlag{
+			Name:        "web_tls_client_ca_file",
+			Usage:       "The PEM bundle of the CAs verifying the client certificates, which are required if set",
+			EnvVar:      "WEB_TLS_CLIENT_CA_FILE",
+			Destination: &webTLSClientCAFile,
+		},
+		cli.StringFlag{
+			Name:        "web_auth_username",
+			Usage:       "The username of the basic auth of the protected paths",
+			EnvVar:      "WEB_AUTH_USERNAME",
+			Destination: &webAuthUsername,
+		},
+		cli.StringFlag{
+			Name:        "web_auth_password",
+			Usage:       "The password of the basic auth of the protected paths",
+			EnvVar:      "WEB_AUTH_PASSWORD",
+			Destination: &webAuthPassword,
+		},
+		cli.StringFlag{
+			Name:        "web_auth_bearer_token",
+			Usage:       "The bearer token of the protected paths, either the token or the basic auth is accepted if both are set",
+			EnvVar:      "WEB_AUTH_BEARER_TOKEN",
+			Destination: &webAuthBearerToken,
+		},
+		cli.StringFlag{
+			Name:        "web_auth_paths",
+			Usage:       "Comma-separated paths protected by the authentication, a path ending with '/' protects the paths under it, metric_path is protected if empty",
+			EnvVar:      "WEB_AUTH_PATHS",
+			Destination: &webAuthPaths,
+		},
+		cli.DurationFlag{
+			Name:        "shutdown_grace_period",
+			Usage:       "The duration of draining the buffered events and saving the state file on SIGTERM or SIGINT",
+			Value:       30 * time.Second,
+			EnvVar:      "SHUTDOWN_GRACE_PERIOD",
+			Destination: &shutdownGracePeriod,
+		},
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:      "replay",
+			Usage:     "Replay a record file through the bootstrap state machine offline and print the counters",
+			ArgsUsage: "<record file>",
+			Action:    replayAction,
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -95,22 +468,14 @@ func main() {
 }
 
 func appAction(c *cli.Context) {
-	stopChan := make(chan interface{}, 1)
-	defer close(stopChan)
+	// load config file
+	cf := newConfigFile(c)
+	if err := cf.load(); err != nil {
+		panic(err)
+	}
 
 	// set logger
-	switch c.String("log_level") {
-	case "debug":
-		logger.SetLevel(logger.DebugLevel)
-	case "warn":
-		logger.SetLevel(logger.WarnLevel)
-	case "fatal":
-		logger.SetLevel(logger.FatalLevel)
-	case "panic":
-		logger.SetLevel(logger.PanicLevel)
-	default:
-		logger.SetLevel(logger.InfoLevel)
-	}
+	setLogLevel(c.String("log_level"))
 
 	// cattle url
 	if cattleURL == "" {
@@ -126,25 +491,98 @@ func appAction(c *cli.Context) {
 	logger.Infoln("Starting rancher_exporter", version.Info(), ", with cattle URL: ", cattleURL, ", access key: ", cattleAccessKey, ", system services hidden: ", hideSys)
 	logger.Infoln("Build context", version.BuildContext())
 
-	re := newRancherExporter()
+	if err := initBootstrapHistograms(); err != nil {
+		panic(err)
+	}
+	if err := initResourceMetrics(); err != nil {
+		panic(err)
+	}
+	if err := initResourceFilter(); err != nil {
+		panic(err)
+	}
+	if err := initAggregationMode(); err != nil {
+		panic(err)
+	}
+	if err := initWebsocketBackoff(); err != nil {
+		panic(err)
+	}
 
-	// register exporter
-	prometheus.MustRegister(re)
+	// register exporter, which is served once the environments are initialized
+	er := newExporterRegistry()
 	prometheus.MustRegister(version.NewCollector("rancher_exporter"))
 
-	// start web
+	// start web before initializing the environments, which are reported by /readyz
 	logger.Infoln("Listening on", listenAddress)
-	http.Handle(metricPath, promhttp.Handler())
+	http.HandleFunc("/healthz", exporterReadiness.healthzHandler)
+	http.HandleFunc("/readyz", exporterReadiness.readyzHandler)
+	http.Handle(metricPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, er}, promhttp.HandlerOpts{}),
+	))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
              <head><title>Rancher 1.6 Exporter</title></head>
              <body>
              <h1>Rancher 1.6 Exporter</h1>
              <p><a href='` + metricPath + `'>Metrics</a></p>
+             <p><a href='/healthz'>Health</a></p>
+             <p><a href='/readyz'>Readiness</a></p>
              </body>
              </html>`))
 	})
-	logger.Fatal(http.ListenAndServe(listenAddress, nil))
+	server, err := newWebServer(http.DefaultServeMux)
+	if err != nil {
+		panic(err)
+	}
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		panic(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serveWeb(server, listener)
+	}()
 
-	re.Stop()
+	re := newRancherExporter()
+	if err := er.reset(re); err != nil {
+		panic(err)
+	}
+
+	go cf.watch(re, er)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-serveErr:
+		logger.Fatal(err)
+	case sig := <-signals:
+		logger.Infof("shutting down on %v in %v", sig, shutdownGracePeriod)
+	}
+
+	// stop accepting scrapes, then drain the events of the closed websockets
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warnf("failed to shut down the web, %v", err)
+	}
+	if err := re.Stop(ctx); err != nil {
+		logger.Warnf("failed to save state file %s, %v", stateFilePath, err)
+	}
+	logger.Infoln("Stopped rancher_exporter")
+}
+
+func setLogLevel(level string) {
+	switch level {
+	case "debug":
+		logger.SetLevel(logger.DebugLevel)
+	case "warn":
+		logger.SetLevel(logger.WarnLevel)
+	case "fatal":
+		logger.SetLevel(logger.FatalLevel)
+	case "panic":
+		logger.SetLevel(logger.PanicLevel)
+	default:
+		logger.SetLevel(logger.InfoLevel)
+	}
 }
@@ -1,195 +1,692 @@
 package main
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The metrics of the resources are created by initResourceMetrics,
+// as the mapped labels of the resources are appended to their label names in the series mode.
 var (
 	// health & state of host, stack, service
-	infinityWorksHostsState = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "host_state",
-			Help:      "State of defined host as reported by the Rancher API",
-		}, []string{"id", "name", "state"})
-
-	infinityWorksHostAgentsState = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "host_agent_state",
-			Help:      "State of defined host agent as reported by the Rancher API",
-		}, []string{"id", "name", "state"})
-
-	infinityWorksStacksHealth = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "stack_health_status",
-			Help:      "HealthState of defined stack as reported by Rancher",
-		}, []string{"id", "name", "health_state", "system"})
-
-	infinityWorksStacksState = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "stack_state",
-			Help:      "State of defined stack as reported by Rancher",
-		}, []string{"id", "name", "state", "system"})
+	infinityWorksHostsState      *prometheus.GaugeVec
+	infinityWorksHostAgentsState *prometheus.GaugeVec
+	infinityWorksStacksHealth    *prometheus.GaugeVec
+	infinityWorksStacksState     *prometheus.GaugeVec
+	infinityWorksServicesScale   *prometheus.GaugeVec
+	infinityWorksServicesHealth  *prometheus.GaugeVec
+	infinityWorksServicesState   *prometheus.GaugeVec
+
+	// resource of host
+	hostMemoryTotal     *prometheus.GaugeVec
+	hostMemoryAvailable *prometheus.GaugeVec
+	hostCPUCount        *prometheus.GaugeVec
+	hostLoadAverage     *prometheus.GaugeVec
+	hostFilesystemSize  *prometheus.GaugeVec
+	hostFilesystemUsed  *prometheus.GaugeVec
+	hostInfo            *prometheus.GaugeVec
+
+	// health & state of instance
+	instancesState      *prometheus.GaugeVec
+	instancesHealth     *prometheus.GaugeVec
+	instancesStartCount *prometheus.GaugeVec
+	instancesExitCode   *prometheus.GaugeVec
+	instancesInfo       *prometheus.GaugeVec
+
+	// resource of instance, exported from the container stats streams
+	instanceCPUUsage        *prometheus.Desc
+	instanceMemoryUsage     *prometheus.Desc
+	instanceMemoryLimit     *prometheus.Desc
+	instanceNetworkReceive  *prometheus.Desc
+	instanceNetworkTransmit *prometheus.Desc
+	instanceBlkioRead       *prometheus.Desc
+	instanceBlkioWrite      *prometheus.Desc
 
-	infinityWorksServicesScale = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "service_scale",
-			Help:      "scale of defined service as reported by Rancher",
-		}, []string{"name", "stack_name", "system"})
-
-	infinityWorksServicesHealth = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "service_health_status",
-			Help:      "HealthState of the service, as reported by the Rancher API",
-		}, []string{"id", "stack_id", "name", "stack_name", "health_state", "system"})
-
-	infinityWorksServicesState = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "service_state",
-			Help:      "State of the service, as reported by the Rancher API",
-		}, []string{"id", "stack_id", "name", "stack_name", "state", "system"})
+	// heartbeat
+	extendingStackHeartbeat    *prometheus.GaugeVec
+	extendingServiceHeartbeat  *prometheus.GaugeVec
+	extendingInstanceHeartbeat *prometheus.GaugeVec
+
+	// mapped labels
+	hostLabelsInfo     *prometheus.GaugeVec
+	stackLabelsInfo    *prometheus.GaugeVec
+	serviceLabelsInfo  *prometheus.GaugeVec
+	instanceLabelsInfo *prometheus.GaugeVec
+)
 
+var (
 	/**
 	Extended
 	*/
 
 	// total counter of stack, service, instance
 
-	extendingTotalStackInitializations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalStackInitializations = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "stacks_initialization_total",
 		Help:      "Current total number of the initialization stacks in Rancher",
-	}, []string{"environment_name", "name"})
+	}, []string{"environment_id", "environment_name", "name"})
 
-	extendingTotalSuccessStackInitialization = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalSuccessStackInitialization = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "stacks_initialization_success_total",
 		Help:      "Current total number of the healthy and active initialization stacks in Rancher",
-	}, []string{"environment_name", "name"})
+	}, []string{"environment_id", "environment_name", "name"})
 
-	extendingTotalErrorStackInitialization = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalErrorStackInitialization = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "stacks_initialization_error_total",
 		Help:      "Current total number of the unhealthy or error initialization stacks in Rancher",
-	}, []string{"environment_name", "name"})
+	}, []string{"environment_id", "environment_name", "name"})
 
-	extendingTotalServiceInitializations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalServiceInitializations = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "services_initialization_total",
 		Help:      "Current total number of the initialization services in Rancher",
-	}, []string{"environment_name", "stack_name", "name"})
+	}, []string{"environment_id", "environment_name", "stack_name", "name"})
 
-	extendingTotalSuccessServiceInitialization = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalSuccessServiceInitialization = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "services_initialization_success_total",
 		Help:      "Current total number of the healthy and active initialization services in Rancher",
-	}, []string{"environment_name", "stack_name", "name"})
+	}, []string{"environment_id", "environment_name", "stack_name", "name"})
 
-	extendingTotalErrorServiceInitialization = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalErrorServiceInitialization = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "services_initialization_error_total",
 		Help:      "Current total number of the unhealthy or error initialization services in Rancher",
-	}, []string{"environment_name", "stack_name", "name"})
+	}, []string{"environment_id", "environment_name", "stack_name", "name"})
 
-	extendingTotalInstanceInitializations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalInstanceInitializations = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "instances_initialization_total",
 		Help:      "Current total number of the initialization instances in Rancher",
-	}, []string{"environment_name", "stack_name", "service_name", "name"})
+	}, []string{"environment_id", "environment_name", "stack_name", "service_name", "name"})
 
-	extendingTotalSuccessInstanceInitialization = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalSuccessInstanceInitialization = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "instances_initialization_success_total",
 		Help:      "Current total number of the healthy and active initialization instances in Rancher",
-	}, []string{"environment_name", "stack_name", "service_name", "name"})
+	}, []string{"environment_id", "environment_name", "stack_name", "service_name", "name"})
 
-	extendingTotalErrorInstanceInitialization = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalErrorInstanceInitialization = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "instances_initialization_error_total",
 		Help:      "Current total number of the unhealthy or error initialization instances in Rancher",
-	}, []string{"environment_name", "stack_name", "service_name", "name"})
+	}, []string{"environment_id", "environment_name", "stack_name", "service_name", "name"})
 
-	extendingTotalStackBootstraps = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalStackBootstraps = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "stacks_bootstrap_total",
 		Help:      "Current total number of the bootstrap stacks in Rancher",
-	}, []string{"environment_name", "name"})
+	}, []string{"environment_id", "environment_name", "name"})
 
-	extendingTotalSuccessStackBootstrap = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalSuccessStackBootstrap = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "stacks_bootstrap_success_total",
 		Help:      "Current total number of the healthy and active bootstrap stacks in Rancher",
-	}, []string{"environment_name", "name"})
+	}, []string{"environment_id", "environment_name", "name"})
 
-	extendingTotalErrorStackBootstrap = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalErrorStackBootstrap = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "stacks_bootstrap_error_total",
 		Help:      "Current total number of the unhealthy or error bootstrap stacks in Rancher",
-	}, []string{"environment_name", "name"})
+	}, []string{"environment_id", "environment_name", "name"})
 
-	extendingTotalServiceBootstraps = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalServiceBootstraps = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "services_bootstrap_total",
 		Help:      "Current total number of the bootstrap services in Rancher",
-	}, []string{"environment_name", "stack_name", "name"})
+	}, []string{"environment_id", "environment_name", "stack_name", "name"})
 
-	extendingTotalSuccessServiceBootstrap = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalSuccessServiceBootstrap = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "services_bootstrap_success_total",
 		Help:      "Current total number of the healthy and active bootstrap services in Rancher",
-	}, []string{"environment_name", "stack_name", "name"})
+	}, []string{"environment_id", "environment_name", "stack_name", "name"})
 
-	extendingTotalErrorServiceBootstrap = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalErrorServiceBootstrap = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "services_bootstrap_error_total",
 		Help:      "Current total number of the unhealthy or error bootstrap services in Rancher",
-	}, []string{"environment_name", "stack_name", "name"})
+	}, []string{"environment_id", "environment_name", "stack_name", "name"})
 
-	extendingTotalInstanceBootstraps = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalInstanceBootstraps = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "instances_bootstrap_total",
 		Help:      "Current total number of the bootstrap instances in Rancher",
-	}, []string{"environment_name", "stack_name", "service_name", "name"})
+	}, []string{"environment_id", "environment_name", "stack_name", "service_name", "name"})
 
-	extendingTotalSuccessInstanceBootstrap = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalSuccessInstanceBootstrap = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "instances_bootstrap_success_total",
 		Help:      "Current total number of the healthy and active bootstrap instances in Rancher",
-	}, []string{"environment_name", "stack_name", "service_name", "name"})
+	}, []string{"environment_id", "environment_name", "stack_name", "service_name", "name"})
 
-	extendingTotalErrorInstanceBootstrap = prometheus.NewCounterVec(prometheus.CounterOpts{
+	extendingTotalErrorInstanceBootstrap = newAggregatedCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "instances_bootstrap_error_total",
 		Help:      "Current total number of the unhealthy or error bootstrap instances in Rancher",
-	}, []string{"environment_name", "stack_name", "service_name", "name"})
+	}, []string{"environment_id", "environment_name", "stack_name", "service_name", "name"})
+
+	extendingTotalTimeoutStackBootstrap = newAggregatedCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stacks_bootstrap_timeout_total",
+		Help:      "Current total number of the bootstrap stacks which are not healthy and active in time in Rancher",
+	}, []string{"environment_id", "environment_name", "name"})
+
+	extendingTotalTimeoutServiceBootstrap = newAggregatedCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "services_bootstrap_timeout_total",
+		Help:      "Current total number of the bootstrap services which are not healthy and active in time in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "name"})
+
+	extendingTotalTimeoutInstanceBootstrap = newAggregatedCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "instances_bootstrap_timeout_total",
+		Help:      "Current total number of the bootstrap instances which are not healthy and active in time in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "service_name", "name"})
+
+	// upgrade counter of service, labeled by the images of the previous and the current launch configs
+	extendingTotalServiceUpgrades = newUnaggregatedCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "services_upgrade_total",
+		Help:      "Current total number of the upgrades started of the services in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "name", "old_image", "new_image"})
+
+	extendingTotalFinishedServiceUpgrade = newUnaggregatedCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "services_upgrade_finished_total",
+		Help:      "Current total number of the upgrades finished of the services in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "name", "old_image", "new_image"})
+
+	extendingTotalRollbackServiceUpgrade = newUnaggregatedCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "services_upgrade_rollback_total",
+		Help:      "Current total number of the upgrades rolled back of the services in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "name", "old_image", "new_image"})
+
+	extendingTotalErrorServiceUpgrade = newUnaggregatedCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "services_upgrade_error_total",
+		Help:      "Current total number of the upgrades canceled, removed or unhealthy of the services in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "name", "old_image", "new_image"})
+
+	// health transition counter of service and instance, labeled by the health state transitioned to
+	extendingTotalServiceHealthTransitions = newUnaggregatedCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "services_health_transitions_total",
+		Help:      "Current total number of the health state transitions of the services in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "name", "health_state"})
+
+	extendingTotalInstanceHealthTransitions = newUnaggregatedCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "instances_health_transitions_total",
+		Help:      "Current total number of the health state transitions of the instances in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "service_name", "name", "health_state"})
+
+	// state timeline counter of stack, service and host, labeled by the state and the health state, or the agent state of host
+	extendingTotalStackStateSeconds = newUnaggregatedCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stacks_state_seconds_total",
+		Help:      "Current total seconds of the stacks in each state and health state in Rancher",
+	}, []string{"environment_id", "environment_name", "name", "state", "health_state"})
+
+	extendingTotalServiceStateSeconds = newUnaggregatedCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "services_state_seconds_total",
+		Help:      "Current total seconds of the services in each state and health state in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "name", "state", "health_state"})
+
+	extendingTotalHostStateSeconds = newUnaggregatedCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hosts_state_seconds_total",
+		Help:      "Current total seconds of the hosts in each state and agent state in Rancher",
+	}, []string{"environment_id", "environment_name", "name", "state", "agent_state"})
+
+	// health timeline gauge
+	extendingServiceHealthStateSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_health_state_seconds",
+		Help:      "The seconds of the service in the current health state in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "name", "health_state"})
+
+	extendingInstanceHealthStateSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_health_state_seconds",
+		Help:      "The seconds of the instance in the current health state in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "service_name", "name", "health_state"})
+
+	extendingServiceHealthFlapping = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_health_flapping",
+		Help:      "Whether the health state of the service is transitioned at least health_flap_threshold times in health_flap_window in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "name"})
+
+	extendingInstanceHealthFlapping = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_health_flapping",
+		Help:      "Whether the health state of the instance is transitioned at least health_flap_threshold times in health_flap_window in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "service_name", "name"})
+
+	// in-flight gauge
+	extendingStackBootstrapInflight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stacks_bootstrap_inflight",
+		Help:      "Current number of the bootstrapping stacks in Rancher",
+	}, []string{"environment_id", "environment_name"})
+
+	extendingServiceBootstrapInflight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "services_bootstrap_inflight",
+		Help:      "Current number of the bootstrapping services in Rancher",
+	}, []string{"environment_id", "environment_name"})
+
+	extendingInstanceBootstrapInflight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instances_bootstrap_inflight",
+		Help:      "Current number of the bootstrapping instances in Rancher",
+	}, []string{"environment_id", "environment_name"})
+
+	extendingStackBootstrapOldest = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stacks_bootstrap_inflight_oldest_seconds",
+		Help:      "The seconds of the longest bootstrapping stack in Rancher",
+	}, []string{"environment_id", "environment_name"})
+
+	extendingServiceBootstrapOldest = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "services_bootstrap_inflight_oldest_seconds",
+		Help:      "The seconds of the longest bootstrapping service in Rancher",
+	}, []string{"environment_id", "environment_name"})
+
+	extendingInstanceBootstrapOldest = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instances_bootstrap_inflight_oldest_seconds",
+		Help:      "The seconds of the longest bootstrapping instance in Rancher",
+	}, []string{"environment_id", "environment_name"})
+
+	extendingServiceUpgradePending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "services_upgrade_pending",
+		Help:      "The upgraded services waiting for finishing or rolling back the upgrade in Rancher",
+	}, []string{"environment_id", "environment_name", "stack_name", "name", "old_image", "new_image"})
 
 	// startup gauge
 	extendingInstanceBootstrapMsCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "instance_bootstrap_ms",
 		Help:      "The bootstrap milliseconds of instances in Rancher",
-	}, []string{"environment_name", "stack_name", "service_name", "name", "system", "type"})
+	}, []string{"environment_id", "environment_name", "stack_name", "service_name", "name", "system", "type"})
+
+	// bootstrap duration, created by initBootstrapHistograms with the configured buckets
+	extendingStackBootstrapDuration    *prometheus.HistogramVec
+	extendingServiceBootstrapDuration  *prometheus.HistogramVec
+	extendingInstanceBootstrapDuration *prometheus.HistogramVec
+)
+
+func initBootstrapHistograms() error {
+	stackBuckets, err := parseBuckets(stackBootstrapBuckets)
+	if err != nil {
+		return fmt.Errorf("invalid stack bootstrap buckets, %v", err)
+	}
+	serviceBuckets, err := parseBuckets(serviceBootstrapBuckets)
+	if err != nil {
+		return fmt.Errorf("invalid service bootstrap buckets, %v", err)
+	}
+	instanceBuckets, err := parseBuckets(instanceBootstrapBuckets)
+	if err != nil {
+		return fmt.Errorf("invalid instance bootstrap buckets, %v", err)
+	}
+
+	extendingStackBootstrapDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stacks_bootstrap_duration_seconds",
+		Help:      "The seconds from the beginning of the bootstrap stacks to the healthy and active or the unhealthy or error in Rancher",
+		Buckets:   stackBuckets,
+	}, []string{"environment_id", "environment_name", "name", "outcome"})
+
+	extendingServiceBootstrapDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "services_bootstrap_duration_seconds",
+		Help:      "The seconds from the beginning of the bootstrap services to the healthy and active or the unhealthy or error in Rancher",
+		Buckets:   serviceBuckets,
+	}, []string{"environment_id", "environment_name", "stack_name", "name", "outcome"})
+
+	extendingInstanceBootstrapDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "instances_bootstrap_duration_seconds",
+		Help:      "The seconds from the beginning of the bootstrap instances to the healthy and active or the unhealthy or error in Rancher",
+		Buckets:   instanceBuckets,
+	}, []string{"environment_id", "environment_name", "stack_name", "service_name", "outcome"})
+
+	return nil
+}
+
+func initResourceMetrics() error {
+	var err error
+	if labelsMode != labelsModeInfo && labelsMode != labelsModeSeries {
+		return fmt.Errorf("invalid labels mode %q", labelsMode)
+	}
+	if hostLabels, err = parseResourceLabels(hostLabelMapping); err != nil {
+		return fmt.Errorf("invalid host labels, %v", err)
+	}
+	if stackLabels, err = parseResourceLabels(stackLabelMapping); err != nil {
+		return fmt.Errorf("invalid stack labels, %v", err)
+	}
+	if serviceLabels, err = parseResourceLabels(serviceLabelMapping); err != nil {
+		return fmt.Errorf("invalid service labels, %v", err)
+	}
+	if instanceLabels, err = parseResourceLabels(instanceLabelMapping); err != nil {
+		return fmt.Errorf("invalid instance labels, %v", err)
+	}
+
+	// health & state of host, stack, service
+	infinityWorksHostsState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "host_state",
+			Help:      "State of defined host as reported by the Rancher API",
+		}, hostLabels.series("environment_id", "environment_name", "id", "name", "state"))
+
+	infinityWorksHostAgentsState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "host_agent_state",
+			Help:      "State of defined host agent as reported by the Rancher API",
+		}, hostLabels.series("environment_id", "environment_name", "id", "name", "state"))
+
+	infinityWorksStacksHealth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stack_health_status",
+			Help:      "HealthState of defined stack as reported by Rancher",
+		}, stackLabels.series("environment_id", "environment_name", "id", "name", "health_state", "system"))
+
+	infinityWorksStacksState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stack_state",
+			Help:      "State of defined stack as reported by Rancher",
+		}, stackLabels.series("environment_id", "environment_name", "id", "name", "state", "system"))
+
+	infinityWorksServicesScale = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_scale",
+			Help:      "scale of defined service as reported by Rancher",
+		}, serviceLabels.series("environment_id", "environment_name", "name", "stack_name", "system"))
+
+	infinityWorksServicesHealth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_health_status",
+			Help:      "HealthState of the service, as reported by the Rancher API",
+		}, serviceLabels.series("environment_id", "environment_name", "id", "stack_id", "name", "stack_name", "health_state", "system"))
+
+	infinityWorksServicesState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_state",
+			Help:      "State of the service, as reported by the Rancher API",
+		}, serviceLabels.series("environment_id", "environment_name", "id", "stack_id", "name", "stack_name", "state", "system"))
+
+	// resource of host
+	hostMemoryTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_memory_total_bytes",
+		Help:      "The total memory of host as reported by the Rancher agent",
+	}, hostLabels.series("environment_id", "environment_name", "id", "name"))
+
+	hostMemoryAvailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_memory_available_bytes",
+		Help:      "The available memory of host as reported by the Rancher agent",
+	}, hostLabels.series("environment_id", "environment_name", "id", "name"))
+
+	hostCPUCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_cpu_count",
+		Help:      "The number of CPUs of host as reported by the Rancher agent",
+	}, hostLabels.series("environment_id", "environment_name", "id", "name"))
+
+	hostLoadAverage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_load_average",
+		Help:      "The load average of host as reported by the Rancher agent",
+	}, hostLabels.series("environment_id", "environment_name", "id", "name", "period"))
+
+	hostFilesystemSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_filesystem_size_bytes",
+		Help:      "The capacity of the mount point of host as reported by the Rancher agent",
+	}, hostLabels.series("environment_id", "environment_name", "id", "name", "mount"))
+
+	hostFilesystemUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_filesystem_used_bytes",
+		Help:      "The usage of the mount point of host as reported by the Rancher agent",
+	}, hostLabels.series("environment_id", "environment_name", "id", "name", "mount"))
+
+	hostInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_info",
+		Help:      "The versions of host as reported by the Rancher API",
+	}, hostLabels.series("environment_id", "environment_name", "id", "name", "docker_version", "kernel_version", "operating_system"))
+
+	// health & state of instance
+	instancesState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_state",
+		Help:      "State of the instance, as reported by the Rancher API",
+	}, instanceLabels.series("environment_id", "environment_name", "id", "service_id", "name", "stack_name", "service_name", "state", "system"))
+
+	instancesHealth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_health_status",
+		Help:      "HealthState of the instance, as reported by the Rancher API",
+	}, instanceLabels.series("environment_id", "environment_name", "id", "service_id", "name", "stack_name", "service_name", "health_state", "system"))
+
+	instancesStartCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_start_count",
+		Help:      "The times of starting the container of the instance, as reported by the Rancher API",
+	}, instanceLabels.series("environment_id", "environment_name", "id", "name", "stack_name", "service_name", "system"))
+
+	instancesExitCode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_exit_code",
+		Help:      "The exit code of the stopped instance, as reported by the Rancher API",
+	}, instanceLabels.series("environment_id", "environment_name", "id", "name", "stack_name", "service_name", "system"))
+
+	instancesInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_info",
+		Help:      "The host and the image of the instance, as reported by the Rancher API",
+	}, instanceLabels.series("environment_id", "environment_name", "id", "name", "stack_name", "service_name", "host_id", "host", "image"))
+
+	// resource of instance
+	instanceCPUUsage = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "instance", "cpu_usage_seconds_total"),
+		"Cumulative cpu time of the instance as reported by the container stats of Rancher",
+		instanceLabels.series("environment_id", "environment_name", "stack_name", "service_name", "name", "host"), nil)
+
+	instanceMemoryUsage = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "instance", "memory_usage_bytes"),
+		"The memory usage of the instance as reported by the container stats of Rancher",
+		instanceLabels.series("environment_id", "environment_name", "stack_name", "service_name", "name", "host"), nil)
+
+	instanceMemoryLimit = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "instance", "memory_limit_bytes"),
+		"The memory limit of the instance as reported by the container stats of Rancher",
+		instanceLabels.series("environment_id", "environment_name", "stack_name", "service_name", "name", "host"), nil)
+
+	instanceNetworkReceive = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "instance", "network_receive_bytes_total"),
+		"Cumulative received bytes of the network interface of the instance as reported by the container stats of Rancher",
+		instanceLabels.series("environment_id", "environment_name", "stack_name", "service_name", "name", "host", "interface"), nil)
+
+	instanceNetworkTransmit = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "instance", "network_transmit_bytes_total"),
+		"Cumulative transmitted bytes of the network interface of the instance as reported by the container stats of Rancher",
+		instanceLabels.series("environment_id", "environment_name", "stack_name", "service_name", "name", "host", "interface"), nil)
+
+	instanceBlkioRead = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "instance", "blkio_read_bytes_total"),
+		"Cumulative read bytes of the block devices of the instance as reported by the container stats of Rancher",
+		instanceLabels.series("environment_id", "environment_name", "stack_name", "service_name", "name", "host"), nil)
+
+	instanceBlkioWrite = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "instance", "blkio_write_bytes_total"),
+		"Cumulative written bytes of the block devices of the instance as reported by the container stats of Rancher",
+		instanceLabels.series("environment_id", "environment_name", "stack_name", "service_name", "name", "host"), nil)
 
 	// heartbeat
 	extendingStackHeartbeat = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "stack_heartbeat",
 		Help:      "The heartbeat of stacks in Rancher",
-	}, []string{"environment_name", "name", "system", "type"})
+	}, stackLabels.series("environment_id", "environment_name", "name", "system", "type"))
 
 	extendingServiceHeartbeat = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "service_heartbeat",
 		Help:      "The heartbeat of services in Rancher",
-	}, []string{"environment_name", "stack_name", "name", "system", "type"})
+	}, serviceLabels.series("environment_id", "environment_name", "stack_name", "name", "system", "type"))
 
 	extendingInstanceHeartbeat = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "instance_heartbeat",
 		Help:      "The heartbeat of instances in Rancher",
-	}, []string{"environment_name", "stack_name", "service_name", "name", "system", "type"})
+	}, instanceLabels.series("environment_id", "environment_name", "stack_name", "service_name", "name", "system", "type"))
+
+	// mapped labels
+	hostLabelsInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_labels",
+		Help:      "The mapped labels of host as reported by the Rancher API",
+	}, append([]string{"environment_id", "environment_name", "id", "name"}, hostLabels.names()...))
+
+	stackLabelsInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stack_labels",
+		Help:      "The mapped labels of stack as reported by the Rancher API",
+	}, append([]string{"environment_id", "environment_name", "id", "name"}, stackLabels.names()...))
+
+	serviceLabelsInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_labels",
+		Help:      "The mapped labels of service as reported by the Rancher API",
+	}, append([]string{"environment_id", "environment_name", "id", "stack_name", "name"}, serviceLabels.names()...))
+
+	instanceLabelsInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_labels",
+		Help:      "The mapped labels of instance as reported by the Rancher API",
+	}, append([]string{"environment_id", "environment_name", "id", "stack_name", "service_name", "name"}, instanceLabels.names()...))
+
+	return nil
+}
+
+// parseBuckets parses the comma-separated upper bounds of histogram buckets, e.g. "5,10,30".
+func parseBuckets(buckets string) ([]float64, error) {
+	var result []float64
+	for _, bucket := range strings.Split(buckets, ",") {
+		if bucket = strings.TrimSpace(bucket); len(bucket) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(bucket, 64)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no bucket in %q", buckets)
+	}
+	if !sort.Float64sAreSorted(result) {
+		return nil, fmt.Errorf("buckets %q are not in increasing order", buckets)
+	}
+	return result, nil
+}
+
+var (
+	/**
+	Exporter
+	*/
+
+	exporterUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "up",
+		Help:      "Whether the last listing of all resources of the environment succeeded",
+	}, []string{"environment_id", "environment_name"})
+
+	exporterCollectorSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "collector_success",
+		Help:      "Whether the last listing of the collector succeeded",
+	}, []string{"environment_id", "environment_name", "collector"})
+
+	exporterCollectorDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "collector_duration_seconds",
+		Help:      "The seconds of the last listing of the collector",
+	}, []string{"environment_id", "environment_name", "collector"})
+
+	exporterScrapeDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "scrape_duration_seconds",
+		Help:      "The seconds of rendering the last scrape from the inventory",
+	})
+
+	exporterAPIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "api_requests_total",
+		Help:      "Current total number of the requests to Rancher API",
+	}, []string{"path", "code"})
+
+	exporterAPIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "api_request_duration_seconds",
+		Help:      "The latency of the requests to Rancher API",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"path"})
+
+	exporterWebsocketConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "websocket_connected",
+		Help:      "Whether the websocket of the environment is connected",
+	}, []string{"environment_id", "environment_name"})
+
+	exporterWebsocketConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "websocket_connections_total",
+		Help:      "Current total number of the established websocket connections",
+	}, []string{"environment_id", "environment_name"})
+
+	exporterWebsocketReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "websocket_reconnects_total",
+		Help:      "Current total number of the websocket reconnections",
+	}, []string{"environment_id", "environment_name"})
+
+	exporterWebsocketMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "websocket_messages_total",
+		Help:      "Current total number of the received websocket messages",
+	}, []string{"environment_id", "environment_name"})
 )
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/gorilla/websocket"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	projectSubpath = "projects"
+)
+
+/**
+Project
+*/
+type project struct {
+	id   string
+	name string
+
+	// id -> name of the stacks in this project
+	stacks         *sync.Map
+	inventory      *inventory
+	containerStats *containerStats
+	removed        *removedResources
+
+	subscribeAddress string
+	// guards websocketConn and closing
+	websocketMutex *sync.Mutex
+	websocketConn  *websocket.Conn
+	// true once the websocket is closed for shutting down, it is never reconnected then
+	closing bool
+	// closed once closing is set, which stops the sleeping reconnections
+	done chan struct{}
+	// 1 if the websocket is connected, accessed atomically
+	connected int32
+	// 1 once the aggregated metrics are initialized, accessed atomically
+	initialized int32
+	// true if the environment is replayed from a record file, which never requests Rancher Server
+	offline bool
+}
+
+func newProject(id, name string) *project {
+	p := newOfflineProject(id, name)
+	p.offline = false
+
+	projectLinksSelf := getSubAddress(getHttpClient().endpoint, projectSubpath, id).String()
+
+	if strings.HasPrefix(projectLinksSelf, "http://") {
+		projectLinksSelf = strings.Replace(projectLinksSelf, "http://", "ws://", -1)
+	} else {
+		projectLinksSelf = strings.Replace(projectLinksSelf, "https://", "wss://", -1)
+	}
+
+	p.subscribeAddress = projectLinksSelf + "/subscribe?eventNames=resource.change&limit=-1&sockId=1"
+	// the environment is connected and listed by watchProject, it is unavailable until then
+	p.setConnected(false)
+	exporterUp.WithLabelValues(p.id, p.name).Set(0)
+
+	return p
+}
+
+// newOfflineProject creates a project without the websocket, its inventory is only stored by the replayed events.
+func newOfflineProject(id, name string) *project {
+	return &project{
+		id:             id,
+		name:           name,
+		stacks:         &sync.Map{},
+		inventory:      newInventory(),
+		containerStats: newContainerStats(),
+		removed:        newRemovedResources(),
+		websocketMutex: &sync.Mutex{},
+		done:           make(chan struct{}),
+		offline:        true,
+	}
+}
+
+// resync lists all the collections of the project and replaces its inventory with the result,
+// a collection failed to list keeps its previous content.
+func (p *project) resync() error {
+	var result error
+
+	for _, collection := range inventoryCollections {
+		if err := p.resyncCollection(collection); err != nil {
+			if result == nil {
+				result = err
+			}
+			logger.Warnf("failed to list %s of environment [%s], %v", collection, p.name, err)
+		}
+	}
+
+	if result != nil {
+		exporterUp.WithLabelValues(p.id, p.name).Set(0)
+	} else {
+		exporterUp.WithLabelValues(p.id, p.name).Set(1)
+	}
+	return result
+}
+
+func (p *project) resyncCollection(collection string) error {
+	resources := make(map[string][]byte)
+	mutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+
+	start := time.Now()
+	err := getHttpClient().foreachCollection(p.id, collection, nil, wg, func(data []byte) {
+		id, _ := jsonparser.GetString(data, "id")
+		if len(id) == 0 || !isInventoryResource(data) {
+			return
+		}
+
+		mutex.Lock()
+		resources[id] = data
+		mutex.Unlock()
+	})
+	wg.Wait()
+	exporterCollectorDuration.WithLabelValues(p.id, p.name, collection).Set(time.Since(start).Seconds())
+
+	if err != nil {
+		exporterCollectorSuccess.WithLabelValues(p.id, p.name, collection).Set(0)
+		return err
+	}
+
+	exporterCollectorSuccess.WithLabelValues(p.id, p.name, collection).Set(1)
+	for _, data := range p.inventory.replace(collection, resources) {
+		p.markRemoved(collection, data)
+	}
+	return nil
+}
+
+func initProjects() []*project {
+	projectsResponseBytes, err := getHttpClient().get(projectSubpath, url.Values{"limit": []string{"-1"}})
+	if err != nil {
+		panic(fmt.Errorf("cannot get project info, %v", err))
+	}
+
+	includes := splitEnvironmentNames(includeEnvironments)
+	excludes := splitEnvironmentNames(excludeEnvironments)
+
+	var projects []*project
+	if _, err := jsonparser.ArrayEach(projectsResponseBytes, func(projectBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+		id, _ := jsonparser.GetString(projectBytes, "id")
+		name, _ := jsonparser.GetString(projectBytes, "name")
+		state, _ := jsonparser.GetString(projectBytes, "state")
+
+		if len(id) == 0 {
+			return
+		}
+		if state != "active" {
+			logger.Infof("skip environment [%s] in state %s", name, state)
+			return
+		}
+		if len(includes) != 0 && !includes[name] {
+			logger.Debugf("skip environment [%s], not included", name)
+			return
+		}
+		if excludes[name] {
+			logger.Debugf("skip environment [%s], excluded", name)
+			return
+		}
+
+		logger.Infof("watching environment [%s] (%s)", name, id)
+		projects = append(projects, newProject(id, name))
+	}, "data"); err != nil {
+		panic(fmt.Errorf("cannot get projects, %v", err))
+	}
+
+	if len(projects) == 0 {
+		panic(fmt.Errorf("no environment is visible with access key %s", cattleAccessKey))
+	}
+
+	return projects
+}
+
+func splitEnvironmentNames(names string) map[string]bool {
+	result := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); len(name) != 0 {
+			result[name] = true
+		}
+	}
+	return result
+}
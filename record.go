@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	logger "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// the longest recorded message, the resources with many labels or environment variables are large
+const maxRecordSize = 16 << 20
+
+// eventRecord is a line of the record file, the message is the raw websocket message of the environment.
+type eventRecord struct {
+	Time            time.Time       `json:"time"`
+	EnvironmentID   string          `json:"environment_id"`
+	EnvironmentName string          `json:"environment_name"`
+	Message         json.RawMessage `json:"message"`
+}
+
+// eventRecorder appends the websocket messages of all environments to the record file,
+// a nil recorder records nothing.
+type eventRecorder struct {
+	mutex *sync.Mutex
+	file  *os.File
+}
+
+func newEventRecorder(path string) (*eventRecorder, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("recording websocket messages to %s", path)
+
+	return &eventRecorder{
+		mutex: &sync.Mutex{},
+		file:  file,
+	}, nil
+}
+
+func (e *eventRecorder) record(p *project, messageBytes []byte) {
+	if e == nil {
+		return
+	}
+
+	line, err := json.Marshal(eventRecord{
+		Time:            time.Now(),
+		EnvironmentID:   p.id,
+		EnvironmentName: p.name,
+		Message:         json.RawMessage(messageBytes),
+	})
+	if err != nil {
+		logger.Warnf("failed to record message of environment [%s], %v", p.name, err)
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.file == nil {
+		return
+	}
+	if _, err := e.file.Write(append(line, '\n')); err != nil {
+		logger.Warnf("failed to record message of environment [%s], %v", p.name, err)
+	}
+}
+
+// close stops recording, the messages received later are not recorded.
+func (e *eventRecorder) close() error {
+	if e == nil {
+		return nil
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file = nil
+	return err
+}
+
+// replayAction feeds a record file through the parser and the msg event handler offline, then prints the counters,
+// the clock of the handler is the recorded time, so the durations and the timeouts are the same as recorded.
+func replayAction(c *cli.Context) error {
+	setLogLevel(c.GlobalString("log_level"))
+
+	if err := replayFile(c); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+func replayFile(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("replay requires exactly one record file")
+	}
+
+	for _, init := range []func() error{initBootstrapHistograms, initResourceMetrics, initResourceFilter, initAggregationMode} {
+		if err := init(); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := newReplayExporter()
+	if err := r.replay(file); err != nil {
+		return err
+	}
+	return writeReplayResult(os.Stdout)
+}
+
+func newReplayExporter() *rancherExporter {
+	return &rancherExporter{
+		mutex:  &sync.Mutex{},
+		states: newBootstrapStates(),
+
+		clock: time.Now,
+	}
+}
+
+// replay handles the records in order, the environments are created by their first records,
+// and the timeout bootstraps are swept as often as the live exporter sweeps them.
+func (r *rancherExporter) replay(reader io.Reader) error {
+	projects := make(map[string]*project)
+	handle := r.newEventHandler()
+
+	r.states.mutex.Lock()
+	defer r.states.mutex.Unlock()
+
+	var now, swept time.Time
+	r.clock = func() time.Time {
+		return now
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record eventRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("invalid record at line %d, %v", line, err)
+		}
+		if record.Time.Before(now) {
+			logger.Warnf("record at line %d is earlier than its previous record", line)
+		} else {
+			now = record.Time
+		}
+
+		if swept.IsZero() {
+			swept = now
+		} else if now.Sub(swept) >= bootstrapSweepInterval {
+			handle(buffMsg{class: "sweep"})
+			r.states.pruneSince()
+			swept = now
+		}
+
+		p, ok := projects[record.EnvironmentID]
+		if !ok {
+			p = newOfflineProject(record.EnvironmentID, record.EnvironmentName)
+			projects[record.EnvironmentID] = p
+			r.projects = append(r.projects, p)
+		}
+
+		if msg, ok := p.parseMessage(record.Message); ok {
+			handle(msg)
+			r.states.pruneSince()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// the seconds in the last states are counted until the last record
+	r.states.timelines.flush(now)
+	for id := range r.states.since {
+		logger.Infof("bootstrap of [%s] is still in-flight at the end of the record", id)
+	}
+	return nil
+}
+
+// writeReplayResult prints the counters and the bootstrap durations in the text format of Prometheus.
+func writeReplayResult(w io.Writer) error {
+	registry := prometheus.NewRegistry()
+	for _, vec := range persistedCounters {
+		if err := registry.Register(vec); err != nil {
+			return err
+		}
+	}
+	for _, histogram := range []*prometheus.HistogramVec{extendingStackBootstrapDuration, extendingServiceBootstrapDuration, extendingInstanceBootstrapDuration} {
+		if err := registry.Register(histogram); err != nil {
+			return err
+		}
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
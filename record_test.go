@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// TestReplay replays the recorded restart of a service with an instance,
+// stopping(healthy) -> starting(healthy) -> running(reinitializing) -> running(healthy).
+func TestReplay(t *testing.T) {
+	stackBootstrapBuckets = "10,30,60"
+	serviceBootstrapBuckets = "10,30,60"
+	instanceBootstrapBuckets = "1,5,10"
+	aggregationMode = aggregationModeSentinel
+	for _, init := range []func() error{initBootstrapHistograms, initResourceFilter} {
+		if err := init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the counters are package-level, so they are reset for replaying the fixture only
+	for _, vec := range persistedCounters {
+		vec.Reset()
+	}
+
+	file, err := os.Open("testdata/restart-service.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := newReplayExporter().replay(file); err != nil {
+		t.Fatal(err)
+	}
+
+	output := &bytes.Buffer{}
+	if err := writeReplayResult(output); err != nil {
+		t.Fatal(err)
+	}
+	families, err := (&expfmt.TextParser{}).TextToMetricFamilies(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := map[string]string{"environment_id": "1a9", "stack_name": "shop", "name": "api"}
+	instance := map[string]string{"environment_id": "1a9", "stack_name": "shop", "service_name": "api", "name": "shop-api-1"}
+	for _, c := range []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"rancher_services_bootstrap_total", service, 1},
+		{"rancher_services_bootstrap_success_total", service, 1},
+		{"rancher_services_bootstrap_error_total", service, 0},
+		{"rancher_instances_bootstrap_total", instance, 1},
+		{"rancher_instances_bootstrap_success_total", instance, 1},
+		{"rancher_stacks_bootstrap_total", map[string]string{"environment_id": "1a9", "name": "shop"}, 0},
+	} {
+		if got, _ := sampleValue(families, c.name, c.labels); got != c.want {
+			t.Errorf("%s%v = %v, want %v", c.name, c.labels, got, c.want)
+		}
+	}
+
+	// the durations are measured by the recorded time
+	for _, m := range families["rancher_services_bootstrap_duration_seconds"].GetMetric() {
+		for _, pair := range m.GetLabel() {
+			if pair.GetName() == "environment_id" && pair.GetValue() == "1a9" {
+				if got := m.GetHistogram().GetSampleSum(); got != 20 {
+					t.Errorf("duration of the service bootstrap = %v, want 20", got)
+				}
+			}
+		}
+	}
+}
@@ -18,7 +18,7 @@ const (
 	serviceSubpath = "services"
 )
 
-func setServiceMetrics(stacks *sync.Map, serviceBytes []byte) (string, *serviceContent) {
+func setServiceMetrics(p *project, stacks *sync.Map, serviceBytes []byte) (string, *serviceContent) {
 	stackId, _ := jsonparser.GetString(serviceBytes, "stackId")
 	IstackName, _ := stacks.Load(stackId)
 	stackName := fmt.Sprintf("%v", IstackName)
@@ -31,24 +31,37 @@ func setServiceMetrics(stacks *sync.Map, serviceBytes []byte) (string, *serviceC
 	serviceState, _ := jsonparser.GetString(serviceBytes, "state")
 	serviceScale, _ := jsonparser.GetInt(serviceBytes, "scale")
 
-	infinityWorksServicesScale.WithLabelValues(serviceName, stackName, serviceSystem).Set(float64(serviceScale))
+	curried := serviceLabels.curry(serviceBytes)
+	servicesHealth := infinityWorksServicesHealth.MustCurryWith(curried)
+	servicesState := infinityWorksServicesState.MustCurryWith(curried)
+
+	infinityWorksServicesScale.MustCurryWith(curried).WithLabelValues(p.id, p.name, serviceName, stackName, serviceSystem).Set(float64(serviceScale))
 	for _, y := range healthStates {
 		if serviceHealthState == y {
-			infinityWorksServicesHealth.WithLabelValues(serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(1)
+			servicesHealth.WithLabelValues(p.id, p.name, serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(1)
 		} else {
-			infinityWorksServicesHealth.WithLabelValues(serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(0)
+			servicesHealth.WithLabelValues(p.id, p.name, serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(0)
 		}
 	}
 
 	for _, y := range serviceStates {
 		if serviceState == y {
-			infinityWorksServicesState.WithLabelValues(serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(1)
+			servicesState.WithLabelValues(p.id, p.name, serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(1)
 		} else {
-			infinityWorksServicesState.WithLabelValues(serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(0)
+			servicesState.WithLabelValues(p.id, p.name, serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(0)
 		}
 	}
 
-	extendingServiceHeartbeat.WithLabelValues(projectName, stackName, serviceName, serviceSystem, serviceType).Set(float64(1))
+	if serviceState == "upgraded" {
+		oldImage, newImage := upgradeImages(serviceBytes)
+		extendingServiceUpgradePending.WithLabelValues(p.id, p.name, stackName, serviceName, oldImage, newImage).Set(1)
+	}
+
+	extendingServiceHeartbeat.MustCurryWith(curried).WithLabelValues(p.id, p.name, stackName, serviceName, serviceSystem, serviceType).Set(float64(1))
+
+	if len(serviceLabels) != 0 {
+		serviceLabelsInfo.WithLabelValues(append([]string{p.id, p.name, serviceId, stackName, serviceName}, serviceLabels.values(serviceBytes)...)...).Set(1)
+	}
 	return serviceId, &serviceContent{
 		ServiceID:   serviceId,
 		ServiceName: serviceName,
@@ -57,7 +70,7 @@ func setServiceMetrics(stacks *sync.Map, serviceBytes []byte) (string, *serviceC
 	}
 }
 
-func setServiceAggregatedMetrics(stacks *sync.Map, serviceBytes []byte) (string, *serviceContent) {
+func setServiceAggregatedMetrics(p *project, stacks *sync.Map, serviceBytes []byte) (string, *serviceContent) {
 	stackId, _ := jsonparser.GetString(serviceBytes, "stackId")
 	IstackName, _ := stacks.Load(stackId)
 	stackName := fmt.Sprintf("%v", IstackName)
@@ -67,47 +80,47 @@ func setServiceAggregatedMetrics(stacks *sync.Map, serviceBytes []byte) (string,
 	serviceHealthState, _ := jsonparser.GetString(serviceBytes, "healthState")
 	serviceState, _ := jsonparser.GetString(serviceBytes, "state")
 
-	extendingTotalServiceBootstraps.WithLabelValues(projectName, specialTag, specialTag)
-	extendingTotalServiceBootstraps.WithLabelValues(projectName, stackName, specialTag)
-	extendingTotalServiceBootstraps.WithLabelValues(projectName, stackName, serviceName)
-	extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, specialTag, specialTag)
-	extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, stackName, specialTag)
-	extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, stackName, serviceName)
-	extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, specialTag, specialTag)
-	extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, stackName, specialTag)
-	extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, stackName, serviceName)
+	extendingTotalServiceBootstraps.WithLabelValues(p.id, p.name, specialTag, specialTag)
+	extendingTotalServiceBootstraps.WithLabelValues(p.id, p.name, stackName, specialTag)
+	extendingTotalServiceBootstraps.WithLabelValues(p.id, p.name, stackName, serviceName)
+	extendingTotalSuccessServiceBootstrap.WithLabelValues(p.id, p.name, specialTag, specialTag)
+	extendingTotalSuccessServiceBootstrap.WithLabelValues(p.id, p.name, stackName, specialTag)
+	extendingTotalSuccessServiceBootstrap.WithLabelValues(p.id, p.name, stackName, serviceName)
+	extendingTotalErrorServiceBootstrap.WithLabelValues(p.id, p.name, specialTag, specialTag)
+	extendingTotalErrorServiceBootstrap.WithLabelValues(p.id, p.name, stackName, specialTag)
+	extendingTotalErrorServiceBootstrap.WithLabelValues(p.id, p.name, stackName, serviceName)
 
 	switch serviceState {
 	case "active":
-		extendingTotalServiceInitializations.WithLabelValues(projectName, specialTag, specialTag).Inc()
-		extendingTotalServiceInitializations.WithLabelValues(projectName, stackName, specialTag).Inc()
-		extendingTotalServiceInitializations.WithLabelValues(projectName, stackName, serviceName).Inc()
+		extendingTotalServiceInitializations.WithLabelValues(p.id, p.name, specialTag, specialTag).Inc()
+		extendingTotalServiceInitializations.WithLabelValues(p.id, p.name, stackName, specialTag).Inc()
+		extendingTotalServiceInitializations.WithLabelValues(p.id, p.name, stackName, serviceName).Inc()
 
 		if serviceHealthState == "unhealthy" {
-			extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, specialTag, specialTag)
-			extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, specialTag)
-			extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, serviceName)
-			extendingTotalErrorServiceInitialization.WithLabelValues(projectName, specialTag, specialTag).Inc()
-			extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, specialTag).Inc()
-			extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, serviceName).Inc()
+			extendingTotalSuccessServiceInitialization.WithLabelValues(p.id, p.name, specialTag, specialTag)
+			extendingTotalSuccessServiceInitialization.WithLabelValues(p.id, p.name, stackName, specialTag)
+			extendingTotalSuccessServiceInitialization.WithLabelValues(p.id, p.name, stackName, serviceName)
+			extendingTotalErrorServiceInitialization.WithLabelValues(p.id, p.name, specialTag, specialTag).Inc()
+			extendingTotalErrorServiceInitialization.WithLabelValues(p.id, p.name, stackName, specialTag).Inc()
+			extendingTotalErrorServiceInitialization.WithLabelValues(p.id, p.name, stackName, serviceName).Inc()
 		} else if serviceHealthState == "healthy" {
-			extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, specialTag, specialTag).Inc()
-			extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, specialTag).Inc()
-			extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, serviceName).Inc()
-			extendingTotalErrorServiceInitialization.WithLabelValues(projectName, specialTag, specialTag)
-			extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, specialTag)
-			extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, serviceName)
+			extendingTotalSuccessServiceInitialization.WithLabelValues(p.id, p.name, specialTag, specialTag).Inc()
+			extendingTotalSuccessServiceInitialization.WithLabelValues(p.id, p.name, stackName, specialTag).Inc()
+			extendingTotalSuccessServiceInitialization.WithLabelValues(p.id, p.name, stackName, serviceName).Inc()
+			extendingTotalErrorServiceInitialization.WithLabelValues(p.id, p.name, specialTag, specialTag)
+			extendingTotalErrorServiceInitialization.WithLabelValues(p.id, p.name, stackName, specialTag)
+			extendingTotalErrorServiceInitialization.WithLabelValues(p.id, p.name, stackName, serviceName)
 		}
 	case "error":
-		extendingTotalServiceInitializations.WithLabelValues(projectName, specialTag, specialTag).Inc()
-		extendingTotalServiceInitializations.WithLabelValues(projectName, stackName, specialTag).Inc()
-		extendingTotalServiceInitializations.WithLabelValues(projectName, stackName, serviceName).Inc()
-		extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, specialTag, specialTag)
-		extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, specialTag)
-		extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, serviceName)
-		extendingTotalErrorServiceInitialization.WithLabelValues(projectName, specialTag, specialTag).Inc()
-		extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, specialTag).Inc()
-		extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, serviceName).Inc()
+		extendingTotalServiceInitializations.WithLabelValues(p.id, p.name, specialTag, specialTag).Inc()
+		extendingTotalServiceInitializations.WithLabelValues(p.id, p.name, stackName, specialTag).Inc()
+		extendingTotalServiceInitializations.WithLabelValues(p.id, p.name, stackName, serviceName).Inc()
+		extendingTotalSuccessServiceInitialization.WithLabelValues(p.id, p.name, specialTag, specialTag)
+		extendingTotalSuccessServiceInitialization.WithLabelValues(p.id, p.name, stackName, specialTag)
+		extendingTotalSuccessServiceInitialization.WithLabelValues(p.id, p.name, stackName, serviceName)
+		extendingTotalErrorServiceInitialization.WithLabelValues(p.id, p.name, specialTag, specialTag).Inc()
+		extendingTotalErrorServiceInitialization.WithLabelValues(p.id, p.name, stackName, specialTag).Inc()
+		extendingTotalErrorServiceInitialization.WithLabelValues(p.id, p.name, stackName, serviceName).Inc()
 	}
 	return serviceId, &serviceContent{
 		ServiceID:   serviceId,
@@ -8,70 +8,79 @@ const (
 	stackSubpath = "stacks"
 )
 
-func setStackMetrics(stackBytes []byte) (string, string) {
+func setStackMetrics(p *project, stackBytes []byte) (string, string) {
 	stackId, _ := jsonparser.GetString(stackBytes, "id")
 	stackName, _ := jsonparser.GetString(stackBytes, "name")
 	stackSystem, _ := jsonparser.GetUnsafeString(stackBytes, "system")
 	stackType, _ := jsonparser.GetString(stackBytes, "type")
 	stackHealthState, _ := jsonparser.GetString(stackBytes, "healthState")
 	stackState, _ := jsonparser.GetString(stackBytes, "state")
+
+	curried := stackLabels.curry(stackBytes)
+	stacksHealth := infinityWorksStacksHealth.MustCurryWith(curried)
+	stacksState := infinityWorksStacksState.MustCurryWith(curried)
+
 	for _, y := range healthStates {
 		if stackHealthState == y {
-			infinityWorksStacksHealth.WithLabelValues(stackId, stackName, y, stackSystem).Set(1)
+			stacksHealth.WithLabelValues(p.id, p.name, stackId, stackName, y, stackSystem).Set(1)
 		} else {
-			infinityWorksStacksHealth.WithLabelValues(stackId, stackName, y, stackSystem).Set(0)
+			stacksHealth.WithLabelValues(p.id, p.name, stackId, stackName, y, stackSystem).Set(0)
 		}
 	}
 
 	for _, y := range stackStates {
 		if stackState == y {
-			infinityWorksStacksState.WithLabelValues(stackId, stackName, y, stackSystem).Set(1)
+			stacksState.WithLabelValues(p.id, p.name, stackId, stackName, y, stackSystem).Set(1)
 		} else {
-			infinityWorksStacksState.WithLabelValues(stackId, stackName, y, stackSystem).Set(0)
+			stacksState.WithLabelValues(p.id, p.name, stackId, stackName, y, stackSystem).Set(0)
 		}
 	}
-	extendingStackHeartbeat.WithLabelValues(projectName, stackName, stackSystem, stackType).Set(float64(1))
+	extendingStackHeartbeat.MustCurryWith(curried).WithLabelValues(p.id, p.name, stackName, stackSystem, stackType).Set(float64(1))
+
+	if len(stackLabels) != 0 {
+		stackLabelsInfo.WithLabelValues(append([]string{p.id, p.name, stackId, stackName}, stackLabels.values(stackBytes)...)...).Set(1)
+	}
 	return stackId, stackName
 }
 
-func setStackAggregatedMetrics(stackBytes []byte) (string, string) {
+func setStackAggregatedMetrics(p *project, stackBytes []byte) (string, string) {
 	stackId, _ := jsonparser.GetString(stackBytes, "id")
 	stackName, _ := jsonparser.GetString(stackBytes, "name")
 	stackHealthState, _ := jsonparser.GetString(stackBytes, "healthState")
 	stackState, _ := jsonparser.GetString(stackBytes, "state")
 
 	// init bootstrap
-	extendingTotalStackBootstraps.WithLabelValues(projectName, specialTag)
-	extendingTotalStackBootstraps.WithLabelValues(projectName, stackName)
-	extendingTotalSuccessStackBootstrap.WithLabelValues(projectName, specialTag)
-	extendingTotalSuccessStackBootstrap.WithLabelValues(projectName, stackName)
-	extendingTotalErrorStackBootstrap.WithLabelValues(projectName, specialTag)
-	extendingTotalErrorStackBootstrap.WithLabelValues(projectName, stackName)
+	extendingTotalStackBootstraps.WithLabelValues(p.id, p.name, specialTag)
+	extendingTotalStackBootstraps.WithLabelValues(p.id, p.name, stackName)
+	extendingTotalSuccessStackBootstrap.WithLabelValues(p.id, p.name, specialTag)
+	extendingTotalSuccessStackBootstrap.WithLabelValues(p.id, p.name, stackName)
+	extendingTotalErrorStackBootstrap.WithLabelValues(p.id, p.name, specialTag)
+	extendingTotalErrorStackBootstrap.WithLabelValues(p.id, p.name, stackName)
 
 	switch stackState {
 	case "active":
 		if stackHealthState == "unhealthy" {
-			extendingTotalStackInitializations.WithLabelValues(projectName, specialTag).Inc()
-			extendingTotalStackInitializations.WithLabelValues(projectName, stackName).Inc()
-			extendingTotalSuccessStackInitialization.WithLabelValues(projectName, specialTag)
-			extendingTotalSuccessStackInitialization.WithLabelValues(projectName, stackName)
-			extendingTotalErrorStackInitialization.WithLabelValues(projectName, specialTag).Inc()
-			extendingTotalErrorStackInitialization.WithLabelValues(projectName, stackName).Inc()
+			extendingTotalStackInitializations.WithLabelValues(p.id, p.name, specialTag).Inc()
+			extendingTotalStackInitializations.WithLabelValues(p.id, p.name, stackName).Inc()
+			extendingTotalSuccessStackInitialization.WithLabelValues(p.id, p.name, specialTag)
+			extendingTotalSuccessStackInitialization.WithLabelValues(p.id, p.name, stackName)
+			extendingTotalErrorStackInitialization.WithLabelValues(p.id, p.name, specialTag).Inc()
+			extendingTotalErrorStackInitialization.WithLabelValues(p.id, p.name, stackName).Inc()
 		} else if stackHealthState == "healthy" {
-			extendingTotalStackInitializations.WithLabelValues(projectName, specialTag).Inc()
-			extendingTotalStackInitializations.WithLabelValues(projectName, stackName).Inc()
-			extendingTotalSuccessStackInitialization.WithLabelValues(projectName, specialTag).Inc()
-			extendingTotalSuccessStackInitialization.WithLabelValues(projectName, stackName).Inc()
-			extendingTotalErrorStackInitialization.WithLabelValues(projectName, specialTag)
-			extendingTotalErrorStackInitialization.WithLabelValues(projectName, stackName)
+			extendingTotalStackInitializations.WithLabelValues(p.id, p.name, specialTag).Inc()
+			extendingTotalStackInitializations.WithLabelValues(p.id, p.name, stackName).Inc()
+			extendingTotalSuccessStackInitialization.WithLabelValues(p.id, p.name, specialTag).Inc()
+			extendingTotalSuccessStackInitialization.WithLabelValues(p.id, p.name, stackName).Inc()
+			extendingTotalErrorStackInitialization.WithLabelValues(p.id, p.name, specialTag)
+			extendingTotalErrorStackInitialization.WithLabelValues(p.id, p.name, stackName)
 		}
 	case "error":
-		extendingTotalStackInitializations.WithLabelValues(projectName, specialTag).Inc()
-		extendingTotalStackInitializations.WithLabelValues(projectName, stackName).Inc()
-		extendingTotalSuccessStackInitialization.WithLabelValues(projectName, specialTag)
-		extendingTotalSuccessStackInitialization.WithLabelValues(projectName, stackName)
-		extendingTotalErrorStackInitialization.WithLabelValues(projectName, specialTag).Inc()
-		extendingTotalErrorStackInitialization.WithLabelValues(projectName, stackName).Inc()
+		extendingTotalStackInitializations.WithLabelValues(p.id, p.name, specialTag).Inc()
+		extendingTotalStackInitializations.WithLabelValues(p.id, p.name, stackName).Inc()
+		extendingTotalSuccessStackInitialization.WithLabelValues(p.id, p.name, specialTag)
+		extendingTotalSuccessStackInitialization.WithLabelValues(p.id, p.name, stackName)
+		extendingTotalErrorStackInitialization.WithLabelValues(p.id, p.name, specialTag).Inc()
+		extendingTotalErrorStackInitialization.WithLabelValues(p.id, p.name, stackName).Inc()
 	}
 
 	return stackId, stackName
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/prometheus/client_golang/prometheus"
+	logger "github.com/sirupsen/logrus"
+)
+
+// the longest interval of dropping the series of the removed resources
+const staleSeriesCheckInterval = time.Minute
+
+var bootstrapOutcomes = []string{"success", "error", "timeout"}
+
+// removedResources keeps the removed hosts, stacks, services and instances of a project until their series are dropped,
+// a resource is removed when the websocket reports it removed or a resync no longer lists it.
+type removedResources struct {
+	mutex *sync.Mutex
+
+	// collection subpath -> joined label values -> resource
+	resources map[string]map[string]*removedResource
+}
+
+type removedResource struct {
+	id string
+	// the label values of the series without the environment labels
+	labelValues []string
+	removed     time.Time
+}
+
+func newRemovedResources() *removedResources {
+	resources := make(map[string]map[string]*removedResource)
+	for _, collection := range []string{hostSubpath, stackSubpath, serviceSubpath, instanceSubpath} {
+		resources[collection] = make(map[string]*removedResource)
+	}
+
+	return &removedResources{
+		mutex:     &sync.Mutex{},
+		resources: resources,
+	}
+}
+
+// markRemoved records a removed resource.
+func (p *project) markRemoved(collection string, resourceBytes []byte) {
+	if staleSeriesRetention <= 0 {
+		return
+	}
+
+	labelValues, ok := p.seriesLabelValues(collection, resourceBytes)
+	if !ok {
+		return
+	}
+
+	id, _ := jsonparser.GetString(resourceBytes, "id")
+
+	p.removed.mutex.Lock()
+	defer p.removed.mutex.Unlock()
+
+	key := strings.Join(labelValues, "/")
+	if resource, ok := p.removed.resources[collection][key]; ok {
+		resource.id = id
+	} else {
+		p.removed.resources[collection][key] = &removedResource{
+			id:          id,
+			labelValues: labelValues,
+			removed:     time.Now(),
+		}
+	}
+}
+
+// stackName returns the name of a removed stack, which names the series of its services removed after it.
+func (r *removedResources) stackName(stackId string) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, resource := range r.resources[stackSubpath] {
+		if resource.id == stackId {
+			return resource.labelValues[0], true
+		}
+	}
+	return "", false
+}
+
+// collections returns the collections which have removed resources.
+func (r *removedResources) collections() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var result []string
+	for collection, resources := range r.resources {
+		if len(resources) != 0 {
+			result = append(result, collection)
+		}
+	}
+	return result
+}
+
+// seriesLabelValues returns the label values of the per-resource series of a host, a stack, a service or an instance,
+// which are named as the state machine names them.
+func (p *project) seriesLabelValues(collection string, resourceBytes []byte) ([]string, bool) {
+	name, _ := jsonparser.GetString(resourceBytes, "name")
+
+	switch collection {
+	case hostSubpath:
+		if len(name) == 0 {
+			name, _ = jsonparser.GetString(resourceBytes, "hostname")
+		}
+		return []string{name}, true
+	case stackSubpath:
+		return []string{name}, true
+	case serviceSubpath:
+		// the stack is often forgotten before its services are reported removed, so it is found in the removed stacks then
+		stackId, _ := jsonparser.GetString(resourceBytes, "stackId")
+		stackName := ""
+		if value, ok := p.stacks.Load(stackId); ok {
+			stackName = value.(string)
+		} else if value, ok := p.removed.stackName(stackId); ok {
+			stackName = value
+		}
+		return []string{stackName, name}, true
+	case instanceSubpath:
+		labelStackServiceName, _ := jsonparser.GetString(resourceBytes, "labels", "io.rancher.stack_service.name")
+		labelStackServiceNameSplit := strings.Split(labelStackServiceName, "/")
+
+		var serviceName string
+		stackName := labelStackServiceNameSplit[0]
+		if len(labelStackServiceNameSplit) > 1 {
+			serviceName = labelStackServiceNameSplit[1]
+		}
+		return []string{stackName, serviceName, name}, true
+	}
+	return nil, false
+}
+
+func (r *rancherExporter) cleanStaleSeriesPeriodically() {
+	if staleSeriesRetention <= 0 {
+		return
+	}
+
+	interval := staleSeriesCheckInterval
+	if staleSeriesRetention < interval {
+		interval = staleSeriesRetention
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, p := range r.projects {
+			p.cleanStaleSeries()
+		}
+	}
+}
+
+// cleanStaleSeries drops the series of the resources removed longer than the retention,
+// a series still named by a resource in the inventory, e.g. a stack recreated with the same name, is kept.
+func (p *project) cleanStaleSeries() {
+	// the alive resources are named without holding the mutex, as a service may be named by a removed stack
+	alive := make(map[string]map[string]bool)
+	for _, collection := range p.removed.collections() {
+		alive[collection] = make(map[string]bool)
+		p.inventory.foreach(collection, func(data []byte) {
+			if labelValues, ok := p.seriesLabelValues(collection, data); ok {
+				alive[collection][strings.Join(labelValues, "/")] = true
+			}
+		})
+	}
+
+	p.removed.mutex.Lock()
+	defer p.removed.mutex.Unlock()
+
+	dropped := 0
+	for collection, resources := range p.removed.resources {
+		for key, resource := range resources {
+			if time.Since(resource.removed) < staleSeriesRetention {
+				continue
+			}
+			if !alive[collection][key] {
+				p.deleteResourceSeries(collection, resource.labelValues)
+				dropped++
+			}
+			delete(resources, key)
+		}
+	}
+
+	if dropped != 0 {
+		logger.Infof("dropped the series of %d removed resources of environment [%s]", dropped, p.name)
+	}
+}
+
+// deleteResourceSeries drops the per-resource series of the counters and the histograms,
+// and the upgrades, the health transitions and the state seconds with any images and states.
+// The series of the services and the instances of a removed stack are dropped with their aggregates by the stack,
+// only the __rancher__ aggregate series of the environment are kept.
+func (p *project) deleteResourceSeries(collection string, labelValues []string) {
+	var counters []*aggregatedCounterVec
+	var histogram *prometheus.HistogramVec
+
+	switch collection {
+	case stackSubpath:
+		counters = []*aggregatedCounterVec{
+			extendingTotalStackInitializations, extendingTotalSuccessStackInitialization, extendingTotalErrorStackInitialization,
+			extendingTotalStackBootstraps, extendingTotalSuccessStackBootstrap, extendingTotalErrorStackBootstrap, extendingTotalTimeoutStackBootstrap,
+		}
+		histogram = extendingStackBootstrapDuration
+	case serviceSubpath:
+		counters = []*aggregatedCounterVec{
+			extendingTotalServiceInitializations, extendingTotalSuccessServiceInitialization, extendingTotalErrorServiceInitialization,
+			extendingTotalServiceBootstraps, extendingTotalSuccessServiceBootstrap, extendingTotalErrorServiceBootstrap, extendingTotalTimeoutServiceBootstrap,
+		}
+		histogram = extendingServiceBootstrapDuration
+	case instanceSubpath:
+		// the instance histogram is not labeled by the instance name
+		counters = []*aggregatedCounterVec{
+			extendingTotalInstanceInitializations, extendingTotalSuccessInstanceInitialization, extendingTotalErrorInstanceInitialization,
+			extendingTotalInstanceBootstraps, extendingTotalSuccessInstanceBootstrap, extendingTotalErrorInstanceBootstrap, extendingTotalTimeoutInstanceBootstrap,
+		}
+	}
+
+	values := append([]string{p.id, p.name}, labelValues...)
+	for _, counter := range counters {
+		counter.DeleteLabelValues(values...)
+	}
+	switch collection {
+	case hostSubpath:
+		extendingTotalHostStateSeconds.deleteMatchingSeries(values)
+	case stackSubpath:
+		extendingTotalStackStateSeconds.deleteMatchingSeries(values)
+		for _, counter := range []*aggregatedCounterVec{
+			extendingTotalServiceInitializations, extendingTotalSuccessServiceInitialization, extendingTotalErrorServiceInitialization,
+			extendingTotalServiceBootstraps, extendingTotalSuccessServiceBootstrap, extendingTotalErrorServiceBootstrap, extendingTotalTimeoutServiceBootstrap,
+			extendingTotalServiceUpgrades, extendingTotalFinishedServiceUpgrade, extendingTotalRollbackServiceUpgrade, extendingTotalErrorServiceUpgrade,
+			extendingTotalServiceHealthTransitions, extendingTotalServiceStateSeconds,
+			extendingTotalInstanceInitializations, extendingTotalSuccessInstanceInitialization, extendingTotalErrorInstanceInitialization,
+			extendingTotalInstanceBootstraps, extendingTotalSuccessInstanceBootstrap, extendingTotalErrorInstanceBootstrap, extendingTotalTimeoutInstanceBootstrap,
+			extendingTotalInstanceHealthTransitions,
+		} {
+			counter.deleteMatchingSeries(values)
+		}
+		stackLabels := prometheus.Labels{"environment_id": p.id, "environment_name": p.name, "stack_name": labelValues[0]}
+		deleteMatchingLabels(extendingInstanceBootstrapMsCost, stackLabels)
+		for _, stackHistogram := range []*prometheus.HistogramVec{extendingServiceBootstrapDuration, extendingInstanceBootstrapDuration} {
+			if stackHistogram != nil {
+				deleteMatchingLabels(stackHistogram, stackLabels)
+			}
+		}
+	case serviceSubpath:
+		for _, counter := range []*aggregatedCounterVec{
+			extendingTotalServiceUpgrades, extendingTotalFinishedServiceUpgrade, extendingTotalRollbackServiceUpgrade, extendingTotalErrorServiceUpgrade,
+			extendingTotalServiceHealthTransitions, extendingTotalServiceStateSeconds,
+		} {
+			counter.deleteMatchingSeries(values)
+		}
+	case instanceSubpath:
+		extendingTotalInstanceHealthTransitions.deleteMatchingSeries(values)
+		deleteMatchingLabels(extendingInstanceBootstrapMsCost, prometheus.Labels{
+			"environment_id": p.id, "environment_name": p.name, "stack_name": labelValues[0], "service_name": labelValues[1], "name": labelValues[2],
+		})
+	}
+	if histogram != nil {
+		for _, outcome := range bootstrapOutcomes {
+			histogram.DeleteLabelValues(append(values, outcome)...)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCleanStaleSeriesOfRemovedStack(t *testing.T) {
+	staleSeriesRetention = time.Millisecond
+	defer func() {
+		staleSeriesRetention = 0
+	}()
+	aggregationMode = aggregationModeSentinel
+
+	p := newOfflineProject("1a6", "Stale")
+	r := newReplayExporter()
+	r.projects = []*project{p}
+	handle := r.newEventHandler()
+
+	message := func(baseType, resource string) []byte {
+		return []byte(fmt.Sprintf(`{"name":"resource.change","resourceType":"%s","data":{"resource":%s}}`, baseType, resource))
+	}
+	stack := func(state string) []byte {
+		return message("stack", fmt.Sprintf(`{"baseType":"stack","id":"1st6","name":"shop","state":"%s","healthState":"healthy","type":"stack"}`, state))
+	}
+	service := func(state string) []byte {
+		return message("service", fmt.Sprintf(`{"baseType":"service","id":"1s6","name":"api","stackId":"1st6","state":"%s","healthState":"healthy","type":"service"}`, state))
+	}
+
+	// the stack is removed with its services, and the stack is reported removed first
+	r.states.mutex.Lock()
+	for _, messageBytes := range [][]byte{stack("active"), service("active"), stack("removed"), service("removed")} {
+		if msg, ok := p.parseMessage(messageBytes); ok {
+			handle(msg)
+		}
+	}
+	r.states.mutex.Unlock()
+	if _, ok := p.stacks.Load("1st6"); ok {
+		t.Fatal("stack shop is not forgotten after it is removed")
+	}
+
+	stackCounter := extendingTotalStackBootstraps.WithLabelValues(p.id, p.name, "shop")
+	stackCounter.Inc()
+	extendingTotalServiceBootstraps.WithLabelValues(p.id, p.name, "shop", "api").Inc()
+	extendingTotalServiceBootstraps.WithLabelValues(p.id, p.name, "shop", specialTag).Inc()
+	extendingTotalServiceBootstraps.WithLabelValues(p.id, p.name, specialTag, specialTag).Inc()
+	// the instances of the stack are never reported removed
+	extendingTotalInstanceBootstraps.WithLabelValues(p.id, p.name, "shop", "api", "shop-api-1").Inc()
+	extendingTotalInstanceBootstraps.WithLabelValues(p.id, p.name, "shop", "api", specialTag).Inc()
+	extendingInstanceBootstrapMsCost.WithLabelValues(p.id, p.name, "shop", "api", "shop-api-1", "false", "container").Set(1000)
+
+	time.Sleep(2 * staleSeriesRetention)
+	p.cleanStaleSeries()
+
+	for _, vec := range []*aggregatedCounterVec{extendingTotalServiceBootstraps, extendingTotalInstanceBootstraps} {
+		counters, err := collectCounters(vec.name, vec.CounterVec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aggregated := false
+		for _, counter := range counters {
+			if counter.Labels["environment_id"] != p.id {
+				continue
+			}
+			if counter.Labels["stack_name"] == "shop" {
+				t.Errorf("the %s series of stack shop is kept, %v", vec.name, counter.Labels)
+			} else if counter.Labels["stack_name"] == specialTag {
+				aggregated = true
+			}
+		}
+		if vec == extendingTotalServiceBootstraps && !aggregated {
+			t.Errorf("the %s aggregate series of the environment is dropped", vec.name)
+		}
+	}
+
+	counters, err := collectCounters(extendingTotalStackBootstraps.name, extendingTotalStackBootstraps.CounterVec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, counter := range counters {
+		if counter.Labels["environment_id"] == p.id && counter.Labels["name"] == "shop" {
+			t.Errorf("the series of stack shop is kept, %v", counter.Labels)
+		}
+	}
+
+	if deleted := extendingInstanceBootstrapMsCost.DeleteLabelValues(p.id, p.name, "shop", "api", "shop-api-1", "false", "container"); deleted {
+		t.Error("the instance_bootstrap_ms series of stack shop is kept")
+	}
+}
+
+// TestCleanStaleSeriesOfRemovedStackFamilies drops the aggregate families of a removed stack,
+// and keeps the aggregate families of the environment.
+func TestCleanStaleSeriesOfRemovedStackFamilies(t *testing.T) {
+	aggregationMode = aggregationModeFamilies
+	defer func() {
+		aggregationMode = aggregationModeSentinel
+	}()
+
+	p := newOfflineProject("1a6", "Stale")
+	extendingTotalInstanceBootstraps.WithLabelValues(p.id, p.name, "shop", "api", specialTag).Inc()
+	extendingTotalInstanceBootstraps.WithLabelValues(p.id, p.name, "shop", specialTag, specialTag).Inc()
+	extendingTotalInstanceBootstraps.WithLabelValues(p.id, p.name, specialTag, specialTag, specialTag).Inc()
+
+	p.deleteResourceSeries(stackSubpath, []string{"shop"})
+
+	state, err := extendingTotalInstanceBootstraps.collectState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	environment := false
+	for _, counter := range state {
+		if counter.Labels["environment_id"] != p.id {
+			continue
+		}
+		if _, ok := counter.Labels["stack_name"]; ok {
+			t.Errorf("the %s series of stack shop is kept, %v", counter.Name, counter.Labels)
+		} else {
+			environment = true
+		}
+	}
+	if !environment {
+		t.Error("the aggregate series of the environment is dropped")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cnrancher/rancher1.x-exporter/internal/bootstrap"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	logger "github.com/sirupsen/logrus"
+)
+
+// stateFileVersion must be increased whenever the layout of stateFile or the meaning of bootstrap.State changes,
+// a state file of another version is ignored instead of being restored.
+const stateFileVersion = 1
+
+type stateFile struct {
+	Version  int             `json:"version"`
+	SavedAt  time.Time       `json:"savedAt"`
+	Counters []stateCounter  `json:"counters"`
+	States   stateFileStates `json:"states"`
+}
+
+type stateCounter struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+type stateFileStates struct {
+	Stacks        map[string]bootstrap.State `json:"stacks"`
+	Services      map[string]bootstrap.State `json:"services"`
+	Instances     map[string]bootstrap.State `json:"instances"`
+	StackServices map[string]bootstrap.State `json:"stackServices"`
+	// missing in the files saved before the bootstrap durations were observed
+	Since map[string]time.Time `json:"since,omitempty"`
+}
+
+// persistedCounters are the counters accumulated from the websocket events,
+// the initialization counters are not persisted as they are recounted at every startup.
+var persistedCounters = []*aggregatedCounterVec{
+	extendingTotalStackBootstraps,
+	extendingTotalSuccessStackBootstrap,
+	extendingTotalErrorStackBootstrap,
+	extendingTotalServiceBootstraps,
+	extendingTotalSuccessServiceBootstrap,
+	extendingTotalErrorServiceBootstrap,
+	extendingTotalInstanceBootstraps,
+	extendingTotalSuccessInstanceBootstrap,
+	extendingTotalErrorInstanceBootstrap,
+	extendingTotalTimeoutStackBootstrap,
+	extendingTotalTimeoutServiceBootstrap,
+	extendingTotalTimeoutInstanceBootstrap,
+	extendingTotalServiceUpgrades,
+	extendingTotalFinishedServiceUpgrade,
+	extendingTotalRollbackServiceUpgrade,
+	extendingTotalErrorServiceUpgrade,
+	extendingTotalServiceHealthTransitions,
+	extendingTotalInstanceHealthTransitions,
+	extendingTotalStackStateSeconds,
+	extendingTotalServiceStateSeconds,
+	extendingTotalHostStateSeconds,
+}
+
+// persistedCounter finds the persisted counter of a name in the state file, which is the name of the counter or its aggregate.
+func persistedCounter(name string) (*aggregatedCounterVec, bool) {
+	for _, vec := range persistedCounters {
+		if vec.name == name {
+			return vec, true
+		}
+		for _, aggregateName := range vec.aggregateNames {
+			if aggregateName == name {
+				return vec, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// saveState writes the persisted counters and the in-flight states to stateFilePath,
+// the file is replaced atomically by renaming a temporary file in the same directory.
+func (r *rancherExporter) saveState() error {
+	if len(stateFilePath) == 0 {
+		return nil
+	}
+
+	sf := &stateFile{
+		Version: stateFileVersion,
+		SavedAt: time.Now(),
+	}
+
+	// the counters are collected with the in-flight states under the mutex which the msg event handler counts them with,
+	// so a bootstrap is either in-flight or counted in the file
+	r.states.mutex.Lock()
+	r.states.timelines.flush(r.clock())
+	for _, vec := range persistedCounters {
+		counters, err := vec.collectState()
+		if err != nil {
+			r.states.mutex.Unlock()
+			return err
+		}
+		sf.Counters = append(sf.Counters, counters...)
+	}
+
+	snapshot := r.states.machine.Snapshot()
+	sf.States = stateFileStates{
+		Stacks:        snapshot.Stacks,
+		Services:      snapshot.Services,
+		Instances:     snapshot.Instances,
+		StackServices: snapshot.StackServices,
+		Since:         make(map[string]time.Time, len(r.states.since)),
+	}
+	for id, since := range r.states.since {
+		sf.States.Since[id] = since
+	}
+	r.states.mutex.Unlock()
+
+	data, err := json.Marshal(sf)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(stateFilePath), filepath.Base(stateFilePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), stateFilePath)
+}
+
+// restoreState loads stateFilePath if it exists, it must be called before the msg event handler starts.
+func (r *rancherExporter) restoreState() error {
+	if len(stateFilePath) == 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(stateFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	sf := &stateFile{}
+	if err := json.Unmarshal(data, sf); err != nil {
+		return err
+	}
+	if sf.Version != stateFileVersion {
+		return fmt.Errorf("version %d of state file %s is not %d", sf.Version, stateFilePath, stateFileVersion)
+	}
+
+	r.states.mutex.Lock()
+	defer r.states.mutex.Unlock()
+
+	for _, counter := range sf.Counters {
+		vec, ok := persistedCounter(counter.Name)
+		if !ok {
+			continue
+		}
+		vec.restore(counter.Labels, counter.Value)
+	}
+	r.states.machine.Restore(bootstrap.Snapshot{
+		Stacks:        sf.States.Stacks,
+		Services:      sf.States.Services,
+		Instances:     sf.States.Instances,
+		StackServices: sf.States.StackServices,
+	})
+	for id, since := range sf.States.Since {
+		r.states.since[id] = since
+	}
+
+	logger.Infof("restored %d counters and %d in-flight stacks, %d services, %d instances saved at %v",
+		len(sf.Counters), len(sf.States.Stacks), len(sf.States.Services), len(sf.States.Instances), sf.SavedAt)
+	return nil
+}
+
+func (r *rancherExporter) saveStatePeriodically() {
+	if len(stateFilePath) == 0 || stateSnapshotInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(stateSnapshotInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := r.saveState(); err != nil {
+			logger.Warnf("failed to save state file %s, %v", stateFilePath, err)
+		}
+	}
+}
+
+func collectCounters(name string, vec *prometheus.CounterVec) ([]stateCounter, error) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+
+	var result []stateCounter
+	var err error
+	for metric := range ch {
+		pb := &dto.Metric{}
+		if writeErr := metric.Write(pb); writeErr != nil {
+			err = writeErr
+			continue
+		}
+
+		labels := make(map[string]string, len(pb.GetLabel()))
+		for _, label := range pb.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		result = append(result, stateCounter{
+			Name:   name,
+			Labels: labels,
+			Value:  pb.GetCounter().GetValue(),
+		})
+	}
+	return result, err
+}
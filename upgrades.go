@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/buger/jsonparser"
+	logger "github.com/sirupsen/logrus"
+)
+
+// upgradeStatus is the stage of an in-flight upgrade of a service.
+type upgradeStatus int
+
+const (
+	// the service is upgrading
+	upgradeInProgress upgradeStatus = iota
+	// the service is upgraded and waits for finishing or rolling back the upgrade
+	upgradePending
+)
+
+type serviceUpgrade struct {
+	status    upgradeStatus
+	stackName string
+	name      string
+	oldImage  string
+	newImage  string
+}
+
+// serviceUpgrades are the in-flight upgrades of the services by their ids, they are only changed by the msg event handler.
+//
+// A service goes upgrading -> upgraded, then finishing_upgrade -> active after "finish upgrade",
+// or rolling_back -> active after "rollback". The websocket may skip the transitional states, e.g. a rollback of an upgraded service
+// is reported as active(initializing), then the old instances are reinitialized as running(updating-reinitializing),
+// so an upgraded service which turns active is rolled back once an old instance is reinitializing, or finished once it is healthy.
+type serviceUpgrades map[string]*serviceUpgrade
+
+func newServiceUpgrade(msg *buffMsg) *serviceUpgrade {
+	return &serviceUpgrade{
+		status:    upgradeInProgress,
+		stackName: msg.stackName,
+		name:      msg.name,
+		oldImage:  msg.previousImage,
+		newImage:  msg.image,
+	}
+}
+
+// upgradeImages returns the images of the previous and the current launch configs of a service,
+// the previous one is only set by an upgrade.
+func upgradeImages(serviceBytes []byte) (string, string) {
+	oldImage, _ := jsonparser.GetString(serviceBytes, "upgrade", "inServiceStrategy", "previousLaunchConfig", "imageUuid")
+	newImage, _ := jsonparser.GetString(serviceBytes, "launchConfig", "imageUuid")
+	return oldImage, newImage
+}
+
+// handle counts the upgrade transitions of a service, or the rollback of a service by the reinitializing old instance.
+func (u serviceUpgrades) handle(msg *buffMsg) {
+	switch msg.class {
+	case "instance":
+		if upgrade, ok := u[msg.parentId]; ok && msg.healthState == "updating-reinitializing" {
+			upgrade.count(extendingTotalRollbackServiceUpgrade, msg.project, "rollback")
+			delete(u, msg.parentId)
+		}
+		return
+	case "service":
+	default:
+		return
+	}
+
+	upgrade, tracked := u[msg.id]
+	switch msg.state {
+	case "upgrading":
+		if !tracked {
+			upgrade = newServiceUpgrade(msg)
+			upgrade.count(extendingTotalServiceUpgrades, msg.project, "count")
+			u[msg.id] = upgrade
+		}
+		return
+	case "upgraded":
+		if !tracked && msg.healthState != "unhealthy" {
+			// the upgrade is started before the exporter, it is tracked without being counted
+			upgrade = newServiceUpgrade(msg)
+			u[msg.id] = upgrade
+		}
+		if upgrade != nil {
+			upgrade.status = upgradePending
+		}
+	}
+
+	// the outcomes are only counted once for the tracked upgrades, as Rancher reports a transitional state repeatedly
+	if !tracked {
+		return
+	}
+
+	switch msg.state {
+	case "upgraded":
+		if msg.healthState == "unhealthy" {
+			upgrade.count(extendingTotalErrorServiceUpgrade, msg.project, "error")
+			delete(u, msg.id)
+		}
+	case "finishing_upgrade":
+		upgrade.count(extendingTotalFinishedServiceUpgrade, msg.project, "finished")
+		delete(u, msg.id)
+	case "rolling_back":
+		upgrade.count(extendingTotalRollbackServiceUpgrade, msg.project, "rollback")
+		delete(u, msg.id)
+	case "canceling_upgrade", "canceled_upgrade", "inactive", "removing", "removed":
+		upgrade.count(extendingTotalErrorServiceUpgrade, msg.project, "error")
+		delete(u, msg.id)
+	case "active":
+		switch {
+		case upgrade.status == upgradeInProgress:
+			// the upgrade is reverted before the service is upgraded
+			upgrade.count(extendingTotalRollbackServiceUpgrade, msg.project, "rollback")
+			delete(u, msg.id)
+		case msg.healthState == "healthy":
+			upgrade.count(extendingTotalFinishedServiceUpgrade, msg.project, "finished")
+			delete(u, msg.id)
+		case msg.healthState == "unhealthy":
+			upgrade.count(extendingTotalErrorServiceUpgrade, msg.project, "error")
+			delete(u, msg.id)
+		}
+	}
+}
+
+// track starts tracking the upgrades of the services listed upgrading or upgraded, but not unhealthy, without counting them,
+// which are started before the exporter or while the websocket was disconnected.
+func (u serviceUpgrades) track(p *project) {
+	var upgrading [][]byte
+	p.inventory.foreach(serviceSubpath, func(data []byte) {
+		state, _ := jsonparser.GetString(data, "state")
+		healthState, _ := jsonparser.GetString(data, "healthState")
+		if state == "upgrading" || state == "upgraded" && healthState != "unhealthy" {
+			upgrading = append(upgrading, append([]byte(nil), data...))
+		}
+	})
+
+	for _, data := range upgrading {
+		msg, ok := p.newBuffMsg("service", data)
+		if _, tracked := u[msg.id]; !ok || tracked {
+			continue
+		}
+		upgrade := newServiceUpgrade(&msg)
+		if msg.state == "upgraded" {
+			upgrade.status = upgradePending
+		}
+		u[msg.id] = upgrade
+	}
+}
+
+func (upgrade *serviceUpgrade) count(counter *aggregatedCounterVec, p *project, outcome string) {
+	counter.WithLabelValues(p.id, p.name, upgrade.stackName, upgrade.name, upgrade.oldImage, upgrade.newImage).Inc()
+	logger.Infof("service [%s] upgrade %s + 1, %s -> %s", upgrade.name, outcome, upgrade.oldImage, upgrade.newImage)
+}
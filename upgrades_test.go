@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestServiceUpgrades(t *testing.T) {
+	aggregationMode = aggregationModeSentinel
+	p := newOfflineProject("1a8", "Upgrades")
+
+	service := func(name, state, healthState string) buffMsg {
+		return buffMsg{
+			project:       p,
+			class:         "service",
+			id:            "1s-" + name,
+			name:          name,
+			state:         state,
+			healthState:   healthState,
+			stackName:     "shop",
+			previousImage: "docker:nginx:1.18",
+			image:         "docker:nginx:1.19",
+		}
+	}
+	oldInstance := func(name string) buffMsg {
+		return buffMsg{project: p, class: "instance", id: "1i-" + name, parentId: "1s-" + name, state: "running", healthState: "updating-reinitializing"}
+	}
+
+	counters := map[string]*aggregatedCounterVec{
+		"count":    extendingTotalServiceUpgrades,
+		"finished": extendingTotalFinishedServiceUpgrade,
+		"rollback": extendingTotalRollbackServiceUpgrade,
+		"error":    extendingTotalErrorServiceUpgrade,
+	}
+	// the counters are package-level, so they are reset for the cases only
+	for _, counter := range counters {
+		counter.Reset()
+	}
+
+	for _, c := range []struct {
+		name string
+		msgs func(name string) []buffMsg
+		want map[string]float64
+	}{
+		{
+			name: "finish",
+			msgs: func(name string) []buffMsg {
+				return []buffMsg{
+					service(name, "upgrading", "degraded"), service(name, "upgrading", "initializing"), service(name, "upgraded", "healthy"),
+					service(name, "finishing_upgrade", "healthy"), service(name, "finishing_upgrade", "healthy"), service(name, "active", "healthy"),
+				}
+			},
+			want: map[string]float64{"count": 1, "finished": 1},
+		},
+		{
+			name: "finish without transitional state",
+			msgs: func(name string) []buffMsg {
+				return []buffMsg{service(name, "upgrading", "initializing"), service(name, "upgraded", "healthy"), service(name, "active", "healthy")}
+			},
+			want: map[string]float64{"count": 1, "finished": 1},
+		},
+		{
+			name: "rollback by old instance",
+			msgs: func(name string) []buffMsg {
+				return []buffMsg{
+					service(name, "upgrading", "degraded"), service(name, "upgraded", "healthy"),
+					service(name, "active", "initializing"), oldInstance(name), service(name, "active", "healthy"),
+				}
+			},
+			want: map[string]float64{"count": 1, "rollback": 1},
+		},
+		{
+			name: "rollback",
+			msgs: func(name string) []buffMsg {
+				return []buffMsg{service(name, "upgrading", "degraded"), service(name, "upgraded", "healthy"), service(name, "rolling_back", "healthy"), oldInstance(name)}
+			},
+			want: map[string]float64{"count": 1, "rollback": 1},
+		},
+		{
+			name: "rollback before upgraded",
+			msgs: func(name string) []buffMsg {
+				return []buffMsg{service(name, "upgrading", "degraded"), service(name, "active", "initializing")}
+			},
+			want: map[string]float64{"count": 1, "rollback": 1},
+		},
+		{
+			name: "canceled",
+			msgs: func(name string) []buffMsg {
+				return []buffMsg{service(name, "upgrading", "degraded"), service(name, "canceling_upgrade", "degraded"), service(name, "canceled_upgrade", "degraded")}
+			},
+			want: map[string]float64{"count": 1, "error": 1},
+		},
+		{
+			name: "unhealthy",
+			msgs: func(name string) []buffMsg {
+				return []buffMsg{service(name, "upgrading", "initializing"), service(name, "upgraded", "unhealthy"), service(name, "upgraded", "unhealthy")}
+			},
+			want: map[string]float64{"count": 1, "error": 1},
+		},
+		{
+			name: "started before the exporter",
+			msgs: func(name string) []buffMsg {
+				return []buffMsg{service(name, "upgraded", "healthy"), service(name, "finishing_upgrade", "healthy")}
+			},
+			want: map[string]float64{"finished": 1},
+		},
+		{
+			name: "not upgraded",
+			msgs: func(name string) []buffMsg {
+				return []buffMsg{service(name, "active", "healthy"), service(name, "finishing_upgrade", "healthy"), oldInstance(name)}
+			},
+			want: map[string]float64{},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			upgrades := make(serviceUpgrades)
+			for _, msg := range c.msgs(c.name) {
+				upgrades.handle(&msg)
+			}
+			if len(upgrades) != 0 {
+				t.Errorf("%d upgrades are still tracked", len(upgrades))
+			}
+
+			for outcome, counter := range counters {
+				states, err := collectCounters(counter.name, counter.CounterVec)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := 0.0
+				for _, state := range states {
+					if state.Labels["environment_id"] == p.id && state.Labels["name"] == c.name {
+						if state.Labels["old_image"] != "docker:nginx:1.18" || state.Labels["new_image"] != "docker:nginx:1.19" {
+							t.Errorf("%s is labeled by %v", counter.name, state.Labels)
+						}
+						got += state.Value
+					}
+				}
+				if got != c.want[outcome] {
+					t.Errorf("%s = %v, want %v", counter.name, got, c.want[outcome])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// webAuth protects the paths of the exporter endpoint with the basic auth or the bearer token,
+// a request passes with either of them if both are configured.
+type webAuth struct {
+	username    string
+	password    string
+	bearerToken string
+
+	// a path ending with '/' protects all the paths under it
+	paths []string
+}
+
+func newWebAuth() (*webAuth, error) {
+	if len(webAuthPassword) != 0 && len(webAuthUsername) == 0 {
+		return nil, errors.New("web_auth_username must be set with web_auth_password")
+	}
+
+	a := &webAuth{
+		username:    webAuthUsername,
+		password:    webAuthPassword,
+		bearerToken: webAuthBearerToken,
+	}
+	for _, path := range strings.Split(webAuthPaths, ",") {
+		if path = strings.TrimSpace(path); len(path) != 0 {
+			a.paths = append(a.paths, path)
+		}
+	}
+	if len(a.paths) == 0 {
+		a.paths = []string{metricPath}
+	}
+	return a, nil
+}
+
+func (a *webAuth) enabled() bool {
+	return len(a.username) != 0 || len(a.bearerToken) != 0
+}
+
+func (a *webAuth) protects(path string) bool {
+	for _, p := range a.paths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *webAuth) authorized(r *http.Request) bool {
+	if len(a.username) != 0 {
+		if username, password, ok := r.BasicAuth(); ok &&
+			subtle.ConstantTimeCompare([]byte(username), []byte(a.username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1 {
+			return true
+		}
+	}
+	if len(a.bearerToken) != 0 {
+		authorization := r.Header.Get("Authorization")
+		if strings.HasPrefix(authorization, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(a.bearerToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *webAuth) wrap(handler http.Handler) http.Handler {
+	if !a.enabled() {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.protects(r.URL.Path) && !a.authorized(r) {
+			if len(a.username) != 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="rancher_exporter"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="rancher_exporter"`)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// newWebTLSConfig returns nil if the exporter endpoint is served without TLS,
+// the client certificates are required and verified if the client CA is configured.
+func newWebTLSConfig() (*tls.Config, error) {
+	if len(webTLSCertFile) == 0 && len(webTLSKeyFile) == 0 {
+		if len(webTLSClientCAFile) != 0 {
+			return nil, errors.New("web_tls_cert_file and web_tls_key_file must be set with web_tls_client_ca_file")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(webTLSCertFile, webTLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load certificate %s and key %s, %v", webTLSCertFile, webTLSKeyFile, err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(webTLSClientCAFile) != 0 {
+		ca, err := ioutil.ReadFile(webTLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read client CA file %s, %v", webTLSClientCAFile, err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate in client CA file %s", webTLSClientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// newWebServer serves the handler on the listen address with the TLS and the authentication of the exporter endpoint.
+func newWebServer(handler http.Handler) (*http.Server, error) {
+	auth, err := newWebAuth()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newWebTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Server{
+		Addr:      listenAddress,
+		Handler:   auth.wrap(handler),
+		TLSConfig: tlsConfig,
+	}, nil
+}
+
+func serveWeb(server *http.Server, listener net.Listener) error {
+	if server.TLSConfig != nil {
+		// the certificate is loaded in the TLS config
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	websocketMinBackoff   = time.Second
+	websocketWriteTimeout = 10 * time.Second
+)
+
+func initWebsocketBackoff() error {
+	if websocketMaxBackoff < websocketMinBackoff {
+		return fmt.Errorf("websocket_max_backoff %v is less than %v", websocketMaxBackoff, websocketMinBackoff)
+	}
+	return nil
+}
+
+// maxWebsocketBackoff returns the maximum delay between the reconnections, which is never less than websocketMinBackoff.
+func maxWebsocketBackoff() time.Duration {
+	if websocketMaxBackoff < websocketMinBackoff {
+		return websocketMinBackoff
+	}
+	return websocketMaxBackoff
+}
+
+func (p *project) dial() (*websocket.Conn, error) {
+	client := getHttpClient()
+	httpHeaders := http.Header{}
+	httpHeaders.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(client.ak+":"+client.sk)))
+	wbs, _, err := client.dialer.Dial(p.subscribeAddress, httpHeaders)
+	if err != nil {
+		return nil, err
+	}
+	exporterWebsocketConnections.WithLabelValues(p.id, p.name).Inc()
+
+	return wbs, nil
+}
+
+// connect dials the subscription with an exponential backoff and jitter until it succeeds,
+// the environment is left disconnected and retried every websocketMaxBackoff once the subscription is failed for websocketReconnectTimeout.
+// It returns nil if the websocket is closed for shutting down.
+func (p *project) connect() *websocket.Conn {
+	start := time.Now()
+	backoff := websocketMinBackoff
+	exceeded := false
+
+	for {
+		if p.isClosing() {
+			return nil
+		}
+
+		wbs, err := p.dial()
+		if err == nil {
+			p.keepalive(wbs)
+			p.setConnected(true)
+			return wbs
+		}
+
+		// full jitter keeps the exporter replicas from reconnecting at the same moment
+		sleep := time.Duration(rand.Int63n(int64(backoff))) + websocketMinBackoff/2
+		switch {
+		case websocketReconnectTimeout <= 0 || time.Since(start) <= websocketReconnectTimeout:
+			logger.Warnf("failed to connect websocket of environment [%s], retry in %v, %v", p.name, sleep, err)
+		case !exceeded:
+			exceeded = true
+			sleep = maxWebsocketBackoff()
+			logger.Errorf("failed to connect websocket of environment [%s] in %v, retry every %v, %v", p.name, websocketReconnectTimeout, sleep, err)
+		default:
+			sleep = maxWebsocketBackoff()
+			logger.Debugf("failed to connect websocket of environment [%s], retry in %v, %v", p.name, sleep, err)
+		}
+
+		select {
+		case <-time.After(sleep):
+		case <-p.done:
+			return nil
+		}
+
+		if backoff *= 2; backoff > maxWebsocketBackoff() {
+			backoff = maxWebsocketBackoff()
+		}
+	}
+}
+
+// keepalive pings the server periodically, a half-open connection is detected by the read deadline,
+// which is extended by any received message or pong.
+func (p *project) keepalive(wbs *websocket.Conn) {
+	if websocketPingInterval <= 0 {
+		return
+	}
+
+	_ = wbs.SetReadDeadline(websocketReadDeadline())
+	wbs.SetPongHandler(func(string) error {
+		return wbs.SetReadDeadline(websocketReadDeadline())
+	})
+
+	go func() {
+		ticker := time.NewTicker(websocketPingInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := wbs.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteTimeout)); err != nil {
+				logger.Debugf("stop pinging websocket of environment [%s], %v", p.name, err)
+				return
+			}
+		}
+	}()
+}
+
+func websocketReadDeadline() time.Time {
+	if websocketPingInterval <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(2 * websocketPingInterval)
+}
+
+func (p *project) getWebsocketConn() *websocket.Conn {
+	p.websocketMutex.Lock()
+	defer p.websocketMutex.Unlock()
+	return p.websocketConn
+}
+
+// setWebsocketConn replaces the websocket, the new one is closed at once if the project is closing.
+func (p *project) setWebsocketConn(wbs *websocket.Conn) bool {
+	p.websocketMutex.Lock()
+	defer p.websocketMutex.Unlock()
+
+	if p.closing {
+		closeWebsocket(wbs)
+		return false
+	}
+	p.websocketConn = wbs
+	return true
+}
+
+func (p *project) isClosing() bool {
+	p.websocketMutex.Lock()
+	defer p.websocketMutex.Unlock()
+	return p.closing
+}
+
+// close stops reconnecting the websocket and sends the close frame,
+// watchEvents returns once the server replies the close frame or the read deadline is exceeded.
+func (p *project) close() {
+	p.websocketMutex.Lock()
+	defer p.websocketMutex.Unlock()
+
+	if !p.closing {
+		p.closing = true
+		close(p.done)
+	}
+	if p.websocketConn != nil {
+		closeWebsocket(p.websocketConn)
+	}
+}
+
+func closeWebsocket(wbs *websocket.Conn) {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "exporter is shutting down")
+	_ = wbs.WriteControl(websocket.CloseMessage, message, time.Now().Add(websocketWriteTimeout))
+	_ = wbs.SetReadDeadline(time.Now().Add(websocketWriteTimeout))
+}
+
+func (p *project) setConnected(connected bool) {
+	if connected {
+		atomic.StoreInt32(&p.connected, 1)
+		exporterWebsocketConnected.WithLabelValues(p.id, p.name).Set(1)
+	} else {
+		atomic.StoreInt32(&p.connected, 0)
+		exporterWebsocketConnected.WithLabelValues(p.id, p.name).Set(0)
+	}
+}
+
+func (p *project) isConnected() bool {
+	return atomic.LoadInt32(&p.connected) == 1
+}
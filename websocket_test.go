@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectKeepsRetryingAfterTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing listens on the address anymore
+	address := listener.Addr().String()
+	_ = listener.Close()
+
+	cattleURL = "http://" + address + "/v2-beta"
+	timeout = time.Second
+	// an invalid maximum backoff is rejected at startup, and never spins or panics the reconnections
+	websocketMaxBackoff = 0
+	websocketReconnectTimeout = time.Nanosecond
+	defer func() {
+		websocketMaxBackoff = time.Minute
+		websocketReconnectTimeout = 0
+	}()
+	if err := initWebsocketBackoff(); err == nil {
+		t.Error("websocket_max_backoff 0 is accepted")
+	}
+	if err := initHttpClient(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newOfflineProject("1a9", "Unreachable")
+	p.subscribeAddress = "ws://" + address + "/v2-beta/projects/1a9/subscribe"
+
+	connected := make(chan bool)
+	go func() {
+		connected <- p.connect() != nil
+	}()
+
+	// the reconnections are retried at least once after the timeout
+	select {
+	case <-connected:
+		t.Fatal("connect returned before the environment is closed")
+	case <-time.After(websocketMinBackoff + 200*time.Millisecond):
+	}
+	if p.isConnected() {
+		t.Error("the environment is connected")
+	}
+
+	p.close()
+	select {
+	case ok := <-connected:
+		if ok {
+			t.Error("connect returned a websocket after the environment is closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connect is not stopped by closing the environment")
+	}
+}